@@ -2,28 +2,175 @@
 package auth
 
 import (
-	"bufio"
 	"crypto/hmac"
+	"crypto/md5" //nolint:gosec // CRAM-MD5 is defined in terms of HMAC-MD5 (RFC 2195)
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
-	"net"
 	"net/textproto"
 	"os"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	oauthUserRe = regexp.MustCompile(`user=([^,\x01]+)`)
+	oauthUserRe   = regexp.MustCompile(`user=([^,\x01]+)`)
+	oauthBearerRe = regexp.MustCompile(`auth=Bearer ([^\x01]+)`)
+
+	// cramCounter makes CRAM challenges unique within a process
+	cramCounter atomic.Int64
 )
 
+// ErrCancelled is returned when the client cancels an exchange by answering a
+// challenge with "*" (RFC 4954 section 4).
+var ErrCancelled = errors.New("authentication cancelled")
+
 // Handler is the interface for authentication handlers.
+// Authenticate runs the SASL exchange over ex and returns what the client supplied;
+// checking the credentials is left to the caller. parts is the AUTH command split on
+// spaces, so parts[2] is the initial response if one was sent. On error the returned
+// Credentials may be nil or hold whatever was received before the exchange failed.
 type Handler interface {
-	Authenticate(conn net.Conn, parts []string) (string, error)
+	Authenticate(ex *Exchange, parts []string) (*Credentials, error)
+}
+
+// ReplyWriter sends a single reply line to the client.
+type ReplyWriter interface {
+	WriteResponse(response string) error
+}
+
+// Exchange carries the challenges and responses of a SASL exchange. Responses are read
+// through the session's own reader, so bytes the client pipelined are neither lost nor
+// taken from the command stream, and the current (possibly TLS) connection is used.
+type Exchange struct {
+	w ReplyWriter
+	r *textproto.Reader
+}
+
+// NewExchange creates an exchange that writes challenges to w and reads responses from r.
+func NewExchange(w ReplyWriter, r *textproto.Reader) *Exchange {
+	return &Exchange{w: w, r: r}
+}
+
+// Challenge sends a 334 continuation with payload base64-encoded (an empty payload sends
+// "334 ") and returns the decoded response. A "*" response returns ErrCancelled.
+func (ex *Exchange) Challenge(payload []byte) ([]byte, error) {
+	line, err := ex.challengeText(base64.StdEncoding.EncodeToString(payload))
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64")
+	}
+	return decoded, nil
+}
+
+// challengeText sends "334 <text>" as is and returns the client's raw response line.
+func (ex *Exchange) challengeText(text string) (string, error) {
+	if err := ex.w.WriteResponse("334 " + text); err != nil {
+		return "", err
+	}
+	line, err := ex.r.ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	if line == "*" {
+		return "", ErrCancelled
+	}
+	return line, nil
+}
+
+// InitialResponse returns the decoded initial response from the AUTH command, or
+// (nil, nil) when none was sent. "=" is the empty initial response.
+func InitialResponse(parts []string) ([]byte, error) {
+	if len(parts) < 3 {
+		return nil, nil
+	}
+	if parts[2] == "=" {
+		return []byte{}, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64")
+	}
+	return decoded, nil
+}
+
+// response returns the initial response if the client sent one, and otherwise sends an
+// empty challenge and returns the client's answer.
+func (ex *Exchange) response(parts []string) ([]byte, error) {
+	initial, err := InitialResponse(parts)
+	if err != nil || initial != nil {
+		return initial, err
+	}
+	return ex.Challenge(nil)
+}
+
+// Credentials holds the identity and proof supplied by a client during AUTH.
+type Credentials struct {
+	Mechanism string // SASL mechanism used, e.g. "PLAIN"
+	Username  string // Authentication identity
+	Authzid   string // Authorization identity (PLAIN only; usually empty)
+	Domain    string // Domain the user belongs to (NTLM)
+	Password  string // Cleartext password (PLAIN, LOGIN)
+	Challenge string // Challenge sent by the server (CRAM-*), the AuthMessage (SCRAM-*), or the hex server challenge (NTLM)
+	Response  string // Hex HMAC digest (CRAM-*), the base64 ClientProof (SCRAM-*), or the hex NT response (NTLM)
+	Token     string // Bearer token (XOAUTH2, OAUTHBEARER)
+
+	Salt           []byte // Salt offered to the client (SCRAM-*)
+	Iterations     int    // Iteration count offered to the client (SCRAM-*)
+	ChannelBinding string // Channel binding type used, e.g. "tls-exporter" (SCRAM-*-PLUS)
+
+	Claims      *TokenClaims      // Claims of a bearer token checked by a TokenValidator
+	Certificate *x509.Certificate // Verified TLS client certificate (EXTERNAL)
+}
+
+// Verify reports whether the credentials prove knowledge of secret: the password for
+// PLAIN, LOGIN and SCRAM, the HMAC key for CRAM-MD5 and CRAM-SHA256, or the token for
+// XOAUTH2 and OAUTHBEARER. EXTERNAL has no secret, and NTLM responses are not checked
+// without a domain controller, so neither ever verifies.
+func (c *Credentials) Verify(secret string) bool {
+	if c == nil {
+		return false
+	}
+	switch strings.ToUpper(c.Mechanism) {
+	case AuthMechanismPlain, AuthMechanismLogin:
+		return subtle.ConstantTimeCompare([]byte(c.Password), []byte(secret)) == 1
+	case AuthMechanismCramMD5, AuthMechanismCramSHA256:
+		hashFunc := cramHashFunc(c.Mechanism)
+		mac := hmac.New(hashFunc, []byte(secret))
+		mac.Write([]byte(c.Challenge))
+		expected := hex.EncodeToString(mac.Sum(nil))
+		return subtle.ConstantTimeCompare([]byte(strings.ToLower(c.Response)), []byte(expected)) == 1
+	case AuthMechanismXOAuth2, AuthMechanismOAuthBearer:
+		return subtle.ConstantTimeCompare([]byte(c.Token), []byte(secret)) == 1
+	case AuthMechanismScramSHA1, AuthMechanismScramSHA1Plus, AuthMechanismScramSHA256, AuthMechanismScramSHA256Plus:
+		proof, err := base64.StdEncoding.DecodeString(c.Response)
+		if err != nil {
+			return false
+		}
+		return scramVerifyProof(scramHashFunc(c.Mechanism), secret, c.Salt, c.Iterations, c.Challenge, proof)
+	default:
+		return false
+	}
+}
+
+// cramHashFunc returns the HMAC hash for a CRAM mechanism.
+func cramHashFunc(mechanism string) func() hash.Hash {
+	if strings.EqualFold(mechanism, AuthMechanismCramMD5) {
+		return md5.New
+	}
+	return sha256.New
 }
 
 // PlainHandler implements the PLAIN authentication mechanism.
@@ -39,153 +186,117 @@ type CramHandler struct {
 }
 
 // XOAuth2Handler implements the XOAUTH2 authentication mechanism.
-type XOAuth2Handler struct{}
+type XOAuth2Handler struct {
+	// Validator checks the bearer token; nil accepts any token.
+	Validator *TokenValidator
+}
 
 // Authenticate handles PLAIN authentication.
-func (h *PlainHandler) Authenticate(conn net.Conn, parts []string) (string, error) {
-	var authData string
-
-	// Check if auth data is provided in the command args (AUTH PLAIN <data>)
-	if len(parts) >= 3 {
-		authData = parts[2]
-	} else if len(parts) == 2 {
-		// Interactive mode - read from connection using textproto
-		br := bufio.NewReader(conn)
-		tp := textproto.NewReader(br)
-		if line, err := tp.ReadLine(); err == nil {
-			authData = strings.TrimSpace(line)
-		}
-	} else {
-		return "", fmt.Errorf("invalid PLAIN command")
-	}
-
-	if authData == "" {
-		return "", fmt.Errorf("no auth data provided")
+func (h *PlainHandler) Authenticate(ex *Exchange, parts []string) (*Credentials, error) {
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid PLAIN command")
 	}
-
-	decoded, err := base64.StdEncoding.DecodeString(authData)
+	decoded, err := ex.response(parts)
 	if err != nil {
-		return "", fmt.Errorf("invalid base64")
+		return nil, err
+	}
+	if len(decoded) == 0 {
+		return nil, fmt.Errorf("no auth data provided")
 	}
 
-	// PLAIN format: \0username\0password
+	// PLAIN format: authzid\0username\0password
 	authParts := strings.SplitN(string(decoded), "\x00", 3)
 	if len(authParts) != 3 {
-		return "", fmt.Errorf("invalid PLAIN format")
+		return nil, fmt.Errorf("invalid PLAIN format")
 	}
 
-	return authParts[1], nil
+	return &Credentials{
+		Mechanism: AuthMechanismPlain,
+		Authzid:   authParts[0],
+		Username:  authParts[1],
+		Password:  authParts[2],
+	}, nil
 }
 
-// Authenticate handles LOGIN authentication.
-func (h *LoginHandler) Authenticate(conn net.Conn, _ []string) (string, error) {
-	// Send username prompt
-	usernamePrompt := "334 " + base64.StdEncoding.EncodeToString([]byte("Username:"))
-	if _, err := conn.Write([]byte(usernamePrompt + "\r\n")); err != nil {
-		return "", err
-	}
-
-	br := bufio.NewReader(conn)
-	tp := textproto.NewReader(br)
-	usernameLine, err := tp.ReadLine()
-	if err != nil {
-		return "", fmt.Errorf("failed to read username")
-	}
-	usernameB64 := strings.TrimSpace(usernameLine)
-	username, err := base64.StdEncoding.DecodeString(usernameB64)
+// Authenticate handles LOGIN authentication. The username may be sent as an initial
+// response (AUTH LOGIN <base64 username>), skipping the username prompt.
+func (h *LoginHandler) Authenticate(ex *Exchange, parts []string) (*Credentials, error) {
+	username, err := InitialResponse(parts)
 	if err != nil {
-		return "", fmt.Errorf("invalid username encoding")
+		return nil, fmt.Errorf("invalid username encoding")
 	}
-
-	// Send password prompt
-	passwordPrompt := "334 " + base64.StdEncoding.EncodeToString([]byte("Password:"))
-	if _, err := conn.Write([]byte(passwordPrompt + "\r\n")); err != nil {
-		return "", err
+	if username == nil {
+		if username, err = ex.Challenge([]byte("Username:")); err != nil {
+			return nil, err
+		}
 	}
+	creds := &Credentials{Mechanism: AuthMechanismLogin, Username: string(username)}
 
-	passwordLine, err := tp.ReadLine()
+	password, err := ex.Challenge([]byte("Password:"))
 	if err != nil {
-		return "", fmt.Errorf("failed to read password")
+		return creds, err
 	}
 
-	// We don't actually verify the password, just return username
-	_ = strings.TrimSpace(passwordLine)
-	return string(username), nil
+	creds.Password = string(password)
+	return creds, nil
 }
 
 // Authenticate handles CRAM-MD5 and CRAM-SHA256 authentication.
-func (h *CramHandler) Authenticate(conn net.Conn, _ []string) (string, error) {
-	challenge := fmt.Sprintf("<%d.%d@badsmtp.test>", time.Now().Unix(), os.Getpid())
-	challengeB64 := base64.StdEncoding.EncodeToString([]byte(challenge))
-
-	response := "334 " + challengeB64
-	if _, err := conn.Write([]byte(response + "\r\n")); err != nil {
-		return "", err
-	}
-
-	br := bufio.NewReader(conn)
-	tp := textproto.NewReader(br)
-	responseLine, err := tp.ReadLine()
-	if err != nil {
-		return "", fmt.Errorf("failed to read response")
-	}
-	responseB64 := strings.TrimSpace(responseLine)
-	decoded, err := base64.StdEncoding.DecodeString(responseB64)
+func (h *CramHandler) Authenticate(ex *Exchange, _ []string) (*Credentials, error) {
+	challenge := fmt.Sprintf("<%d.%d.%d@badsmtp.test>", time.Now().Unix(), os.Getpid(), cramCounter.Add(1))
+	decoded, err := ex.Challenge([]byte(challenge))
 	if err != nil {
-		return "", fmt.Errorf("invalid response encoding")
+		return nil, err
 	}
 
-	// Parse username from response (format: "username hash")
+	// Parse username and digest from response (format: "username digest")
 	responseParts := strings.SplitN(string(decoded), " ", 2)
 	if len(responseParts) != 2 {
-		return "", fmt.Errorf("invalid response format")
+		return nil, fmt.Errorf("invalid response format")
 	}
 
-	return responseParts[0], nil
+	mechanism := h.Name
+	if mechanism == "" {
+		mechanism = AuthMechanismCramMD5
+	}
+	return &Credentials{
+		Mechanism: mechanism,
+		Username:  responseParts[0],
+		Challenge: challenge,
+		Response:  responseParts[1],
+	}, nil
 }
 
 // Authenticate handles XOAUTH2 authentication.
-func (h *XOAuth2Handler) Authenticate(conn net.Conn, parts []string) (string, error) {
-	var authDataB64 string
-
-	// Check if auth data is provided in the command args (AUTH XOAUTH2 <data>)
-	if len(parts) >= 3 {
-		authDataB64 = parts[2]
-	} else if len(parts) == 2 {
-		// Interactive mode - send challenge and read from connection
-		if _, err := conn.Write([]byte("334 \r\n")); err != nil {
-			return "", err
-		}
-
-		br := bufio.NewReader(conn)
-		tp := textproto.NewReader(br)
-		line, err := tp.ReadLine()
-		if err != nil {
-			return "", fmt.Errorf("failed to read response")
-		}
-		authDataB64 = strings.TrimSpace(line)
-	} else {
-		return "", fmt.Errorf("invalid XOAUTH2 command")
-	}
-
-	if authDataB64 == "" {
-		return "", fmt.Errorf("no auth data provided")
+func (h *XOAuth2Handler) Authenticate(ex *Exchange, parts []string) (*Credentials, error) {
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid XOAUTH2 command")
 	}
-
-	decoded, err := base64.StdEncoding.DecodeString(authDataB64)
+	decoded, err := ex.response(parts)
 	if err != nil {
-		return "", fmt.Errorf("invalid base64")
+		return nil, err
+	}
+	if len(decoded) == 0 {
+		return nil, fmt.Errorf("no auth data provided")
 	}
-
-	// Extract username from OAuth2 string (simplified)
 	authString := string(decoded)
-	matches := oauthUserRe.FindStringSubmatch(authString)
 
-	if len(matches) < 2 {
-		return "", fmt.Errorf("username not found in OAuth2 string")
+	// Extract username and bearer token from OAuth2 string (simplified)
+	creds := &Credentials{Mechanism: AuthMechanismXOAuth2}
+	if m := oauthUserRe.FindStringSubmatch(authString); len(m) == 2 {
+		creds.Username = m[1]
+	}
+	if m := oauthBearerRe.FindStringSubmatch(authString); len(m) == 2 {
+		creds.Token = m[1]
+	}
+	if h.Validator != nil && creds.Token == "" {
+		return creds, fmt.Errorf("bearer token not found in XOAUTH2 string")
 	}
 
-	return matches[1], nil
+	if err := validateBearerToken(ex, h.Validator, creds); err != nil {
+		return creds, err
+	}
+	return creds, nil
 }
 
 const (
@@ -205,33 +316,108 @@ const (
 	AuthMechanismXOAuth2 = "XOAUTH2"
 )
 
+// HandlerOptions carries session state some mechanisms need during the exchange.
+type HandlerOptions struct {
+	// TLSState is the session's TLS state, or nil on a cleartext connection. SCRAM -PLUS
+	// mechanisms take their channel binding data from it.
+	TLSState *tls.ConnectionState
+	// ChannelBinding reports whether SCRAM -PLUS mechanisms were advertised in this
+	// session. Only then is a client's "y" channel binding flag a downgrade.
+	ChannelBinding bool
+	// LookupSecret returns the password for a username. SCRAM needs it mid-exchange to
+	// verify the client proof and to sign the server-final message.
+	LookupSecret func(username string) (secret string, ok bool)
+	// TokenValidator checks XOAUTH2 and OAUTHBEARER bearer tokens. Nil accepts any token.
+	TokenValidator *TokenValidator
+	// PeerCertificate is the client certificate verified during the TLS handshake, or nil.
+	// EXTERNAL is only available with one.
+	PeerCertificate *x509.Certificate
+}
+
 // NewHandler creates a new authentication handler for the specified mechanism.
 func NewHandler(mechanism string) Handler {
+	return NewHandlerWithOptions(mechanism, HandlerOptions{})
+}
+
+// NewHandlerWithOptions creates a new authentication handler for the specified mechanism,
+// passing opts to mechanisms that use them.
+func NewHandlerWithOptions(mechanism string, opts HandlerOptions) Handler {
 	switch strings.ToUpper(mechanism) {
 	case AuthMechanismPlain:
 		return &PlainHandler{}
 	case AuthMechanismLogin:
 		return &LoginHandler{}
 	case AuthMechanismCramMD5:
-		return &CramHandler{HashFunc: sha256.New, Name: AuthMechanismCramMD5}
+		return &CramHandler{HashFunc: md5.New, Name: AuthMechanismCramMD5}
 	case AuthMechanismCramSHA256:
 		return &CramHandler{HashFunc: sha256.New, Name: AuthMechanismCramSHA256}
 	case AuthMechanismXOAuth2:
-		return &XOAuth2Handler{}
+		return &XOAuth2Handler{Validator: opts.TokenValidator}
+	case AuthMechanismOAuthBearer:
+		return &OAuthBearerHandler{Validator: opts.TokenValidator}
+	case AuthMechanismScramSHA1, AuthMechanismScramSHA256:
+		return &ScramHandler{Name: strings.ToUpper(mechanism), TLSState: opts.TLSState, ChannelBinding: opts.ChannelBinding, LookupSecret: opts.LookupSecret}
+	case AuthMechanismScramSHA1Plus, AuthMechanismScramSHA256Plus:
+		// -PLUS is only meaningful over TLS
+		if opts.TLSState == nil {
+			return nil
+		}
+		return &ScramHandler{Name: strings.ToUpper(mechanism), Plus: true, TLSState: opts.TLSState, ChannelBinding: opts.ChannelBinding, LookupSecret: opts.LookupSecret}
+	case AuthMechanismNTLM:
+		return &NTLMHandler{}
+	case AuthMechanismExternal:
+		if opts.PeerCertificate == nil {
+			return nil
+		}
+		return &ExternalHandler{Certificate: opts.PeerCertificate}
 	default:
 		return nil
 	}
 }
 
+// ErrDropConnection is returned by ApplyExchangePatterns when the server should close
+// the connection without replying.
+var ErrDropConnection = errors.New("connection dropped by username pattern")
+
+// Username patterns that make any mechanism misbehave once the client has sent its
+// credentials.
+const (
+	BadChallengePattern   = "authbadchallenge"   // send a 334 continuation that is not base64
+	ExtraChallengePattern = "authextrachallenge" // send one more 334 round before replying
+	DropPattern           = "authdrop"           // close the connection without replying
+)
+
+// ApplyExchangePatterns continues a completed exchange according to the misbehaviour
+// patterns in creds.Username. A bad challenge always fails the exchange: the client
+// should cancel it with "*", which returns ErrCancelled. An extra round succeeds
+// whatever the client answers, unless it cancels.
+func ApplyExchangePatterns(ex *Exchange, creds *Credentials) error {
+	username := strings.ToLower(creds.Username)
+	switch {
+	case strings.Contains(username, DropPattern):
+		return ErrDropConnection
+	case strings.Contains(username, BadChallengePattern):
+		if _, err := ex.challengeText("Not base64: <" + BadChallengePattern + ">"); err != nil {
+			return err
+		}
+		return fmt.Errorf("client answered a malformed challenge")
+	case strings.Contains(username, ExtraChallengePattern):
+		if _, err := ex.challengeText(base64.StdEncoding.EncodeToString([]byte("Additional challenge"))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // IsValidAuth checks if the provided username is valid for authentication.
 func IsValidAuth(username string) bool {
 	return !strings.Contains(username, "badauth")
 }
 
-// GenerateCramResponse generates a CRAM-SHA256 response.
+// GenerateCramResponse generates a CRAM-MD5 response.
 // Helper functions for CRAM authentication
 func GenerateCramResponse(username, password, challenge string) string {
-	h := hmac.New(sha256.New, []byte(password))
+	h := hmac.New(md5.New, []byte(password))
 	h.Write([]byte(challenge))
 	hash := hex.EncodeToString(h.Sum(nil))
 	return username + " " + hash
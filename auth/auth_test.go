@@ -1,9 +1,13 @@
 package auth
 
 import (
+	"bufio"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/textproto"
 	"strings"
 	"testing"
 	"time"
@@ -43,6 +47,27 @@ func (m *mockAuthConn) SetDeadline(time.Time) error      { return nil }
 func (m *mockAuthConn) SetReadDeadline(time.Time) error  { return nil }
 func (m *mockAuthConn) SetWriteDeadline(time.Time) error { return nil }
 
+// connWriter writes replies straight to a connection.
+type connWriter struct{ net.Conn }
+
+func (w connWriter) WriteResponse(response string) error {
+	_, err := io.WriteString(w.Conn, response+"\r\n")
+	return err
+}
+
+// exchangeOver returns an Exchange that talks to the client over conn.
+func exchangeOver(conn net.Conn) *Exchange {
+	return NewExchange(connWriter{conn}, textproto.NewReader(bufio.NewReader(conn)))
+}
+
+// usernameOf returns the username from creds, or "" when the handler returned none.
+func usernameOf(creds *Credentials) string {
+	if creds == nil {
+		return ""
+	}
+	return creds.Username
+}
+
 func TestNewHandler(t *testing.T) {
 	tests := []struct {
 		mechanism string
@@ -135,7 +160,8 @@ func TestPlainHandlerAuthenticate(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			conn := newMockAuthConn([]string{})
-			username, err := handler.Authenticate(conn, test.args)
+			creds, err := handler.Authenticate(exchangeOver(conn), test.args)
+			username := usernameOf(creds)
 
 			if test.hasError {
 				if err == nil {
@@ -195,14 +221,15 @@ func TestLoginHandlerAuthenticate(t *testing.T) {
 			args:      []string{"AUTH", "LOGIN", base64.StdEncoding.EncodeToString([]byte("user@example.com"))},
 			responses: []string{base64.StdEncoding.EncodeToString([]byte("password"))},
 			expected:  "user@example.com",
-			hasError:  true, // This should fail because LOGIN mechanism expects interactive flow
+			hasError:  false, // The initial response skips the username prompt
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			conn := newMockAuthConn(test.responses)
-			username, err := handler.Authenticate(conn, test.args)
+			creds, err := handler.Authenticate(exchangeOver(conn), test.args)
+			username := usernameOf(creds)
 
 			if test.hasError {
 				if err == nil {
@@ -263,7 +290,8 @@ func TestCramHandlerAuthenticate(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			conn := newMockAuthConn(test.responses)
-			username, err := handler.Authenticate(conn, test.args)
+			creds, err := handler.Authenticate(exchangeOver(conn), test.args)
+			username := usernameOf(creds)
 
 			if test.hasError {
 				if err == nil {
@@ -324,7 +352,8 @@ func TestXOAuth2HandlerAuthenticate(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			conn := newMockAuthConn(test.responses)
-			username, err := handler.Authenticate(conn, test.args)
+			creds, err := handler.Authenticate(exchangeOver(conn), test.args)
+			username := usernameOf(creds)
 
 			if test.hasError {
 				if err == nil {
@@ -400,7 +429,8 @@ func TestAuthenticationFlow(t *testing.T) {
 			}
 
 			conn := newMockAuthConn(responses)
-			username, err := handler.Authenticate(conn, args)
+			creds, err := handler.Authenticate(exchangeOver(conn), args)
+			username := usernameOf(creds)
 
 			if err != nil {
 				t.Errorf("Authentication failed for mechanism %s: %v", mechanism, err)
@@ -450,7 +480,8 @@ func TestAuthenticationFailures(t *testing.T) {
 			}
 
 			conn := newMockAuthConn(responses)
-			username, err := handler.Authenticate(conn, args)
+			creds, err := handler.Authenticate(exchangeOver(conn), args)
+			username := usernameOf(creds)
 
 			if err != nil {
 				t.Errorf("Authentication parsing failed for mechanism %s: %v", mechanism, err)
@@ -488,7 +519,7 @@ func TestBase64Handling(t *testing.T) {
 
 			// Try to use the base64 input in a PLAIN auth
 			args := []string{"AUTH", "PLAIN", test.input}
-			_, err := handler.Authenticate(conn, args)
+			_, err := handler.Authenticate(exchangeOver(conn), args)
 
 			if test.hasError {
 				if err == nil {
@@ -503,3 +534,95 @@ func TestBase64Handling(t *testing.T) {
 		})
 	}
 }
+
+func TestCredentialsVerify(t *testing.T) {
+	const challenge = "<1.2@badsmtp.test>"
+	cramDigest := func(mechanism, secret string) string {
+		creds := GenerateCramResponse("user", secret, challenge)
+		if mechanism == AuthMechanismCramSHA256 {
+			creds = GenerateCramSHA256Response("user", secret, challenge)
+		}
+		return strings.SplitN(creds, " ", 2)[1]
+	}
+
+	tests := []struct {
+		name   string
+		creds  *Credentials
+		secret string
+		want   bool
+	}{
+		{"PLAIN correct", &Credentials{Mechanism: "PLAIN", Password: "s3cret"}, "s3cret", true},
+		{"PLAIN wrong", &Credentials{Mechanism: "PLAIN", Password: "guess"}, "s3cret", false},
+		{"LOGIN correct", &Credentials{Mechanism: "LOGIN", Password: "s3cret"}, "s3cret", true},
+		{"CRAM-MD5 correct", &Credentials{Mechanism: "CRAM-MD5", Challenge: challenge, Response: cramDigest("CRAM-MD5", "s3cret")}, "s3cret", true},
+		{"CRAM-MD5 wrong", &Credentials{Mechanism: "CRAM-MD5", Challenge: challenge, Response: cramDigest("CRAM-MD5", "guess")}, "s3cret", false},
+		{"CRAM-MD5 with SHA256 digest", &Credentials{Mechanism: "CRAM-MD5", Challenge: challenge, Response: cramDigest("CRAM-SHA256", "s3cret")}, "s3cret", false},
+		{"CRAM-SHA256 correct", &Credentials{Mechanism: "CRAM-SHA256", Challenge: challenge, Response: cramDigest("CRAM-SHA256", "s3cret")}, "s3cret", true},
+		{"XOAUTH2 token", &Credentials{Mechanism: "XOAUTH2", Token: "token123"}, "token123", true},
+		{"unknown mechanism", &Credentials{Mechanism: "NTLM", Password: "s3cret"}, "s3cret", false},
+		{"nil credentials", nil, "s3cret", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.creds.Verify(test.secret); got != test.want {
+				t.Errorf("Verify() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandlersReturnSecrets(t *testing.T) {
+	plain := base64.StdEncoding.EncodeToString([]byte("admin\x00user@example.com\x00s3cret"))
+	creds, err := (&PlainHandler{}).Authenticate(exchangeOver(newMockAuthConn(nil)), []string{"AUTH", "PLAIN", plain})
+	if err != nil || creds.Password != "s3cret" || creds.Authzid != "admin" || creds.Mechanism != AuthMechanismPlain {
+		t.Fatalf("unexpected PLAIN credentials %+v (%v)", creds, err)
+	}
+
+	creds, err = (&LoginHandler{}).Authenticate(exchangeOver(newMockAuthConn([]string{
+		base64.StdEncoding.EncodeToString([]byte("user@example.com")),
+		base64.StdEncoding.EncodeToString([]byte("s3cret")),
+	})), []string{"AUTH", "LOGIN"})
+	if err != nil || creds.Password != "s3cret" {
+		t.Fatalf("unexpected LOGIN credentials %+v (%v)", creds, err)
+	}
+
+	handler := NewHandler("CRAM-MD5")
+	creds, err = handler.Authenticate(exchangeOver(newMockAuthConn([]string{
+		base64.StdEncoding.EncodeToString([]byte("user@example.com 0123abcd")),
+	})), []string{"AUTH", "CRAM-MD5"})
+	if err != nil || creds.Challenge == "" || creds.Response != "0123abcd" || creds.Mechanism != AuthMechanismCramMD5 {
+		t.Fatalf("unexpected CRAM-MD5 credentials %+v (%v)", creds, err)
+	}
+
+	xoauth := base64.StdEncoding.EncodeToString([]byte("user=user@example.com\x01auth=Bearer token123\x01\x01"))
+	creds, err = (&XOAuth2Handler{}).Authenticate(exchangeOver(newMockAuthConn(nil)), []string{"AUTH", "XOAUTH2", xoauth})
+	if err != nil || creds.Token != "token123" {
+		t.Fatalf("unexpected XOAUTH2 credentials %+v (%v)", creds, err)
+	}
+}
+
+func TestExchangeCancelAndInitialResponse(t *testing.T) {
+	_, err := (&LoginHandler{}).Authenticate(exchangeOver(newMockAuthConn([]string{"*"})), []string{"AUTH", "LOGIN"})
+	if !errors.Is(err, ErrCancelled) {
+		t.Fatalf("expected ErrCancelled for '*', got %v", err)
+	}
+
+	_, err = NewHandler("CRAM-MD5").Authenticate(exchangeOver(newMockAuthConn([]string{" * "})), []string{"AUTH", "CRAM-MD5"})
+	if !errors.Is(err, ErrCancelled) {
+		t.Fatalf("expected ErrCancelled for CRAM-MD5, got %v", err)
+	}
+
+	initial, err := InitialResponse([]string{"AUTH", "PLAIN", "="})
+	if err != nil || initial == nil || len(initial) != 0 {
+		t.Fatalf("expected '=' to be an empty initial response, got %q (%v)", initial, err)
+	}
+	if initial, err := InitialResponse([]string{"AUTH", "PLAIN"}); initial != nil || err != nil {
+		t.Fatalf("expected no initial response, got %q (%v)", initial, err)
+	}
+
+	// An empty initial response is not a prompt request: PLAIN fails without reading
+	_, err = (&PlainHandler{}).Authenticate(exchangeOver(newMockAuthConn(nil)), []string{"AUTH", "PLAIN", "="})
+	if err == nil || errors.Is(err, ErrCancelled) {
+		t.Fatalf("expected empty PLAIN response to fail, got %v", err)
+	}
+}
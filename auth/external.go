@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// AuthMechanismExternal represents the EXTERNAL authentication mechanism (RFC 4422
+// appendix A), which authenticates the client with its TLS client certificate.
+const AuthMechanismExternal = "EXTERNAL"
+
+// ExternalHandler implements the EXTERNAL authentication mechanism.
+type ExternalHandler struct {
+	// Certificate is the client certificate verified during the TLS handshake.
+	Certificate *x509.Certificate
+}
+
+// Authenticate handles EXTERNAL authentication. The client's only message is an optional
+// authorization identity; when empty, the identity is taken from the certificate. A
+// non-empty authorization identity must be one of the identities in the certificate.
+func (h *ExternalHandler) Authenticate(ex *Exchange, parts []string) (*Credentials, error) {
+	if h.Certificate == nil {
+		return nil, fmt.Errorf("no client certificate")
+	}
+	authzid, err := ex.response(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &Credentials{
+		Mechanism:   AuthMechanismExternal,
+		Username:    CertificateIdentity(h.Certificate),
+		Authzid:     string(authzid),
+		Certificate: h.Certificate,
+	}
+	if creds.Authzid != "" {
+		if !certificateHasIdentity(h.Certificate, creds.Authzid) {
+			return creds, fmt.Errorf("authorization identity %q is not in the client certificate", creds.Authzid)
+		}
+		creds.Username = creds.Authzid
+	}
+	return creds, nil
+}
+
+// CertificateIdentity returns the identity a client certificate authenticates: its first
+// email address SAN, or the subject common name if it has none.
+func CertificateIdentity(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// certificateHasIdentity reports whether identity is the common name, an email address
+// or a DNS name of cert.
+func certificateHasIdentity(cert *x509.Certificate, identity string) bool {
+	if strings.EqualFold(cert.Subject.CommonName, identity) {
+		return true
+	}
+	for _, names := range [][]string{cert.EmailAddresses, cert.DNSNames} {
+		for _, name := range names {
+			if strings.EqualFold(name, identity) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"testing"
+)
+
+func TestExternalHandlerAuthenticate(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "relay.example.com"},
+		EmailAddresses: []string{"relay@example.com"},
+		DNSNames:       []string{"mx.example.com"},
+	}
+	handler := NewHandlerWithOptions(AuthMechanismExternal, HandlerOptions{PeerCertificate: cert})
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	creds, err := handler.Authenticate(exchangeOver(newMockAuthConn(nil)), []string{"AUTH", "EXTERNAL", "="})
+	if err != nil || creds.Username != "relay@example.com" || creds.Certificate != cert {
+		t.Fatalf("expected identity from the certificate, got %+v (%v)", creds, err)
+	}
+
+	creds, err = handler.Authenticate(exchangeOver(newMockAuthConn([]string{b64("mx.example.com")})), []string{"AUTH", "EXTERNAL"})
+	if err != nil || creds.Username != "mx.example.com" {
+		t.Fatalf("expected authorization identity from the certificate, got %+v (%v)", creds, err)
+	}
+
+	if _, err := handler.Authenticate(exchangeOver(newMockAuthConn(nil)), []string{"AUTH", "EXTERNAL", b64("someone@example.com")}); err == nil {
+		t.Error("expected an authorization identity outside the certificate to fail")
+	}
+
+	if NewHandlerWithOptions(AuthMechanismExternal, HandlerOptions{}) != nil {
+		t.Error("expected no EXTERNAL handler without a client certificate")
+	}
+}
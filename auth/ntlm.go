@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+	"unicode/utf16"
+)
+
+// AuthMechanismNTLM represents the NTLM authentication mechanism (MS-SMTPNTLM).
+const AuthMechanismNTLM = "NTLM"
+
+// NTLM message types and the negotiate flags BadSMTP understands (MS-NLMP section 2.2.2.5).
+const (
+	ntlmNegotiate    = 1
+	ntlmChallenge    = 2
+	ntlmAuthenticate = 3
+
+	ntlmFlagUnicode         = 0x00000001
+	ntlmFlagOEM             = 0x00000002
+	ntlmFlagRequestTarget   = 0x00000004
+	ntlmFlagNTLM            = 0x00000200
+	ntlmFlagAlwaysSign      = 0x00008000
+	ntlmFlagTargetDomain    = 0x00010000
+	ntlmFlagExtendedSession = 0x00080000
+	ntlmFlagTargetInfo      = 0x00800000
+	ntlmFlagVersion         = 0x02000000
+	ntlmFlag128             = 0x20000000
+	ntlmFlagKeyExchange     = 0x40000000
+	ntlmFlag56              = 0x80000000
+
+	// ntlmEchoedFlags are the client-requested flags the server agrees to
+	ntlmEchoedFlags = ntlmFlagExtendedSession | ntlmFlag128 | ntlmFlagKeyExchange | ntlmFlag56
+
+	// AV_PAIR identifiers for the target information block (MS-NLMP section 2.2.2.1)
+	ntlmAvEOL             = 0
+	ntlmAvNbComputerName  = 1
+	ntlmAvNbDomainName    = 2
+	ntlmAvDNSComputerName = 3
+	ntlmAvDNSDomainName   = 4
+	ntlmAvTimestamp       = 7
+
+	ntlmChallengeHeaderSize    = 56
+	ntlmAuthenticateHeaderSize = 64
+
+	// ntlmTargetName and ntlmDNSName identify the simulated server and its domain.
+	ntlmTargetName = "BADSMTP"
+	ntlmDNSName    = "badsmtp.test"
+
+	// ntlmFiletimeEpoch is the number of 100ns intervals between 1601 and 1970.
+	ntlmFiletimeEpoch = 116444736000000000
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmVersion is the Version field sent in the challenge: Windows 10.0 build 17763, NTLM revision 15.
+var ntlmVersion = []byte{10, 0, 0x63, 0x45, 0, 0, 0, 15}
+
+// NTLMHandler implements the NTLM authentication mechanism: the Type 1 (negotiate),
+// Type 2 (challenge) and Type 3 (authenticate) message exchange. The client's response
+// to the challenge is recorded but not verified, as there is no domain controller; the
+// outcome depends on the username, like the other mechanisms in pattern mode.
+type NTLMHandler struct{}
+
+// Authenticate handles NTLM authentication. The Type 1 message may be sent as an initial
+// response; otherwise the server prompts for it with "334 NTLM supported".
+func (h *NTLMHandler) Authenticate(ex *Exchange, parts []string) (*Credentials, error) {
+	negotiate, err := InitialResponse(parts)
+	if err != nil {
+		return nil, err
+	}
+	if negotiate == nil {
+		line, err := ex.challengeText("NTLM supported")
+		if err != nil {
+			return nil, err
+		}
+		if negotiate, err = base64.StdEncoding.DecodeString(line); err != nil {
+			return nil, fmt.Errorf("invalid base64")
+		}
+	}
+	clientFlags, err := parseNTLMNegotiate(negotiate)
+	if err != nil {
+		return nil, err
+	}
+
+	serverChallenge := make([]byte, 8)
+	if _, err := rand.Read(serverChallenge); err != nil {
+		return nil, fmt.Errorf("failed to generate NTLM challenge: %w", err)
+	}
+	authenticate, err := ex.Challenge(ntlmChallengeMessage(clientFlags, serverChallenge, time.Now()))
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := parseNTLMAuthenticate(authenticate)
+	if err != nil {
+		return nil, err
+	}
+	if msg.username == "" {
+		return nil, fmt.Errorf("anonymous NTLM authentication is not supported")
+	}
+	return &Credentials{
+		Mechanism: AuthMechanismNTLM,
+		Username:  msg.username,
+		Domain:    msg.domain,
+		Challenge: hex.EncodeToString(serverChallenge),
+		Response:  hex.EncodeToString(msg.ntResponse),
+	}, nil
+}
+
+// parseNTLMNegotiate checks a Type 1 message and returns its negotiate flags.
+func parseNTLMNegotiate(msg []byte) (uint32, error) {
+	if err := checkNTLMHeader(msg, ntlmNegotiate, 16); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(msg[12:16]), nil
+}
+
+// ntlmChallengeMessage builds the Type 2 message: the server challenge, the target name
+// and a target information block describing the simulated server.
+func ntlmChallengeMessage(clientFlags uint32, serverChallenge []byte, now time.Time) []byte {
+	flags := uint32(ntlmFlagRequestTarget | ntlmFlagNTLM | ntlmFlagAlwaysSign | ntlmFlagTargetDomain |
+		ntlmFlagTargetInfo | ntlmFlagVersion)
+	flags |= clientFlags & ntlmEchoedFlags
+	unicode := clientFlags&ntlmFlagUnicode != 0 || clientFlags&ntlmFlagOEM == 0
+	if unicode {
+		flags |= ntlmFlagUnicode
+	} else {
+		flags |= ntlmFlagOEM
+	}
+
+	targetName := []byte(ntlmTargetName)
+	if unicode {
+		targetName = utf16LE(ntlmTargetName)
+	}
+
+	var info bytes.Buffer
+	writeAvPair := func(id uint16, value []byte) {
+		_ = binary.Write(&info, binary.LittleEndian, id)
+		_ = binary.Write(&info, binary.LittleEndian, uint16(len(value)))
+		info.Write(value)
+	}
+	writeAvPair(ntlmAvNbDomainName, utf16LE(ntlmTargetName))
+	writeAvPair(ntlmAvNbComputerName, utf16LE(ntlmTargetName))
+	writeAvPair(ntlmAvDNSDomainName, utf16LE(ntlmDNSName))
+	writeAvPair(ntlmAvDNSComputerName, utf16LE(ntlmDNSName))
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, uint64(now.UnixNano()/100+ntlmFiletimeEpoch))
+	writeAvPair(ntlmAvTimestamp, timestamp)
+	writeAvPair(ntlmAvEOL, nil)
+
+	msg := make([]byte, ntlmChallengeHeaderSize, ntlmChallengeHeaderSize+len(targetName)+info.Len())
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], ntlmChallenge)
+	putNTLMField(msg[12:], len(targetName), len(msg))
+	msg = append(msg, targetName...)
+	binary.LittleEndian.PutUint32(msg[20:], flags)
+	copy(msg[24:32], serverChallenge)
+	putNTLMField(msg[40:], info.Len(), len(msg))
+	msg = append(msg, info.Bytes()...)
+	copy(msg[48:56], ntlmVersion)
+	return msg
+}
+
+// ntlmAuthenticateFields is what BadSMTP reads from a Type 3 message.
+type ntlmAuthenticateFields struct {
+	domain, username, workstation string
+	ntResponse                    []byte
+}
+
+// parseNTLMAuthenticate extracts the names and NT response from a Type 3 message.
+func parseNTLMAuthenticate(msg []byte) (*ntlmAuthenticateFields, error) {
+	if err := checkNTLMHeader(msg, ntlmAuthenticate, ntlmAuthenticateHeaderSize); err != nil {
+		return nil, err
+	}
+	unicode := binary.LittleEndian.Uint32(msg[60:64])&ntlmFlagUnicode != 0
+
+	fields := &ntlmAuthenticateFields{}
+	var err error
+	if fields.ntResponse, err = ntlmField(msg, 20); err != nil {
+		return nil, err
+	}
+	for offset, dest := range map[int]*string{28: &fields.domain, 36: &fields.username, 44: &fields.workstation} {
+		value, err := ntlmField(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if *dest, err = ntlmString(value, unicode); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+// checkNTLMHeader checks the signature, message type and minimum length of msg.
+func checkNTLMHeader(msg []byte, messageType uint32, minLen int) error {
+	if len(msg) < minLen || !bytes.Equal(msg[:8], ntlmSignature) {
+		return fmt.Errorf("invalid NTLM message")
+	}
+	if got := binary.LittleEndian.Uint32(msg[8:12]); got != messageType {
+		return fmt.Errorf("unexpected NTLM message type %d, want %d", got, messageType)
+	}
+	return nil
+}
+
+// ntlmField returns the payload described by the length/offset field at fieldOffset.
+func ntlmField(msg []byte, fieldOffset int) ([]byte, error) {
+	length := int(binary.LittleEndian.Uint16(msg[fieldOffset:]))
+	offset := int(binary.LittleEndian.Uint32(msg[fieldOffset+4:]))
+	if offset > len(msg) || length > len(msg)-offset {
+		return nil, fmt.Errorf("NTLM field at %d is out of range", fieldOffset)
+	}
+	return msg[offset : offset+length], nil
+}
+
+// putNTLMField writes a length/maximum length/offset field.
+func putNTLMField(field []byte, length, offset int) {
+	binary.LittleEndian.PutUint16(field[0:], uint16(length))
+	binary.LittleEndian.PutUint16(field[2:], uint16(length))
+	binary.LittleEndian.PutUint32(field[4:], uint32(offset))
+}
+
+// ntlmString decodes a UTF-16LE or OEM string from a message payload.
+func ntlmString(b []byte, unicode bool) (string, error) {
+	if !unicode {
+		return string(b), nil
+	}
+	if len(b)%2 != 0 {
+		return "", fmt.Errorf("invalid UTF-16 string in NTLM message")
+	}
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// utf16LE encodes s as UTF-16LE.
+func utf16LE(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+// NTLMNegotiateMessage returns a Type 1 message requesting Unicode, as sent by a client.
+func NTLMNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], ntlmNegotiate)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmFlagUnicode|ntlmFlagRequestTarget|ntlmFlagNTLM|ntlmFlagExtendedSession)
+	return msg
+}
+
+// NTLMAuthenticateMessage returns a Unicode Type 3 message for domain\username with a
+// placeholder NT response, as sent by a client. BadSMTP does not verify the response.
+func NTLMAuthenticateMessage(domain, username, workstation string) []byte {
+	payloads := [][]byte{make([]byte, 24), make([]byte, 24), utf16LE(domain), utf16LE(username), utf16LE(workstation), nil}
+
+	msg := make([]byte, ntlmAuthenticateHeaderSize)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], ntlmAuthenticate)
+	for i, payload := range payloads {
+		putNTLMField(msg[12+8*i:], len(payload), len(msg))
+		msg = append(msg, payload...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], ntlmFlagUnicode|ntlmFlagNTLM)
+	return msg
+}
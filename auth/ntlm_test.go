@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNTLMHandlerAuthenticate(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	conn := &recordingConn{mockAuthConn: newMockAuthConn([]string{
+		b64(NTLMNegotiateMessage()),
+		b64(NTLMAuthenticateMessage("EXAMPLE", "goodauth", "WORKSTATION")),
+	})}
+
+	creds, err := (&NTLMHandler{}).Authenticate(exchangeOver(conn), []string{"AUTH", "NTLM"})
+	if err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if creds.Mechanism != AuthMechanismNTLM || creds.Username != "goodauth" || creds.Domain != "EXAMPLE" {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+
+	lines := strings.Split(strings.TrimSpace(conn.written.String()), "\r\n")
+	if len(lines) != 2 || lines[0] != "334 NTLM supported" {
+		t.Fatalf("unexpected challenges %q", lines)
+	}
+	challenge, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(lines[1], "334 "))
+	if err != nil {
+		t.Fatalf("Type 2 message is not base64: %v", err)
+	}
+	if err := checkNTLMHeader(challenge, ntlmChallenge, ntlmChallengeHeaderSize); err != nil {
+		t.Fatalf("invalid Type 2 message: %v", err)
+	}
+	if hex := creds.Challenge; len(hex) != 16 {
+		t.Errorf("Challenge = %q, want 8 hex-encoded bytes", hex)
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:24])
+	if flags&ntlmFlagUnicode == 0 || flags&ntlmFlagTargetInfo == 0 || flags&ntlmFlagExtendedSession == 0 {
+		t.Errorf("unexpected Type 2 flags %#x", flags)
+	}
+	targetName, err := ntlmField(challenge, 12)
+	if err != nil || !bytes.Equal(targetName, utf16LE(ntlmTargetName)) {
+		t.Errorf("unexpected target name %q (%v)", targetName, err)
+	}
+	info, err := ntlmField(challenge, 40)
+	if err != nil || !bytes.Contains(info, utf16LE(ntlmDNSName)) || !bytes.HasSuffix(info, []byte{0, 0, 0, 0}) {
+		t.Errorf("unexpected target info %x (%v)", info, err)
+	}
+}
+
+func TestNTLMHandlerInitialResponse(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	conn := newMockAuthConn([]string{b64(NTLMAuthenticateMessage("", "user@example.com", ""))})
+	creds, err := (&NTLMHandler{}).Authenticate(exchangeOver(conn), []string{"AUTH", "NTLM", b64(NTLMNegotiateMessage())})
+	if err != nil || creds.Username != "user@example.com" {
+		t.Fatalf("unexpected result %+v (%v)", creds, err)
+	}
+}
+
+func TestNTLMHandlerRejectsBadMessages(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	tests := []struct {
+		name      string
+		responses []string
+	}{
+		{"not NTLM", []string{b64([]byte("hello, this is not NTLM"))}},
+		{"Type 3 first", []string{b64(NTLMAuthenticateMessage("", "user", ""))}},
+		{"anonymous", []string{b64(NTLMNegotiateMessage()), b64(NTLMAuthenticateMessage("", "", ""))}},
+		{"truncated Type 3", []string{b64(NTLMNegotiateMessage()), b64(NTLMAuthenticateMessage("DOMAIN", "user", "")[:70])}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := (&NTLMHandler{}).Authenticate(exchangeOver(newMockAuthConn(test.responses)), []string{"AUTH", "NTLM"}); err == nil {
+				t.Fatal("expected failure")
+			}
+		})
+	}
+}
+
+func TestNTLMChallengeOEM(t *testing.T) {
+	msg := ntlmChallengeMessage(ntlmFlagOEM, make([]byte, 8), time.Now())
+	if flags := binary.LittleEndian.Uint32(msg[20:24]); flags&ntlmFlagOEM == 0 || flags&ntlmFlagUnicode != 0 {
+		t.Errorf("expected an OEM challenge, got flags %#x", flags)
+	}
+	if targetName, _ := ntlmField(msg, 12); string(targetName) != ntlmTargetName {
+		t.Errorf("unexpected OEM target name %q", targetName)
+	}
+}
@@ -0,0 +1,391 @@
+package auth
+
+import (
+	"cmp"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AuthMechanismOAuthBearer represents the OAUTHBEARER authentication mechanism (RFC 7628).
+const AuthMechanismOAuthBearer = "OAUTHBEARER"
+
+// Token failure statuses reported in the RFC 7628 error challenge.
+const (
+	TokenStatusInvalid           = "invalid_token"
+	TokenStatusInsufficientScope = "insufficient_scope"
+)
+
+// TokenError describes why a bearer token was rejected.
+type TokenError struct {
+	Status string // TokenStatusInvalid or TokenStatusInsufficientScope
+	Reason string
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Reason)
+}
+
+func invalidToken(format string, args ...any) *TokenError {
+	return &TokenError{Status: TokenStatusInvalid, Reason: fmt.Sprintf(format, args...)}
+}
+
+// TokenClaims holds the validated claims of a bearer token.
+type TokenClaims struct {
+	Subject   string
+	Email     string
+	Audience  []string
+	Scopes    []string
+	ExpiresAt time.Time // Zero when the token has no exp claim
+}
+
+// TokenValidator validates bearer tokens as signed JWTs, using either a static HMAC
+// secret (HS256/384/512) or public keys from a JWKS file (RS*, PS*, ES*, EdDSA).
+type TokenValidator struct {
+	HMACSecret []byte
+	Keys       map[string]crypto.PublicKey // JWKS keys by kid
+	Audience   string                      // Required aud value (empty = not checked)
+	Scope      string                      // Required scope (empty = not checked)
+	Now        func() time.Time            // Clock for exp/nbf checks (default time.Now)
+}
+
+// Validate checks the token's signature, expiry, audience and scope. Failures are
+// returned as *TokenError.
+func (v *TokenValidator) Validate(token string) (*TokenClaims, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, invalidToken("token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(segments[0], &header); err != nil {
+		return nil, invalidToken("invalid JWT header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return nil, invalidToken("invalid JWT signature encoding")
+	}
+	if err := v.verifySignature(header.Alg, header.Kid, segments[0]+"."+segments[1], signature); err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		Sub   string          `json:"sub"`
+		Email string          `json:"email"`
+		Aud   json.RawMessage `json:"aud"`
+		Exp   *float64        `json:"exp"`
+		Nbf   *float64        `json:"nbf"`
+		Scope string          `json:"scope"`
+		Scp   json.RawMessage `json:"scp"`
+	}
+	if err := decodeJWTSegment(segments[1], &raw); err != nil {
+		return nil, invalidToken("invalid JWT claims: %v", err)
+	}
+
+	claims := &TokenClaims{
+		Subject:  raw.Sub,
+		Email:    raw.Email,
+		Audience: stringOrList(raw.Aud),
+		Scopes:   strings.Fields(raw.Scope),
+	}
+	claims.Scopes = append(claims.Scopes, stringOrList(raw.Scp)...)
+
+	now := time.Now
+	if v.Now != nil {
+		now = v.Now
+	}
+	if raw.Exp != nil {
+		claims.ExpiresAt = time.Unix(int64(*raw.Exp), 0)
+		if !now().Before(claims.ExpiresAt) {
+			return claims, invalidToken("token expired at %s", claims.ExpiresAt.UTC().Format(time.RFC3339))
+		}
+	}
+	if raw.Nbf != nil && now().Before(time.Unix(int64(*raw.Nbf), 0)) {
+		return claims, invalidToken("token not valid yet")
+	}
+	if v.Audience != "" && !slices.Contains(claims.Audience, v.Audience) {
+		return claims, invalidToken("token audience %v does not include %q", claims.Audience, v.Audience)
+	}
+	if v.Scope != "" && !slices.Contains(claims.Scopes, v.Scope) {
+		return claims, &TokenError{Status: TokenStatusInsufficientScope, Reason: fmt.Sprintf("token lacks scope %q", v.Scope)}
+	}
+	return claims, nil
+}
+
+// verifySignature checks signature over signingInput for the JWT alg.
+func (v *TokenValidator) verifySignature(alg, kid, signingInput string, signature []byte) error {
+	var hashFunc func() hash.Hash
+	var cryptoHash crypto.Hash
+	switch alg[min(len(alg), 2):] {
+	case "256":
+		hashFunc, cryptoHash = sha256.New, crypto.SHA256
+	case "384":
+		hashFunc, cryptoHash = sha512.New384, crypto.SHA384
+	case "512":
+		hashFunc, cryptoHash = sha512.New, crypto.SHA512
+	}
+
+	if strings.HasPrefix(alg, "HS") && hashFunc != nil {
+		if len(v.HMACSecret) == 0 {
+			return invalidToken("no HMAC secret configured for %s", alg)
+		}
+		mac := hmac.New(hashFunc, v.HMACSecret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return invalidToken("invalid token signature")
+		}
+		return nil
+	}
+
+	key, err := v.publicKey(kid)
+	if err != nil {
+		return err
+	}
+	var digest []byte
+	if hashFunc != nil {
+		h := hashFunc()
+		h.Write([]byte(signingInput))
+		digest = h.Sum(nil)
+	}
+
+	var ok bool
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(alg, "RS") && digest != nil:
+			ok = rsa.VerifyPKCS1v15(pub, cryptoHash, digest, signature) == nil
+		case strings.HasPrefix(alg, "PS") && digest != nil:
+			ok = rsa.VerifyPSS(pub, cryptoHash, digest, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && digest != nil && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			ok = ecdsa.Verify(pub, digest, r, s)
+		}
+	case ed25519.PublicKey:
+		if alg == "EdDSA" {
+			ok = ed25519.Verify(pub, []byte(signingInput), signature)
+		}
+	}
+	if !ok {
+		return invalidToken("invalid token signature for alg %q", alg)
+	}
+	return nil
+}
+
+// publicKey returns the JWKS key for kid, or the only key when the token has no kid.
+func (v *TokenValidator) publicKey(kid string) (crypto.PublicKey, error) {
+	if key, ok := v.Keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(v.Keys) == 1 {
+		for _, key := range v.Keys {
+			return key, nil
+		}
+	}
+	return nil, invalidToken("no key found for kid %q", kid)
+}
+
+func decodeJWTSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringOrList decodes a JSON claim that may be a string or an array of strings.
+func stringOrList(raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return strings.Fields(s)
+	}
+	return nil
+}
+
+// LoadJWKS reads a JSON Web Key Set file and returns its public keys by kid. RSA, EC
+// (P-256, P-384, P-521) and OKP (Ed25519) keys are supported; others are skipped.
+func LoadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // path comes from trusted configuration
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS file: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if err := errors.Join(errN, errE); err != nil {
+				return nil, fmt.Errorf("invalid RSA key %q: %w", k.Kid, err)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			curve, ok := curves[k.Crv]
+			if !ok {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if err := errors.Join(errX, errY); err != nil {
+				return nil, fmt.Errorf("invalid EC key %q: %w", k.Kid, err)
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS file %s contains no usable keys", path)
+	}
+	return keys, nil
+}
+
+// OAuthBearerHandler implements the OAUTHBEARER authentication mechanism (RFC 7628).
+type OAuthBearerHandler struct {
+	// Validator checks the bearer token; nil accepts any token.
+	Validator *TokenValidator
+}
+
+// Authenticate handles OAUTHBEARER authentication.
+func (h *OAuthBearerHandler) Authenticate(ex *Exchange, parts []string) (*Credentials, error) {
+	response, err := ex.response(parts)
+	if err != nil {
+		return nil, err
+	}
+	decoded := string(response)
+
+	// gs2-header "n,a=user@example.com," followed by \x01-separated key=value pairs
+	gs2, kvpairs, found := strings.Cut(decoded, "\x01")
+	if !found || (!strings.HasPrefix(gs2, "n,") && !strings.HasPrefix(gs2, "y,")) {
+		return nil, fmt.Errorf("invalid OAUTHBEARER format")
+	}
+	creds := &Credentials{Mechanism: AuthMechanismOAuthBearer}
+	for _, field := range strings.Split(strings.TrimSuffix(gs2, ","), ",")[1:] {
+		if after, ok := strings.CutPrefix(field, "a="); ok {
+			creds.Username = scramUnescape(after)
+		}
+	}
+	for _, kv := range strings.Split(kvpairs, "\x01") {
+		if after, ok := strings.CutPrefix(kv, "auth="); ok {
+			scheme, token, _ := strings.Cut(after, " ")
+			if strings.EqualFold(scheme, "Bearer") {
+				creds.Token = strings.TrimSpace(token)
+			}
+		}
+	}
+	if creds.Token == "" {
+		return creds, fmt.Errorf("bearer token not found in OAUTHBEARER message")
+	}
+
+	if err := validateBearerToken(ex, h.Validator, creds); err != nil {
+		return creds, err
+	}
+	return creds, nil
+}
+
+// oauthErrorStatus is the JSON error challenge sent when a token is rejected. OAUTHBEARER
+// uses the RFC 7628 status names; XOAUTH2 clients expect HTTP-style status codes.
+type oauthErrorStatus struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes,omitempty"`
+	Scope   string `json:"scope,omitempty"`
+}
+
+// validateBearerToken checks creds.Token with validator. On failure it sends the JSON
+// error challenge and waits for the client's dummy response before returning the error,
+// leaving the final 535 to the caller. A username sent by the client must be the token's
+// email or subject; without one, the username falls back to them.
+func validateBearerToken(ex *Exchange, validator *TokenValidator, creds *Credentials) error {
+	if validator == nil {
+		if creds.Username == "" {
+			return fmt.Errorf("username not found in %s message", creds.Mechanism)
+		}
+		return nil
+	}
+
+	claims, err := validator.Validate(creds.Token)
+	if err == nil && creds.Username != "" &&
+		!strings.EqualFold(creds.Username, claims.Email) && !strings.EqualFold(creds.Username, claims.Subject) {
+		// A valid token only proves the identity it was issued for
+		err = invalidToken("token was not issued for %s", creds.Username)
+	}
+	if err == nil {
+		creds.Claims = claims
+		if creds.Username == "" {
+			creds.Username = cmp.Or(claims.Email, claims.Subject)
+		}
+		return nil
+	}
+
+	status := oauthErrorStatus{Status: TokenStatusInvalid, Scope: validator.Scope}
+	var tokenErr *TokenError
+	if errors.As(err, &tokenErr) {
+		status.Status = tokenErr.Status
+	}
+	if creds.Mechanism == AuthMechanismXOAuth2 {
+		status.Schemes = "Bearer"
+		status.Status = "401"
+		if tokenErr != nil && tokenErr.Status == TokenStatusInsufficientScope {
+			status.Status = "403"
+		}
+	}
+	payload, _ := json.Marshal(status)
+	// The client answers the error challenge with a dummy response (\x01 for
+	// OAUTHBEARER, an empty line for XOAUTH2) and then expects the failure reply
+	if _, cerr := ex.Challenge(payload); cerr != nil && !errors.Is(cerr, ErrCancelled) {
+		return cerr
+	}
+	return err
+}
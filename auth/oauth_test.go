@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var oauthSecret = []byte("token-signing-secret")
+
+// signHS256 returns an HS256 JWT for claims.
+func signHS256(t *testing.T, secret []byte, claims map[string]any) string {
+	t.Helper()
+	signingInput := jwtSigningInput(t, map[string]any{"alg": "HS256", "typ": "JWT"}, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func jwtSigningInput(t *testing.T, header, claims map[string]any) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+}
+
+func TestTokenValidatorValidate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	validator := &TokenValidator{
+		HMACSecret: oauthSecret,
+		Audience:   "badsmtp",
+		Scope:      "mail.send",
+		Now:        func() time.Time { return now },
+	}
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"sub":   "1234",
+			"email": "user@example.com",
+			"aud":   []string{"badsmtp", "other"},
+			"scope": "openid mail.send",
+			"exp":   now.Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status string // expected TokenError status, "" for success
+	}{
+		{"valid", signHS256(t, oauthSecret, claims(nil)), ""},
+		{"string audience and scp", signHS256(t, oauthSecret, claims(map[string]any{"aud": "badsmtp", "scope": nil, "scp": []string{"mail.send"}})), ""},
+		{"expired", signHS256(t, oauthSecret, claims(map[string]any{"exp": now.Add(-time.Minute).Unix()})), TokenStatusInvalid},
+		{"not yet valid", signHS256(t, oauthSecret, claims(map[string]any{"nbf": now.Add(time.Minute).Unix()})), TokenStatusInvalid},
+		{"wrong audience", signHS256(t, oauthSecret, claims(map[string]any{"aud": "someone-else"})), TokenStatusInvalid},
+		{"missing scope", signHS256(t, oauthSecret, claims(map[string]any{"scope": "openid"})), TokenStatusInsufficientScope},
+		{"wrong secret", signHS256(t, []byte("guess"), claims(nil)), TokenStatusInvalid},
+		{"not a JWT", "opaque-token", TokenStatusInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := validator.Validate(test.token)
+			if test.status == "" {
+				if err != nil {
+					t.Fatalf("expected token to validate, got %v", err)
+				}
+				if got.Email != "user@example.com" || got.Subject != "1234" {
+					t.Errorf("unexpected claims %+v", got)
+				}
+				return
+			}
+			var tokenErr *TokenError
+			if !errors.As(err, &tokenErr) || tokenErr.Status != test.status {
+				t.Fatalf("expected %s error, got %v", test.status, err)
+			}
+		})
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32))) }
+	jwks := map[string]any{"keys": []map[string]string{
+		{"kty": "EC", "kid": "key-1", "crv": "P-256", "x": b64(key.X), "y": b64(key.Y)},
+		{"kty": "unknown", "kid": "skipped"},
+	}}
+	data, _ := json.Marshal(jwks)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadJWKS(path)
+	if err != nil {
+		t.Fatalf("LoadJWKS() error = %v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(keys))
+	}
+
+	signingInput := jwtSigningInput(t,
+		map[string]any{"alg": "ES256", "kid": "key-1"},
+		map[string]any{"sub": "user@example.com", "exp": time.Now().Add(time.Hour).Unix()})
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	token := signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	validator := &TokenValidator{Keys: keys}
+	if _, err := validator.Validate(token); err != nil {
+		t.Fatalf("expected ES256 token to validate, got %v", err)
+	}
+	sig[0] ^= 0xff
+	if _, err := validator.Validate(signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)); err == nil {
+		t.Fatal("expected tampered ES256 signature to fail")
+	}
+}
+
+func TestOAuthBearerHandlerAuthenticate(t *testing.T) {
+	token := signHS256(t, oauthSecret, map[string]any{"email": "user@example.com", "exp": time.Now().Add(time.Hour).Unix()})
+	message := func(authzid, token string) string {
+		return base64.StdEncoding.EncodeToString([]byte("n,a=" + authzid + ",\x01host=badsmtp.test\x01port=587\x01auth=Bearer " + token + "\x01\x01"))
+	}
+
+	creds, err := (&OAuthBearerHandler{}).Authenticate(exchangeOver(newMockAuthConn(nil)), []string{"AUTH", "OAUTHBEARER", message("user@example.com", "anything")})
+	if err != nil || creds.Username != "user@example.com" || creds.Token != "anything" {
+		t.Fatalf("unexpected unvalidated credentials %+v (%v)", creds, err)
+	}
+
+	handler := NewHandlerWithOptions(AuthMechanismOAuthBearer, HandlerOptions{TokenValidator: &TokenValidator{HMACSecret: oauthSecret}})
+	creds, err = handler.Authenticate(exchangeOver(newMockAuthConn(nil)), []string{"AUTH", "OAUTHBEARER", base64.StdEncoding.EncodeToString([]byte("n,,\x01auth=Bearer " + token + "\x01\x01"))})
+	if err != nil || creds.Username != "user@example.com" || creds.Claims == nil {
+		t.Fatalf("expected username from token claims, got %+v (%v)", creds, err)
+	}
+	creds, err = handler.Authenticate(exchangeOver(newMockAuthConn(nil)), []string{"AUTH", "OAUTHBEARER", message("USER@example.com", token)})
+	if err != nil || creds.Claims == nil {
+		t.Fatalf("expected the token's email to match case-insensitively, got %+v (%v)", creds, err)
+	}
+}
+
+func TestOAuthTokenForAnotherUser(t *testing.T) {
+	alice := signHS256(t, oauthSecret, map[string]any{"sub": "alice", "email": "alice@example.com", "exp": time.Now().Add(time.Hour).Unix()})
+	validator := &TokenValidator{HMACSecret: oauthSecret}
+
+	tests := []struct {
+		mechanism string
+		initial   string
+		reply     string
+	}{
+		{AuthMechanismOAuthBearer, "n,a=bob@example.com,\x01auth=Bearer " + alice + "\x01\x01", "AQ=="},
+		{AuthMechanismXOAuth2, "user=bob\x01auth=Bearer " + alice + "\x01\x01", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.mechanism, func(t *testing.T) {
+			conn := &recordingConn{mockAuthConn: newMockAuthConn([]string{test.reply})}
+			handler := NewHandlerWithOptions(test.mechanism, HandlerOptions{TokenValidator: validator})
+			creds, err := handler.Authenticate(exchangeOver(conn), []string{"AUTH", test.mechanism, base64.StdEncoding.EncodeToString([]byte(test.initial))})
+			var tokenErr *TokenError
+			if !errors.As(err, &tokenErr) || tokenErr.Status != TokenStatusInvalid {
+				t.Fatalf("expected alice's token to be rejected for bob, got %v", err)
+			}
+			if creds.Claims != nil {
+				t.Error("expected no claims for a rejected token")
+			}
+			if !strings.HasPrefix(conn.written.String(), "334 ") {
+				t.Errorf("expected the error challenge, got %q", conn.written.String())
+			}
+		})
+	}
+}
+
+// recordingConn is a mockAuthConn that keeps what the handler wrote.
+type recordingConn struct {
+	*mockAuthConn
+	written strings.Builder
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func TestOAuthErrorChallenge(t *testing.T) {
+	expired := signHS256(t, oauthSecret, map[string]any{"email": "user@example.com", "exp": time.Now().Add(-time.Hour).Unix()})
+	validator := &TokenValidator{HMACSecret: oauthSecret, Scope: "mail.send"}
+
+	tests := []struct {
+		mechanism string
+		initial   string
+		reply     string
+		status    string
+	}{
+		{AuthMechanismOAuthBearer, "n,a=user@example.com,\x01auth=Bearer " + expired + "\x01\x01", "AQ==", TokenStatusInvalid},
+		{AuthMechanismXOAuth2, "user=user@example.com\x01auth=Bearer " + expired + "\x01\x01", "", "401"},
+	}
+	for _, test := range tests {
+		t.Run(test.mechanism, func(t *testing.T) {
+			conn := &recordingConn{mockAuthConn: newMockAuthConn([]string{test.reply})}
+			handler := NewHandlerWithOptions(test.mechanism, HandlerOptions{TokenValidator: validator})
+			_, err := handler.Authenticate(exchangeOver(conn), []string{"AUTH", test.mechanism, base64.StdEncoding.EncodeToString([]byte(test.initial))})
+			if err == nil {
+				t.Fatal("expected expired token to fail")
+			}
+			if conn.index != 1 {
+				t.Error("expected the handler to read the client's dummy response")
+			}
+
+			line := strings.TrimSpace(conn.written.String())
+			if !strings.HasPrefix(line, "334 ") {
+				t.Fatalf("expected 334 error challenge, got %q", line)
+			}
+			payload, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "334 "))
+			if err != nil {
+				t.Fatalf("error challenge is not base64: %v", err)
+			}
+			var status oauthErrorStatus
+			if err := json.Unmarshal(payload, &status); err != nil {
+				t.Fatalf("error challenge is not JSON: %q", payload)
+			}
+			if status.Status != test.status || status.Scope != "mail.send" {
+				t.Errorf("unexpected error status %+v", status)
+			}
+		})
+	}
+}
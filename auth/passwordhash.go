@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"github.com/GehirnInc/crypt"
+	"github.com/GehirnInc/crypt/sha256_crypt"
+	"github.com/GehirnInc/crypt/sha512_crypt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHash is a stored password hash, as found in htpasswd and shadow files.
+type PasswordHash interface {
+	// Verify reports whether password matches the hash.
+	Verify(password string) bool
+}
+
+// ParsePasswordHash parses a modular crypt format hash. Supported schemes are bcrypt
+// ($2a$, $2b$, $2x$ and $2y$) and SHA-crypt ($5$ for SHA-256, $6$ for SHA-512).
+func ParsePasswordHash(s string) (PasswordHash, error) {
+	switch {
+	case strings.HasPrefix(s, "$2"):
+		return parseBcryptHash(s)
+	case strings.HasPrefix(s, "$5$"):
+		return parseSHACryptHash(s, sha256_crypt.New(), 43)
+	case strings.HasPrefix(s, "$6$"):
+		return parseSHACryptHash(s, sha512_crypt.New(), 86)
+	default:
+		return nil, fmt.Errorf("unsupported password hash scheme (want bcrypt, $5$ or $6$)")
+	}
+}
+
+// Hashes with a higher cost than these are rejected when they are loaded, so that a typo
+// in a users file cannot make every AUTH keep a CPU busy for hours.
+const (
+	bcryptMaxCost     = 16
+	shaCryptMaxRounds = 10000000
+)
+
+// bcryptHash is a $2a$, $2b$, $2x$ or $2y$ hash.
+type bcryptHash []byte
+
+func parseBcryptHash(s string) (PasswordHash, error) {
+	cost, err := bcrypt.Cost([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bcrypt hash: %w", err)
+	}
+	if cost > bcryptMaxCost {
+		return nil, fmt.Errorf("bcrypt cost %d is above the maximum of %d", cost, bcryptMaxCost)
+	}
+	return bcryptHash(s), nil
+}
+
+// Verify implements PasswordHash.
+func (h bcryptHash) Verify(password string) bool {
+	return bcrypt.CompareHashAndPassword(h, []byte(password)) == nil
+}
+
+// cryptAlphabet holds the characters of the base-64 encoding used by crypt(3).
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// shaCryptHash is a $5$ or $6$ hash.
+type shaCryptHash struct {
+	encoded string
+	setting string // $5$, any rounds and the salt
+	crypter crypt.Crypter
+}
+
+// parseSHACryptHash parses a hash whose digest is digestLen characters long, so that a
+// mistyped hash is reported rather than never matching.
+func parseSHACryptHash(s string, crypter crypt.Crypter, digestLen int) (PasswordHash, error) {
+	// $5$[rounds=N$]salt$digest
+	rest := s[3:]
+	if strings.HasPrefix(rest, "rounds=") {
+		_, rest, _ = strings.Cut(rest, "$")
+	}
+	_, digest, ok := strings.Cut(rest, "$")
+	if !ok || len(digest) != digestLen || strings.Trim(digest, cryptAlphabet) != "" {
+		return nil, fmt.Errorf("invalid SHA-crypt hash")
+	}
+	rounds, err := crypter.Cost(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SHA-crypt hash: %w", err)
+	}
+	if rounds > shaCryptMaxRounds {
+		return nil, fmt.Errorf("SHA-crypt rounds %d are above the maximum of %d", rounds, shaCryptMaxRounds)
+	}
+	return &shaCryptHash{encoded: s, setting: s[:strings.LastIndex(s, "$")], crypter: crypter}, nil
+}
+
+// Verify implements PasswordHash. The hash is recomputed from the setting alone: the
+// crypter's own Verify takes the digest for part of a salt shorter than 16 characters
+// when rounds are given.
+func (h *shaCryptHash) Verify(password string) bool {
+	computed, err := h.crypter.Generate([]byte(password), []byte(h.setting))
+	return err == nil && subtle.ConstantTimeCompare([]byte(computed), []byte(h.encoded)) == 1
+}
+
+// VerifyHash reports whether the credentials prove knowledge of the password stored as h.
+// Only PLAIN and LOGIN send the password itself, so no other mechanism verifies against a
+// hash.
+func (c *Credentials) VerifyHash(h PasswordHash) bool {
+	if c == nil || h == nil {
+		return false
+	}
+	switch strings.ToUpper(c.Mechanism) {
+	case AuthMechanismPlain, AuthMechanismLogin:
+		return h.Verify(c.Password)
+	default:
+		return false
+	}
+}
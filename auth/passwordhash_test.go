@@ -0,0 +1,35 @@
+package auth
+
+import "testing"
+
+func TestParsePasswordHash(t *testing.T) {
+	tests := []struct {
+		hash, password string
+	}{
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		{"$2y$04$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW", "secret"},
+		{"$5$rounds=1000$saltsalt$eKLZU9t9OoPWrqOQsoTIKG0aYkZ5rGOoOQhiIvoSWX2", "secret"},
+		{"$6$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1", "secret"},
+	}
+	for _, tt := range tests {
+		h, err := ParsePasswordHash(tt.hash)
+		if err != nil {
+			t.Fatalf("ParsePasswordHash(%q) failed: %v", tt.hash, err)
+		}
+		if !h.Verify(tt.password) {
+			t.Errorf("expected %q to match %q", tt.password, tt.hash)
+		}
+		if h.Verify(tt.password + "x") {
+			t.Errorf("expected a wrong password to fail for %q", tt.hash)
+		}
+	}
+
+	for _, bad := range []string{"secret", "$1$salt$hash", "$2a$99$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2a$17$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "$6$rounds=999999999$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1",
+		"$2a$05$short", "$6$saltonly", "$6$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1x",
+		"$5$saltsalt$not*base64"} {
+		if _, err := ParsePasswordHash(bad); err == nil {
+			t.Errorf("expected ParsePasswordHash(%q) to fail", bad)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // SCRAM-SHA-1 is defined in terms of SHA-1 (RFC 5802)
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+const (
+	// AuthMechanismScramSHA1 represents the SCRAM-SHA-1 authentication mechanism.
+	AuthMechanismScramSHA1 = "SCRAM-SHA-1"
+
+	// AuthMechanismScramSHA1Plus represents SCRAM-SHA-1 with TLS channel binding.
+	AuthMechanismScramSHA1Plus = "SCRAM-SHA-1-PLUS"
+
+	// AuthMechanismScramSHA256 represents the SCRAM-SHA-256 authentication mechanism.
+	AuthMechanismScramSHA256 = "SCRAM-SHA-256"
+
+	// AuthMechanismScramSHA256Plus represents SCRAM-SHA-256 with TLS channel binding.
+	AuthMechanismScramSHA256Plus = "SCRAM-SHA-256-PLUS"
+
+	// ScramIterations is the PBKDF2 iteration count offered to clients (RFC 7677 minimum).
+	ScramIterations = 4096
+
+	// ChannelBindingTLSUnique and ChannelBindingTLSExporter are the supported channel
+	// binding types (RFC 5929 and RFC 9266).
+	ChannelBindingTLSUnique   = "tls-unique"
+	ChannelBindingTLSExporter = "tls-exporter"
+
+	scramSaltSize  = 16
+	scramNonceSize = 18
+
+	// scramLowIterations is the deliberately weak count sent to scramlowiter users.
+	scramLowIterations = 1
+
+	// tlsExporterLabel is the exporter label for tls-exporter channel binding (RFC 9266).
+	tlsExporterLabel = "EXPORTER-Channel-Binding"
+	tlsExporterSize  = 32
+)
+
+// Username patterns that make the SCRAM server misbehave, so clients can be checked for
+// detecting a malicious or broken server.
+const (
+	ScramBadSignaturePattern = "scrambadsig"   // server-final carries a wrong ServerSignature
+	ScramLowIterPattern      = "scramlowiter"  // server-first offers an iteration count of 1
+	ScramBadNoncePattern     = "scrambadnonce" // server-first nonce does not extend the client nonce
+)
+
+// ScramHandler implements the SCRAM-SHA-1 and SCRAM-SHA-256 mechanisms and their -PLUS
+// channel-binding variants (RFC 5802, RFC 7677).
+type ScramHandler struct {
+	Name string // Mechanism name, which selects the hash, as Credentials.Verify does
+	Plus bool   // -PLUS variant: channel binding is required
+
+	// TLSState is the session's TLS state, used for channel binding. Nil on cleartext.
+	TLSState *tls.ConnectionState
+	// ChannelBinding reports whether -PLUS mechanisms were advertised in this session.
+	ChannelBinding bool
+	// LookupSecret returns a user's password; the server needs it to verify the client
+	// proof and to prove itself in server-final.
+	LookupSecret func(username string) (secret string, ok bool)
+}
+
+// Authenticate runs the SCRAM exchange. The client proof is checked against the secret
+// from LookupSecret before the server signature is sent.
+func (h *ScramHandler) Authenticate(ex *Exchange, parts []string) (*Credentials, error) {
+	clientFirst, err := ex.response(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := parseScramClientFirst(string(clientFirst))
+	if err != nil {
+		return nil, err
+	}
+	creds := &Credentials{Mechanism: h.Name, Username: first.username, Authzid: first.authzid}
+	if err := h.checkChannelBindingFlag(first); err != nil {
+		return creds, err
+	}
+
+	secret, ok := "", false
+	if h.LookupSecret != nil {
+		secret, ok = h.LookupSecret(first.username)
+	}
+	if !ok {
+		return creds, fmt.Errorf("no SCRAM secret for user: %s", first.username)
+	}
+
+	// server-first-message
+	salt := make([]byte, scramSaltSize)
+	serverNonce := make([]byte, scramNonceSize)
+	if _, err := rand.Read(salt); err != nil {
+		return creds, err
+	}
+	if _, err := rand.Read(serverNonce); err != nil {
+		return creds, err
+	}
+	nonce := first.nonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	iterations := ScramIterations
+	lowerUser := strings.ToLower(first.username)
+	if strings.Contains(lowerUser, ScramLowIterPattern) {
+		iterations = scramLowIterations
+	}
+	advertisedNonce := nonce
+	if strings.Contains(lowerUser, ScramBadNoncePattern) {
+		advertisedNonce = base64.RawStdEncoding.EncodeToString(serverNonce)
+		nonce = advertisedNonce
+	}
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", advertisedNonce, base64.StdEncoding.EncodeToString(salt), iterations)
+
+	clientFinal, err := ex.Challenge([]byte(serverFirst))
+	if err != nil {
+		return creds, err
+	}
+	final, err := parseScramClientFinal(string(clientFinal))
+	if err != nil {
+		return creds, err
+	}
+	if final.nonce != nonce {
+		return creds, fmt.Errorf("SCRAM nonce mismatch")
+	}
+	if err := h.checkChannelBinding(first, final); err != nil {
+		return creds, err
+	}
+
+	creds.Challenge = first.bare + "," + serverFirst + "," + final.withoutProof
+	creds.Response = final.proof
+	creds.Salt = salt
+	creds.Iterations = iterations
+	creds.ChannelBinding = first.cbName
+	if !creds.Verify(secret) {
+		return creds, fmt.Errorf("invalid SCRAM proof for user: %s", first.username)
+	}
+
+	// server-final-message
+	signature := scramServerSignature(scramHashFunc(h.Name), secret, salt, iterations, creds.Challenge)
+	if strings.Contains(lowerUser, ScramBadSignaturePattern) {
+		signature[0] ^= 0xff
+	}
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(signature)
+	if _, err := ex.Challenge([]byte(serverFinal)); err != nil {
+		return creds, err
+	}
+	return creds, nil
+}
+
+// checkChannelBindingFlag checks the gs2 channel binding flag against the mechanism.
+func (h *ScramHandler) checkChannelBindingFlag(first *scramClientFirst) error {
+	switch first.cbFlag {
+	case "p":
+		if !h.Plus {
+			return fmt.Errorf("channel binding requested with non-PLUS mechanism")
+		}
+		if h.TLSState == nil {
+			return fmt.Errorf("channel binding requested without TLS")
+		}
+		if first.cbName != ChannelBindingTLSUnique && first.cbName != ChannelBindingTLSExporter {
+			return fmt.Errorf("unsupported channel binding type %q", first.cbName)
+		}
+	case "y":
+		// The client supports channel binding but thinks we do not: a downgrade if we
+		// offered -PLUS in this session (RFC 5802 section 6)
+		if h.ChannelBinding {
+			return fmt.Errorf("channel binding downgrade detected")
+		}
+	default:
+		if h.Plus {
+			return fmt.Errorf("%s requires channel binding", h.Name)
+		}
+	}
+	return nil
+}
+
+// checkChannelBinding verifies the c= attribute carries the gs2 header and, for -PLUS,
+// the channel binding data of this TLS session.
+func (h *ScramHandler) checkChannelBinding(first *scramClientFirst, final *scramClientFinal) error {
+	expected := []byte(first.gs2Header)
+	if first.cbFlag == "p" {
+		data, err := channelBindingData(h.TLSState, first.cbName)
+		if err != nil {
+			return err
+		}
+		expected = append(expected, data...)
+	}
+	got, err := base64.StdEncoding.DecodeString(final.channelBinding)
+	if err != nil {
+		return fmt.Errorf("invalid channel binding encoding")
+	}
+	if subtle.ConstantTimeCompare(got, expected) != 1 {
+		return fmt.Errorf("channel binding mismatch")
+	}
+	return nil
+}
+
+// channelBindingData returns the channel binding data of the given type for state.
+func channelBindingData(state *tls.ConnectionState, cbName string) ([]byte, error) {
+	switch cbName {
+	case ChannelBindingTLSUnique:
+		if len(state.TLSUnique) == 0 {
+			return nil, fmt.Errorf("tls-unique is not available for this TLS version")
+		}
+		return state.TLSUnique, nil
+	case ChannelBindingTLSExporter:
+		return state.ExportKeyingMaterial(tlsExporterLabel, nil, tlsExporterSize)
+	default:
+		return nil, fmt.Errorf("unsupported channel binding type %q", cbName)
+	}
+}
+
+// scramClientFirst is a parsed client-first-message.
+type scramClientFirst struct {
+	gs2Header string // "n,," / "y,," / "p=<name>,," including any authzid
+	cbFlag    string // "n", "y" or "p"
+	cbName    string // channel binding type when cbFlag is "p"
+	authzid   string
+	username  string
+	nonce     string
+	bare      string // client-first-message-bare, part of the AuthMessage
+}
+
+func parseScramClientFirst(msg string) (*scramClientFirst, error) {
+	fields := strings.SplitN(msg, ",", 3)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid SCRAM client-first-message")
+	}
+	first := &scramClientFirst{gs2Header: fields[0] + "," + fields[1] + ",", bare: fields[2]}
+	switch {
+	case fields[0] == "n" || fields[0] == "y":
+		first.cbFlag = fields[0]
+	case strings.HasPrefix(fields[0], "p="):
+		first.cbFlag, first.cbName = "p", strings.TrimPrefix(fields[0], "p=")
+	default:
+		return nil, fmt.Errorf("invalid SCRAM channel binding flag")
+	}
+	if fields[1] != "" {
+		if !strings.HasPrefix(fields[1], "a=") {
+			return nil, fmt.Errorf("invalid SCRAM authzid")
+		}
+		first.authzid = scramUnescape(strings.TrimPrefix(fields[1], "a="))
+	}
+
+	attrs := strings.Split(first.bare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, fmt.Errorf("invalid SCRAM client-first-message")
+	}
+	first.username = scramUnescape(strings.TrimPrefix(attrs[0], "n="))
+	first.nonce = strings.TrimPrefix(attrs[1], "r=")
+	if first.username == "" || first.nonce == "" {
+		return nil, fmt.Errorf("invalid SCRAM client-first-message")
+	}
+	return first, nil
+}
+
+// scramClientFinal is a parsed client-final-message.
+type scramClientFinal struct {
+	channelBinding string // base64 c= value
+	nonce          string
+	proof          string // base64 p= value
+	withoutProof   string // client-final-message-without-proof, part of the AuthMessage
+}
+
+func parseScramClientFinal(msg string) (*scramClientFinal, error) {
+	idx := strings.LastIndex(msg, ",p=")
+	if idx < 0 {
+		return nil, fmt.Errorf("invalid SCRAM client-final-message")
+	}
+	final := &scramClientFinal{withoutProof: msg[:idx], proof: msg[idx+len(",p="):]}
+	attrs := strings.Split(final.withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, fmt.Errorf("invalid SCRAM client-final-message")
+	}
+	final.channelBinding = strings.TrimPrefix(attrs[0], "c=")
+	final.nonce = strings.TrimPrefix(attrs[1], "r=")
+	return final, nil
+}
+
+// scramUnescape decodes the =2C and =3D escapes used in SCRAM saslnames.
+func scramUnescape(s string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(s)
+}
+
+// scramHashFunc returns the hash for a SCRAM mechanism name.
+func scramHashFunc(mechanism string) func() hash.Hash {
+	if strings.HasPrefix(strings.ToUpper(mechanism), AuthMechanismScramSHA1) {
+		return sha1.New
+	}
+	return sha256.New
+}
+
+// scramSaltedPassword computes Hi(password, salt, i) (RFC 5802 section 2.2).
+func scramSaltedPassword(hashFunc func() hash.Hash, password string, salt []byte, iterations int) []byte {
+	key, err := pbkdf2.Key(hashFunc, password, salt, iterations, hashFunc().Size())
+	if err != nil {
+		// Only possible for invalid parameters in FIPS mode; fall back to an unusable key
+		return make([]byte, hashFunc().Size())
+	}
+	return key
+}
+
+func scramHMAC(hashFunc func() hash.Hash, key []byte, msg string) []byte {
+	mac := hmac.New(hashFunc, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramVerifyProof reports whether proof was computed from password over authMessage.
+func scramVerifyProof(hashFunc func() hash.Hash, password string, salt []byte, iterations int, authMessage string, proof []byte) bool {
+	salted := scramSaltedPassword(hashFunc, password, salt, iterations)
+	clientKey := scramHMAC(hashFunc, salted, "Client Key")
+	h := hashFunc()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	signature := scramHMAC(hashFunc, storedKey, authMessage)
+	if len(proof) != len(signature) {
+		return false
+	}
+	for i := range proof {
+		proof[i] ^= signature[i]
+	}
+	h = hashFunc()
+	h.Write(proof)
+	return subtle.ConstantTimeCompare(h.Sum(nil), storedKey) == 1
+}
+
+// scramServerSignature computes the ServerSignature sent in server-final.
+func scramServerSignature(hashFunc func() hash.Hash, password string, salt []byte, iterations int, authMessage string) []byte {
+	salted := scramSaltedPassword(hashFunc, password, salt, iterations)
+	serverKey := scramHMAC(hashFunc, salted, "Server Key")
+	return scramHMAC(hashFunc, serverKey, authMessage)
+}
+
+// ScramClientProof computes the base64 ClientProof a client sends for authMessage. It
+// is exported for tests and tools that drive a SCRAM exchange against BadSMTP.
+func ScramClientProof(mechanism, password string, salt []byte, iterations int, authMessage string) string {
+	hashFunc := scramHashFunc(mechanism)
+	salted := scramSaltedPassword(hashFunc, password, salt, iterations)
+	clientKey := scramHMAC(hashFunc, salted, "Client Key")
+	h := hashFunc()
+	h.Write(clientKey)
+	signature := scramHMAC(hashFunc, h.Sum(nil), authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+	return base64.StdEncoding.EncodeToString(clientKey)
+}
+
+// ScramServerSignature computes the base64 ServerSignature a client should expect for
+// authMessage.
+func ScramServerSignature(mechanism, password string, salt []byte, iterations int, authMessage string) string {
+	return base64.StdEncoding.EncodeToString(scramServerSignature(scramHashFunc(mechanism), password, salt, iterations, authMessage))
+}
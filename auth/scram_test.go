@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scramResult is what a test client observed during a SCRAM exchange.
+type scramResult struct {
+	serverFirst string // decoded server-first-message
+	serverFinal string // decoded server-final-message ("" if the server failed first)
+	authMessage string
+	salt        []byte
+	iterations  int
+	creds       *Credentials
+	err         error // error returned by the handler
+}
+
+// runScram drives a SCRAM exchange against handler over a pipe. gs2Header is the
+// client's gs2 header and cbData the channel binding data appended to it in c=.
+func runScram(t *testing.T, handler Handler, mechanism, username, password, gs2Header string, cbData []byte) *scramResult {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+
+	res := &scramResult{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		res.creds, res.err = handler.Authenticate(exchangeOver(server), []string{"AUTH", mechanism})
+	}()
+
+	r := bufio.NewReader(client)
+	readChallenge := func() (string, bool) {
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "334 ") {
+			return "", false
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[4:]))
+		if err != nil {
+			t.Fatalf("server sent invalid base64: %q", line)
+		}
+		return string(decoded), true
+	}
+	send := func(msg string) {
+		if _, err := client.Write([]byte(base64.StdEncoding.EncodeToString([]byte(msg)) + "\r\n")); err != nil {
+			t.Fatalf("client write failed: %v", err)
+		}
+	}
+
+	if _, ok := readChallenge(); !ok {
+		<-done
+		return res
+	}
+	clientFirstBare := "n=" + username + ",r=clientnonce"
+	send(gs2Header + clientFirstBare)
+
+	serverFirst, ok := readChallenge()
+	if !ok {
+		<-done
+		return res
+	}
+	res.serverFirst = serverFirst
+	var nonce string
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch {
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		case strings.HasPrefix(attr, "s="):
+			res.salt, _ = base64.StdEncoding.DecodeString(attr[2:])
+		case strings.HasPrefix(attr, "i="):
+			res.iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+
+	cbind := base64.StdEncoding.EncodeToString(append([]byte(gs2Header), cbData...))
+	withoutProof := "c=" + cbind + ",r=" + nonce
+	res.authMessage = clientFirstBare + "," + serverFirst + "," + withoutProof
+	send(withoutProof + ",p=" + ScramClientProof(mechanism, password, res.salt, res.iterations, res.authMessage))
+
+	if serverFinal, ok := readChallenge(); ok {
+		res.serverFinal = serverFinal
+		send("")
+	}
+	<-done
+	return res
+}
+
+func staticSecret(secret string) func(string) (string, bool) {
+	return func(string) (string, bool) { return secret, true }
+}
+
+func TestScramHandlerAuthenticate(t *testing.T) {
+	for _, mech := range []string{AuthMechanismScramSHA1, AuthMechanismScramSHA256} {
+		t.Run(mech, func(t *testing.T) {
+			handler := NewHandlerWithOptions(mech, HandlerOptions{LookupSecret: staticSecret("s3cret")})
+			res := runScram(t, handler, mech, "user@example.com", "s3cret", "n,,", nil)
+			if res.err != nil {
+				t.Fatalf("expected success, got %v", res.err)
+			}
+			if res.creds.Username != "user@example.com" || res.creds.Mechanism != mech {
+				t.Errorf("unexpected credentials %+v", res.creds)
+			}
+			if !strings.HasPrefix(res.serverFirst, "r=clientnonce") || res.iterations != ScramIterations {
+				t.Errorf("unexpected server-first-message %q", res.serverFirst)
+			}
+			want := "v=" + ScramServerSignature(mech, "s3cret", res.salt, res.iterations, res.authMessage)
+			if res.serverFinal != want {
+				t.Errorf("server-final = %q, want %q", res.serverFinal, want)
+			}
+			if !res.creds.Verify("s3cret") || res.creds.Verify("guess") {
+				t.Error("Verify() did not match the SCRAM proof")
+			}
+		})
+	}
+}
+
+func TestScramHandlerFailures(t *testing.T) {
+	opts := HandlerOptions{LookupSecret: staticSecret("s3cret")}
+
+	res := runScram(t, NewHandlerWithOptions(AuthMechanismScramSHA256, opts), AuthMechanismScramSHA256, "user@example.com", "guess", "n,,", nil)
+	if res.err == nil || res.serverFinal != "" {
+		t.Errorf("wrong password: expected failure before server-final, got %v / %q", res.err, res.serverFinal)
+	}
+
+	res = runScram(t, NewHandler(AuthMechanismScramSHA256), AuthMechanismScramSHA256, "user@example.com", "s3cret", "n,,", nil)
+	if res.err == nil {
+		t.Error("expected failure without a secret lookup")
+	}
+
+	res = runScram(t, NewHandlerWithOptions(AuthMechanismScramSHA256, opts), AuthMechanismScramSHA256, "user@example.com", "s3cret", "p=tls-unique,,", nil)
+	if res.err == nil {
+		t.Error("expected failure for channel binding with a non-PLUS mechanism")
+	}
+
+	if NewHandlerWithOptions(AuthMechanismScramSHA256Plus, opts) != nil {
+		t.Error("expected no -PLUS handler without TLS")
+	}
+
+	tlsOpts := HandlerOptions{LookupSecret: staticSecret("s3cret"), TLSState: &tls.ConnectionState{TLSUnique: []byte("finished")}}
+	res = runScram(t, NewHandlerWithOptions(AuthMechanismScramSHA256, tlsOpts), AuthMechanismScramSHA256, "user@example.com", "s3cret", "y,,", nil)
+	if res.err != nil {
+		t.Errorf("expected the y flag to be accepted over TLS when -PLUS was not advertised, got %v", res.err)
+	}
+	tlsOpts.ChannelBinding = true
+	res = runScram(t, NewHandlerWithOptions(AuthMechanismScramSHA256, tlsOpts), AuthMechanismScramSHA256, "user@example.com", "s3cret", "y,,", nil)
+	if res.err == nil {
+		t.Error("expected downgrade detection for y flag when -PLUS was advertised")
+	}
+}
+
+func TestScramChannelBinding(t *testing.T) {
+	state := &tls.ConnectionState{TLSUnique: []byte("finished")}
+	opts := HandlerOptions{LookupSecret: staticSecret("s3cret"), TLSState: state}
+	handler := NewHandlerWithOptions(AuthMechanismScramSHA1Plus, opts)
+
+	res := runScram(t, handler, AuthMechanismScramSHA1Plus, "user@example.com", "s3cret", "p=tls-unique,,", state.TLSUnique)
+	if res.err != nil {
+		t.Fatalf("expected success, got %v", res.err)
+	}
+	if res.creds.ChannelBinding != ChannelBindingTLSUnique {
+		t.Errorf("ChannelBinding = %q", res.creds.ChannelBinding)
+	}
+
+	res = runScram(t, handler, AuthMechanismScramSHA1Plus, "user@example.com", "s3cret", "p=tls-unique,,", []byte("other"))
+	if res.err == nil {
+		t.Error("expected failure for mismatched channel binding data")
+	}
+
+	res = runScram(t, handler, AuthMechanismScramSHA1Plus, "user@example.com", "s3cret", "n,,", nil)
+	if res.err == nil {
+		t.Error("expected -PLUS to require channel binding")
+	}
+}
+
+func TestScramMaliciousServerPatterns(t *testing.T) {
+	opts := HandlerOptions{LookupSecret: staticSecret("s3cret")}
+	mech := AuthMechanismScramSHA256
+
+	res := runScram(t, NewHandlerWithOptions(mech, opts), mech, "scrambadsig@example.com", "s3cret", "n,,", nil)
+	good := "v=" + ScramServerSignature(mech, "s3cret", res.salt, res.iterations, res.authMessage)
+	if res.serverFinal == "" || res.serverFinal == good {
+		t.Errorf("scrambadsig: expected a wrong server signature, got %q", res.serverFinal)
+	}
+
+	res = runScram(t, NewHandlerWithOptions(mech, opts), mech, "scramlowiter@example.com", "s3cret", "n,,", nil)
+	if res.iterations != 1 {
+		t.Errorf("scramlowiter: iterations = %d, want 1", res.iterations)
+	}
+
+	res = runScram(t, NewHandlerWithOptions(mech, opts), mech, "scrambadnonce@example.com", "s3cret", "n,,", nil)
+	if strings.HasPrefix(res.serverFirst, "r=clientnonce") {
+		t.Errorf("scrambadnonce: server nonce extends the client nonce: %q", res.serverFirst)
+	}
+}
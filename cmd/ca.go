@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+
+	"badsmtp/server"
+
+	"github.com/spf13/cobra"
+)
+
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Manage the local CA that signs BadSMTP's certificates",
+}
+
+var caExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Print the CA certificate in PEM format",
+	Long: "Print the certificate of the local CA in tls_ca_dir, creating the CA first if needed. " +
+		"Add it to a client's trust store to verify the certificates BadSMTP serves.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		cfg, err := loadConfig(cmd.Root().PersistentFlags())
+		if err != nil {
+			return err
+		}
+		if cfg.TLSCADir == "" {
+			return fmt.Errorf("tls_ca_dir is empty, so there is no persistent CA to export")
+		}
+		ca, err := server.LoadOrCreateCA(cfg.TLSCADir)
+		if err != nil {
+			return fmt.Errorf("failed to load CA: %w", err)
+		}
+		_, err = cmd.OutOrStdout().Write(ca.CertPEM())
+		return err
+	},
+}
+
+// registerCACommands adds the ca command and its subcommands to the root command.
+func registerCACommands() {
+	caCmd.AddCommand(caExportCmd)
+	rootCmd.AddCommand(caCmd)
+}
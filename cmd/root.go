@@ -14,6 +14,7 @@ import (
 	kfile "github.com/knadh/koanf/providers/file"
 	kposflag "github.com/knadh/koanf/providers/posflag"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var rootCmd = &cobra.Command{
@@ -21,66 +22,133 @@ var rootCmd = &cobra.Command{
 	Short: "BadSMTP SMTP testing server",
 	Long:  "BadSMTP is a configurable SMTP server for testing clients and integrations.",
 	RunE: func(cmd *cobra.Command, _ []string) error {
-		// Create koanf instance
-		k := koanf.New(".")
-
-		// Load config file first (lowest priority, except for built-in defaults)
-		// Check for --config flag to see if user specified a custom config path
-		cfgPath := cmd.Flag("config").Value.String()
-		if cfgPath != "" {
-			if err := k.Load(kfile.Provider(cfgPath), kyaml.Parser()); err != nil {
-				return fmt.Errorf("failed to load config file %s: %w", cfgPath, err)
-			}
-		} else {
-			// Search for config files in standard locations (in order of precedence)
-			searchPaths := getConfigSearchPaths()
-			extensions := []string{"yaml", "yml", "json"}
-
-			configFound := false
-			for _, dir := range searchPaths {
-				for _, ext := range extensions {
-					configPath := fmt.Sprintf("%s/badsmtp.%s", dir, ext)
-					if _, err := os.Stat(configPath); err == nil {
-						if err := k.Load(kfile.Provider(configPath), kyaml.Parser()); err != nil {
-							return fmt.Errorf("failed to load config file %s: %w", configPath, err)
-						}
-						configFound = true
-						break
+		cfg, err := loadConfig(cmd.PersistentFlags())
+		if err != nil {
+			return err
+		}
+
+		srv, err := server.NewServer(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create server: %w", err)
+		}
+
+		return srv.Start()
+	},
+}
+
+// loadConfig builds the server configuration from the config file, BADSMTP_*
+// environment variables and the root command's flags, in increasing order of precedence.
+func loadConfig(flags *pflag.FlagSet) (*server.Config, error) {
+	// Create koanf instance
+	k := koanf.New(".")
+
+	// Load config file first (lowest priority, except for built-in defaults)
+	// Check for --config flag to see if user specified a custom config path
+	cfgPath := flags.Lookup("config").Value.String()
+	if cfgPath != "" {
+		if err := k.Load(kfile.Provider(cfgPath), kyaml.Parser()); err != nil {
+			return nil, fmt.Errorf("failed to load config file %s: %w", cfgPath, err)
+		}
+	} else {
+		// Search for config files in standard locations (in order of precedence)
+		searchPaths := getConfigSearchPaths()
+		extensions := []string{"yaml", "yml", "json"}
+
+		configFound := false
+		for _, dir := range searchPaths {
+			for _, ext := range extensions {
+				configPath := fmt.Sprintf("%s/badsmtp.%s", dir, ext)
+				if _, err := os.Stat(configPath); err == nil {
+					if err := k.Load(kfile.Provider(configPath), kyaml.Parser()); err != nil {
+						return nil, fmt.Errorf("failed to load config file %s: %w", configPath, err)
 					}
-				}
-				if configFound {
+					configFound = true
 					break
 				}
 			}
+			if configFound {
+				break
+			}
 		}
+	}
 
-		// Load environment variables (prefix BADSMTP) - medium priority, overrides config file
-		// use a replacer function to map ENV names to koanf keys
-		if err := k.Load(kenv.Provider("BADSMTP_", "_", createEnvReplacer().Replace), nil); err != nil {
-			return fmt.Errorf("failed to load env: %w", err)
-		}
+	// Load environment variables (prefix BADSMTP) - medium priority, overrides config file
+	// use a replacer function to map ENV names to koanf keys
+	if err := k.Load(kenv.Provider("BADSMTP_", "_", createEnvReplacer().Replace), nil); err != nil {
+		return nil, fmt.Errorf("failed to load env: %w", err)
+	}
 
-		// Load command-line flags last (highest priority) - overrides everything
-		if err := k.Load(kposflag.Provider(cmd.PersistentFlags(), ":", k), nil); err != nil {
-			return fmt.Errorf("failed to load flags: %w", err)
-		}
+	// Load command-line flags last (highest priority) - overrides everything
+	if err := k.Load(kposflag.ProviderWithFlag(flags, ":", k, flagConfigKey(flags, k)), nil); err != nil {
+		return nil, fmt.Errorf("failed to load flags: %w", err)
+	}
+
+	// Hostnames contain the koanf delimiter, so hostname_mailbox_map is nested by the
+	// loaders; take it out and flatten it back into hostname keys.
+	hostnameMap := hostnameMailboxMap(k)
 
-		// Unmarshal into typed config
-		var cfg server.Config
-		if err := k.Unmarshal("", &cfg); err != nil {
-			return fmt.Errorf("failed to unmarshal config: %w", err)
+	// Unmarshal into typed config, matching keys to Config's mapstructure tags
+	var cfg server.Config
+	if err := k.UnmarshalWithConf("", &cfg, koanf.UnmarshalConf{Tag: "mapstructure"}); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	for hostname, dir := range hostnameMap {
+		if cfg.HostnameMailboxMap == nil {
+			cfg.HostnameMailboxMap = make(map[string]string)
 		}
+		cfg.HostnameMailboxMap[hostname] = dir
+	}
 
-		// Apply defaults
-		cfg.EnsureDefaults()
+	// Apply defaults
+	cfg.EnsureDefaults()
+	return &cfg, nil
+}
 
-		srv, err := server.NewServer(&cfg)
-		if err != nil {
-			return fmt.Errorf("failed to create server: %w", err)
+// flagAliases maps flag names whose config key is not simply the dashed name with underscores.
+// Nested keys use koanf's "." delimiter.
+var flagAliases = map[string]string{
+	"mailbox":           "mailbox_dir",
+	"tls-min-version":   "tls.min_version",
+	"tls-max-version":   "tls.max_version",
+	"tls-cipher-suites": "tls.cipher_suites",
+	"tls-curves":        "tls.curves",
+}
+
+// flagConfigKey returns a posflag callback mapping flag names (e.g. "enable-hostname-routing")
+// to the snake_case keys used by Config's mapstructure tags. The --config flag is skipped.
+func flagConfigKey(flags *pflag.FlagSet, k *koanf.Koanf) func(f *pflag.Flag) (string, interface{}) {
+	return func(f *pflag.Flag) (string, interface{}) {
+		if f.Name == "config" {
+			return "", nil
+		}
+		key, ok := flagAliases[f.Name]
+		if !ok {
+			key = strings.ReplaceAll(f.Name, "-", "_")
+		}
+		if strings.Contains(key, ".") {
+			// posflag nests keys on ":" (hostnames contain "."), but checks whether an unset
+			// flag's key is already configured as given, so do that check here
+			if !f.Changed && k.Exists(key) {
+				return "", nil
+			}
+			key = strings.ReplaceAll(key, ".", ":")
 		}
+		return key, kposflag.FlagVal(flags, f)
+	}
+}
 
-		return srv.Start()
-	},
+// hostnameMailboxMap removes hostname_mailbox_map from k and returns it keyed by full hostname.
+func hostnameMailboxMap(k *koanf.Koanf) map[string]string {
+	const key = "hostname_mailbox_map"
+	if !k.Exists(key) {
+		return nil
+	}
+	mappings := make(map[string]string)
+	for hostname, dir := range k.Cut(key).All() {
+		mappings[hostname] = fmt.Sprint(dir)
+	}
+	k.Delete(key)
+	return mappings
 }
 
 func createEnvReplacer() *strings.Replacer {
@@ -112,6 +180,7 @@ func RegisterFlags() {
 	pf.StringP("config", "c", "", "Configuration file path")
 	pf.Bool("enable-hostname-routing", false, "Enable hostname-based routing")
 	pf.String("default-mailbox-dir", "", "Default mailbox directory for unmapped hostnames")
+	pf.Bool("token-mailboxes", false, "Store messages from sessions with a tok<id> EHLO label in a sub-mailbox per token")
 
 	// Listen address (bind IP)
 	pf.String("listen-address", "127.0.0.1", "IP address to bind listeners to (maps to listen_address)")
@@ -119,6 +188,7 @@ func RegisterFlags() {
 	// Port range configurations
 	pf.Int("greeting-delay-port-start", server.DefaultGreetingDelayStart, "Starting port for greeting delays")
 	pf.Int("drop-delay-port-start", server.DefaultDropDelayStart, "Starting port for drop delays")
+	pf.Int("tls-behaviour-port-start", server.DefaultTLSBehaviourStart, "Starting port for misbehaving TLS handshakes")
 
 	// TLS configuration
 	pf.String("tls-cert-file", "", "Path to TLS certificate file")
@@ -126,6 +196,25 @@ func RegisterFlags() {
 	pf.Int("tls-port", server.DefaultTLSPort, "Port for implicit TLS (SMTPS)")
 	pf.Int("starttls-port", server.DefaultSTARTTLSPort, "Port for STARTTLS")
 	pf.String("tls-hostname", server.DefaultTLSHostname, "Hostname for TLS certificate")
+	pf.String("tls-client-ca-file", "", "Path to the CA bundle that issues TLS client certificates")
+	pf.String("tls-client-auth", server.TLSClientAuthNone, "TLS client certificate mode: none, request or require")
+	pf.String("tls-ca-dir", server.DefaultTLSCADir(), "Directory holding the local CA that signs generated certificates (created on first run)")
+	pf.String("tls-min-version", "", "Minimum TLS version for implicit TLS and STARTTLS: 1.0, 1.1, 1.2 or 1.3 (default 1.2)")
+	pf.String("tls-max-version", "", "Maximum TLS version for implicit TLS and STARTTLS: 1.0, 1.1, 1.2 or 1.3")
+	pf.StringSlice("tls-cipher-suites", nil, "TLS 1.0-1.2 cipher suites to accept, by name (default: Go's secure suites)")
+	pf.StringSlice("tls-curves", nil, "Key exchanges in order of preference, e.g. X25519,P256 (default: Go's)")
+	pf.String("tls-key-log-file", "", "File to append TLS secrets to for decrypting captured traffic (default: $SSLKEYLOGFILE)")
+
+	// Authentication configuration
+	pf.String("auth-users-file", "", "YAML, JSON or htpasswd file of users whose passwords AUTH verifies (reloaded on change)")
+
+	// LMTP configuration
+	pf.Int("lmtp-port", 0, "Port for LMTP (RFC 2033) connections (0 disables)")
+
+	// Submission configuration
+	pf.Int("submission-port", 0, "Port for message submission (RFC 6409) connections (0 disables)")
+
+	registerCACommands()
 }
 
 // Execute sets the version and runs the root command.
@@ -217,8 +217,8 @@ func (l *SMTPLogger) LogErrorSimulation(errorCode int, trigger, smtpStage string
 		F("hostname", l.hostname))
 }
 
-// LogTLSHandshake logs TLS handshake events
-func (l *SMTPLogger) LogTLSHandshake(success bool, tlsVersion, cipher string, err error) {
+// LogTLSHandshake logs TLS handshake events, with any extra fields describing the connection
+func (l *SMTPLogger) LogTLSHandshake(success bool, tlsVersion, cipher string, err error, extra ...Field) {
 	fields := []Field{
 		F("client_ip", l.clientIP),
 		F("success", success),
@@ -232,6 +232,7 @@ func (l *SMTPLogger) LogTLSHandshake(success bool, tlsVersion, cipher string, er
 	if l.hostname != "" {
 		fields = append(fields, F("hostname", l.hostname))
 	}
+	fields = append(fields, extra...)
 
 	if success {
 		l.Info("TLS handshake successful", fields...)
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"badsmtp/auth"
+)
+
+// User metadata keys set by UserAuthenticator. Custom Authorizers can read them from
+// User.Metadata; PolicyAuthorizer enforces the quota and allowed senders.
+const (
+	MetadataQuota             = "quota"
+	MetadataAllowedSenders    = "allowed_senders"
+	MetadataAllowedMechanisms = "allowed_mechanisms"
+)
+
+// AuthUser is an account checked by UserAuthenticator. It is loaded from the auth_users
+// configuration key or from the auth_users_file.
+type AuthUser struct {
+	Username          string                 `mapstructure:"username"`           // Authentication identity (matched case-insensitively)
+	Password          string                 `mapstructure:"password"`           // Cleartext secret: the password, CRAM key and XOAUTH2 token
+	PasswordHash      string                 `mapstructure:"password_hash"`      // bcrypt or SHA-crypt hash, checked for PLAIN and LOGIN only
+	Active            *bool                  `mapstructure:"active"`             // Whether the account may log in (default true)
+	Quota             int64                  `mapstructure:"quota"`              // Total bytes the user may send (0 = unlimited)
+	AllowedSenders    []string               `mapstructure:"allowed_senders"`    // MAIL FROM patterns the user may use (empty = any)
+	AllowedMechanisms []string               `mapstructure:"allowed_mechanisms"` // SASL mechanisms the user may use (empty = any)
+	Metadata          map[string]interface{} `mapstructure:"metadata"`           // Extra values copied into User.Metadata
+
+	hash auth.PasswordHash
+}
+
+// UserAuthenticator verifies the secret supplied during AUTH against a list of users:
+// PLAIN and LOGIN passwords, CRAM-MD5 and CRAM-SHA256 digests, and XOAUTH2 tokens
+// (unless a TokenValidator checked them), and SCRAM proofs. Users with a password hash
+// instead of a cleartext password can only use PLAIN and LOGIN. EXTERNAL only needs a
+// known user, as the client certificate was verified during the TLS handshake. Unknown
+// users and wrong secrets both fail.
+//
+// The users can be replaced at any time with SetUsers, e.g. when a users file changes.
+type UserAuthenticator struct {
+	mu    sync.RWMutex
+	users map[string]AuthUser
+}
+
+// NewUserAuthenticator creates an authenticator for the given users. If any of them is
+// invalid, e.g. has an unparsable password hash, nobody can log in; SetUsers reports the
+// error, and NewServer does so for Config.AuthUsers.
+func NewUserAuthenticator(users []AuthUser) *UserAuthenticator {
+	byName, err := indexUsers(users)
+	if err != nil {
+		byName = make(map[string]AuthUser)
+	}
+	return &UserAuthenticator{users: byName}
+}
+
+// SetUsers replaces the users. On error, such as an unparsable password hash, the
+// current users are kept.
+func (a *UserAuthenticator) SetUsers(users []AuthUser) error {
+	byName, err := indexUsers(users)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.users = byName
+	a.mu.Unlock()
+	return nil
+}
+
+// indexUsers parses the password hashes and maps the users by lower-cased username.
+func indexUsers(users []AuthUser) (map[string]AuthUser, error) {
+	byName := make(map[string]AuthUser, len(users))
+	for _, u := range users {
+		if u.Username == "" {
+			return nil, fmt.Errorf("user without a username")
+		}
+		if u.PasswordHash != "" {
+			hash, err := auth.ParsePasswordHash(u.PasswordHash)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %w", u.Username, err)
+			}
+			u.hash = hash
+		}
+		byName[strings.ToLower(u.Username)] = u
+	}
+	return byName, nil
+}
+
+func (a *UserAuthenticator) lookup(username string) (AuthUser, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[strings.ToLower(username)]
+	return u, ok
+}
+
+// Authenticate checks a cleartext username and password.
+func (a *UserAuthenticator) Authenticate(username, password string) (*User, error) {
+	return a.AuthenticateCredentials(&auth.Credentials{
+		Mechanism: auth.AuthMechanismPlain,
+		Username:  username,
+		Password:  password,
+	})
+}
+
+// AuthenticateCredentials checks the secret proved by creds (implements CredentialsAuthenticator).
+func (a *UserAuthenticator) AuthenticateCredentials(creds *auth.Credentials) (*User, error) {
+	u, ok := a.lookup(creds.Username)
+	// A bearer token already checked by the TokenValidator, or a verified client
+	// certificate, only needs a known user
+	if !ok || !u.allowsMechanism(creds.Mechanism) ||
+		(creds.Claims == nil && creds.Certificate == nil && !u.verify(creds)) {
+		return nil, fmt.Errorf("authentication failed for user: %s", creds.Username)
+	}
+
+	metadata := make(map[string]interface{}, len(u.Metadata)+5)
+	for k, v := range u.Metadata {
+		metadata[k] = v
+	}
+	metadata["auth_method"] = "password"
+	metadata["mechanism"] = creds.Mechanism
+	if u.Quota > 0 {
+		metadata[MetadataQuota] = u.Quota
+	}
+	if len(u.AllowedSenders) > 0 {
+		metadata[MetadataAllowedSenders] = u.AllowedSenders
+	}
+	if len(u.AllowedMechanisms) > 0 {
+		metadata[MetadataAllowedMechanisms] = u.AllowedMechanisms
+	}
+	return &User{
+		ID:       u.Username,
+		Username: u.Username,
+		Active:   u.Active == nil || *u.Active,
+		Metadata: metadata,
+	}, nil
+}
+
+// LookupSecret returns the cleartext password for username (implements SecretProvider).
+// Users with only a password hash have no secret to return.
+func (a *UserAuthenticator) LookupSecret(username string) (string, bool) {
+	u, ok := a.lookup(username)
+	if !ok || (u.Password == "" && u.PasswordHash != "") {
+		return "", false
+	}
+	return u.Password, true
+}
+
+// verify checks the secret in creds against the cleartext password, or against the
+// password hash for users without one.
+func (u *AuthUser) verify(creds *auth.Credentials) bool {
+	if u.Password == "" && u.PasswordHash != "" {
+		return creds.VerifyHash(u.hash)
+	}
+	return creds.Verify(u.Password)
+}
+
+// allowsMechanism reports whether the user may authenticate with mechanism.
+func (u *AuthUser) allowsMechanism(mechanism string) bool {
+	if len(u.AllowedMechanisms) == 0 {
+		return true
+	}
+	for _, m := range u.AllowedMechanisms {
+		if strings.EqualFold(m, mechanism) {
+			return true
+		}
+	}
+	return false
+}
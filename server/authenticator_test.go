@@ -0,0 +1,317 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"badsmtp/auth"
+)
+
+func TestUserAuthenticator(t *testing.T) {
+	a := NewUserAuthenticator([]AuthUser{{Username: "Alice@example.com", Password: "s3cret"}})
+
+	if _, err := a.Authenticate("alice@example.com", "s3cret"); err != nil {
+		t.Fatalf("expected correct password to succeed: %v", err)
+	}
+	if _, err := a.Authenticate("alice@example.com", "guess"); err == nil {
+		t.Fatal("expected wrong password to fail")
+	}
+	if _, err := a.Authenticate("goodauth@example.com", "s3cret"); err == nil {
+		t.Fatal("expected unknown user to fail")
+	}
+
+	const challenge = "<1.2@badsmtp.test>"
+	digest := strings.SplitN(auth.GenerateCramResponse("alice@example.com", "s3cret", challenge), " ", 2)[1]
+	user, err := a.AuthenticateCredentials(&auth.Credentials{
+		Mechanism: auth.AuthMechanismCramMD5,
+		Username:  "alice@example.com",
+		Challenge: challenge,
+		Response:  digest,
+	})
+	if err != nil {
+		t.Fatalf("expected CRAM-MD5 digest to verify: %v", err)
+	}
+	if user.Username != "Alice@example.com" || user.Metadata["mechanism"] != auth.AuthMechanismCramMD5 {
+		t.Fatalf("unexpected user %+v", user)
+	}
+}
+
+func TestSessionVerifiesPasswords(t *testing.T) {
+	cfg := &Config{
+		Port:         2525,
+		MessageStore: nopStore{},
+		AuthUsers:    []AuthUser{{Username: "alice@example.com", Password: "s3cret"}},
+	}
+	cfg.EnsureDefaults()
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	cmd := paramSession(t, cfg, "nopipelining.example.com")
+	if got := cmd("AUTH PLAIN " + b64("\x00alice@example.com\x00guess")); !strings.HasPrefix(got, "535") {
+		t.Fatalf("expected wrong PLAIN password to fail, got %q", got)
+	}
+	if got := cmd("AUTH PLAIN " + b64("\x00goodauth@example.com\x00s3cret")); !strings.HasPrefix(got, "535") {
+		t.Fatalf("expected unknown user to fail, got %q", got)
+	}
+
+	challengeLine := cmd("AUTH CRAM-MD5")
+	if !strings.HasPrefix(challengeLine, "334 ") {
+		t.Fatalf("expected CRAM-MD5 challenge, got %q", challengeLine)
+	}
+	challenge, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(challengeLine, "334 "))
+	if err != nil {
+		t.Fatalf("invalid challenge %q: %v", challengeLine, err)
+	}
+	if got := cmd(b64(auth.GenerateCramResponse("alice@example.com", "s3cret", string(challenge)))); !strings.HasPrefix(got, "235") {
+		t.Fatalf("expected CRAM-MD5 to succeed, got %q", got)
+	}
+}
+
+func TestSessionVerifiesScram(t *testing.T) {
+	cfg := &Config{
+		Port:         2525,
+		MessageStore: nopStore{},
+		AuthUsers:    []AuthUser{{Username: "alice@example.com", Password: "s3cret"}},
+	}
+	cfg.EnsureDefaults()
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	for _, test := range []struct {
+		password string
+		want     string
+	}{
+		{"s3cret", "235"},
+		{"guess", "535"},
+	} {
+		cmd := paramSession(t, cfg, "nopipelining-authscram.example.com")
+		clientFirstBare := "n=alice@example.com,r=clientnonce"
+		serverFirstLine := cmd("AUTH SCRAM-SHA-256 " + b64("n,,"+clientFirstBare))
+		if !strings.HasPrefix(serverFirstLine, "334 ") {
+			t.Fatalf("expected server-first-message, got %q", serverFirstLine)
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(serverFirstLine, "334 "))
+		serverFirst := string(decoded)
+		attrs := strings.Split(serverFirst, ",")
+		salt, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(attrs[1], "s="))
+
+		withoutProof := "c=" + b64("n,,") + "," + attrs[0]
+		authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+		proof := auth.ScramClientProof(auth.AuthMechanismScramSHA256, test.password, salt, auth.ScramIterations, authMessage)
+		got := cmd(b64(withoutProof + ",p=" + proof))
+		if strings.HasPrefix(got, "334 ") {
+			// Acknowledge the server-final-message; cmd("") would only read
+			got = cmd(" ")
+		}
+		if !strings.HasPrefix(got, test.want) {
+			t.Fatalf("password %q: expected %s, got %q", test.password, test.want, got)
+		}
+	}
+}
+
+func TestSessionValidatesBearerTokens(t *testing.T) {
+	cfg := &Config{
+		Port:            2525,
+		MessageStore:    nopStore{},
+		OAuthHMACSecret: "token-signing-secret",
+		OAuthScope:      "mail.send",
+	}
+	cfg.EnsureDefaults()
+	if err := cfg.loadTokenValidator(); err != nil {
+		t.Fatalf("loadTokenValidator() error = %v", err)
+	}
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	token := func(scope string) string {
+		signingInput := b64url(`{"alg":"HS256"}`) + "." + b64url(`{"email":"goodauth@example.com","scope":"`+scope+`"}`)
+		mac := hmac.New(sha256.New, []byte("token-signing-secret"))
+		mac.Write([]byte(signingInput))
+		return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	cmd := paramSession(t, cfg, "nopipelining-authoauth.example.com")
+	got := cmd("AUTH OAUTHBEARER " + b64("n,,\x01auth=Bearer "+token("openid")+"\x01\x01"))
+	if !strings.HasPrefix(got, "334 ") {
+		t.Fatalf("expected error challenge for insufficient scope, got %q", got)
+	}
+	if got := cmd("AQ=="); !strings.HasPrefix(got, "535") {
+		t.Fatalf("expected 535 after the dummy response, got %q", got)
+	}
+	if got := cmd("AUTH OAUTHBEARER " + b64("n,,\x01auth=Bearer "+token("mail.send")+"\x01\x01")); !strings.HasPrefix(got, "235") {
+		t.Fatalf("expected valid token to succeed, got %q", got)
+	}
+
+	// A valid token for one user does not log in as another
+	cmd = paramSession(t, cfg, "nopipelining-authoauth.example.com")
+	if got := cmd("AUTH OAUTHBEARER " + b64("n,a=bob@example.com,\x01auth=Bearer "+token("mail.send")+"\x01\x01")); !strings.HasPrefix(got, "334 ") {
+		t.Fatalf("expected error challenge for a token issued to another user, got %q", got)
+	}
+	if got := cmd("AQ=="); !strings.HasPrefix(got, "535") {
+		t.Fatalf("expected 535 after the dummy response, got %q", got)
+	}
+}
+
+func b64url(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func TestSessionSASLExchange(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	cmd := paramSession(t, cfg, "nopipelining.example.com")
+	if got := cmd("AUTH LOGIN"); !strings.HasPrefix(got, "334 ") {
+		t.Fatalf("expected username prompt, got %q", got)
+	}
+	if got := cmd("*"); !strings.HasPrefix(got, "501 5.7.0") {
+		t.Fatalf("expected 501 5.7.0 after cancelling, got %q", got)
+	}
+
+	// AUTH LOGIN with an initial response goes straight to the password prompt
+	if got := cmd("AUTH LOGIN " + b64("goodauth@example.com")); got != "334 "+b64("Password:") {
+		t.Fatalf("expected password prompt, got %q", got)
+	}
+	if got := cmd(b64("password")); !strings.HasPrefix(got, "235") {
+		t.Fatalf("expected LOGIN to succeed, got %q", got)
+	}
+
+	// A response written together with the AUTH command must not be lost
+	cmd = paramSession(t, cfg, "nopipelining.example.com")
+	if got := cmd("AUTH PLAIN\r\n" + b64("\x00goodauth@example.com\x00password")); !strings.HasPrefix(got, "334") {
+		t.Fatalf("expected empty challenge, got %q", got)
+	}
+	if got := cmd(""); !strings.HasPrefix(got, "235") {
+		t.Fatalf("expected pipelined PLAIN response to succeed, got %q", got)
+	}
+	if got := cmd("MAIL FROM:<goodauth@example.com>"); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected MAIL after AUTH to succeed, got %q", got)
+	}
+}
+
+func TestSessionAuthFailurePatterns(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	plain := func(username string) string { return "AUTH PLAIN " + b64("\x00"+username+"\x00password") }
+
+	for _, test := range []struct {
+		username string
+		want     string
+	}{
+		{"auth454@example.com", "454 4.7.0 Temporary authentication failure"},
+		{"auth534@example.com", "534 5.7.9 Authentication mechanism is too weak"},
+		{"auth538@example.com", "538 5.7.11 Encryption required for requested authentication mechanism"},
+		{"auth432@example.com", "432 4.7.12 A password transition is needed"},
+		{"auth535_5.7.0@example.com", "535 5.7.0 Authentication credentials invalid"},
+	} {
+		cmd := paramSession(t, cfg, "nopipelining.example.com")
+		if got := cmd(plain(test.username)); got != test.want {
+			t.Errorf("AUTH as %s: got %q, want %q", test.username, got, test.want)
+		}
+	}
+
+	cmd := paramSession(t, cfg, "nopipelining.example.com")
+	got := cmd(plain("authbadchallenge@example.com"))
+	if !strings.HasPrefix(got, "334 ") {
+		t.Fatalf("expected a malformed challenge, got %q", got)
+	}
+	if _, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(got, "334 ")); err == nil {
+		t.Fatalf("expected the challenge not to be base64, got %q", got)
+	}
+	if got := cmd("*"); !strings.HasPrefix(got, "501 5.7.0") {
+		t.Fatalf("expected cancelling the malformed challenge to give 501, got %q", got)
+	}
+
+	if got := cmd(plain("authextrachallenge@example.com")); !strings.HasPrefix(got, "334 ") {
+		t.Fatalf("expected an extra challenge, got %q", got)
+	}
+	if got := cmd(b64("anything")); !strings.HasPrefix(got, "235") {
+		t.Fatalf("expected success after the extra round, got %q", got)
+	}
+}
+
+func TestSessionAuthDropPattern(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	client, serverConn := connPair()
+	defer client.Close()
+	sess := NewSession(serverConn, cfg, nil)
+	go func() { _ = sess.Handle() }()
+
+	tp := textproto.NewConn(client)
+	if _, err := tp.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	_ = tp.PrintfLine("EHLO nopipelining.example.com")
+	if _, _, err := tp.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	_ = tp.PrintfLine("AUTH LOGIN")
+	for _, line := range []string{"authdrop@example.com", "password"} {
+		if _, err := tp.ReadLine(); err != nil {
+			t.Fatalf("expected a LOGIN prompt: %v", err)
+		}
+		_ = tp.PrintfLine("%s", base64.StdEncoding.EncodeToString([]byte(line)))
+	}
+	if reply, err := tp.ReadLine(); err == nil {
+		t.Fatalf("expected the connection to drop after the password, got %q", reply)
+	}
+}
+
+func TestSessionNTLM(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	b64 := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"goodauth", "235"},
+		{"badauth", "535"},
+		{"auth454@example.com", "454 4.7.0"},
+	}
+	for _, test := range tests {
+		t.Run(test.username, func(t *testing.T) {
+			cmd := paramSession(t, cfg, "nopipelining-authntlm.example.com")
+			if got := cmd("AUTH NTLM"); got != "334 NTLM supported" {
+				t.Fatalf("expected NTLM prompt, got %q", got)
+			}
+			if got := cmd(b64(auth.NTLMNegotiateMessage())); !strings.HasPrefix(got, "334 TlRMTVNTUA") {
+				t.Fatalf("expected Type 2 challenge, got %q", got)
+			}
+			if got := cmd(b64(auth.NTLMAuthenticateMessage("EXAMPLE", test.username, "WS"))); !strings.HasPrefix(got, test.want) {
+				t.Fatalf("expected %s, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestSessionChannelBindingAdvertised(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	client, serverConn := connPair()
+	t.Cleanup(func() { _ = client.Close() })
+	sess := NewSession(serverConn, cfg, nil)
+	sess.tlsState = &tls.ConnectionState{TLSUnique: []byte("finished")}
+
+	// A "y" flag is only a downgrade once -PLUS was advertised in the session
+	for _, test := range []struct {
+		parts []string
+		want  bool
+	}{
+		{nil, true},
+		{[]string{"authscram"}, true},
+		{[]string{"authplain"}, false},
+		{[]string{"noauth"}, false},
+	} {
+		var response []string
+		sess.addStandardCapabilities(&response, test.parts)
+		if got := sess.authHandlerOptions().ChannelBinding; got != test.want {
+			t.Errorf("EHLO %v: ChannelBinding = %v, want %v", test.parts, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"path"
+	"strings"
+	"sync"
+)
+
+// DefaultPolicyUsername is the AuthorizationPolicy username that applies to authenticated
+// users without a policy of their own.
+const DefaultPolicyUsername = "*"
+
+// AuthorizationPolicy describes what one authenticated user may do. It is loaded from the
+// authorization_policies configuration key.
+//
+// Address patterns are matched case-insensitively and support shell-style wildcards, e.g.
+// "alice@example.com", "*@example.com" or "*". An empty list allows any address.
+type AuthorizationPolicy struct {
+	Username          string   `mapstructure:"username"`           // Username the policy applies to ("*" for the default policy)
+	AllowedSenders    []string `mapstructure:"allowed_senders"`    // MAIL FROM patterns the user may use
+	AllowedRecipients []string `mapstructure:"allowed_recipients"` // RCPT TO patterns the user may send to
+	Quota             int64    `mapstructure:"quota"`              // Total bytes the user may send (0 or less = unlimited)
+}
+
+// PolicyAuthorizer is a config-driven Authorizer enforcing per-user sender and recipient
+// allowlists and a byte quota. Quota usage is tracked in memory for the life of the server.
+type PolicyAuthorizer struct {
+	policies map[string]AuthorizationPolicy
+
+	mu   sync.Mutex
+	used map[string]int64
+}
+
+// NewPolicyAuthorizer creates an authorizer from a list of per-user policies.
+func NewPolicyAuthorizer(policies []AuthorizationPolicy) *PolicyAuthorizer {
+	a := &PolicyAuthorizer{
+		policies: make(map[string]AuthorizationPolicy, len(policies)),
+		used:     make(map[string]int64),
+	}
+	for _, p := range policies {
+		a.policies[strings.ToLower(p.Username)] = p
+	}
+	return a
+}
+
+// policyFor returns the policy for user, falling back to the default policy. The allowed
+// senders and quota in the user's metadata (see UserAuthenticator) replace those of the
+// default policy.
+func (a *PolicyAuthorizer) policyFor(user *User) (AuthorizationPolicy, bool) {
+	if user == nil {
+		p, ok := a.policies[DefaultPolicyUsername]
+		return p, ok
+	}
+	if p, ok := a.policies[strings.ToLower(user.Username)]; ok {
+		return p, true
+	}
+	p, ok := a.policies[DefaultPolicyUsername]
+	if senders, isList := user.Metadata[MetadataAllowedSenders].([]string); isList && len(senders) > 0 {
+		p.AllowedSenders = senders
+		ok = true
+	}
+	if quota, isInt := user.Metadata[MetadataQuota].(int64); isInt && quota > 0 {
+		p.Quota = quota
+		ok = true
+	}
+	return p, ok
+}
+
+// CanSendFrom reports whether user may use from as the envelope sender.
+func (a *PolicyAuthorizer) CanSendFrom(user *User, from string) bool {
+	p, ok := a.policyFor(user)
+	if !ok {
+		return true
+	}
+	return matchAddressPatterns(p.AllowedSenders, from)
+}
+
+// CanSendTo reports whether user may send to the given recipient.
+func (a *PolicyAuthorizer) CanSendTo(user *User, to string) bool {
+	p, ok := a.policyFor(user)
+	if !ok {
+		return true
+	}
+	return matchAddressPatterns(p.AllowedRecipients, to)
+}
+
+// GetQuota returns the number of bytes user may still send, or -1 for unlimited.
+func (a *PolicyAuthorizer) GetQuota(user *User) int64 {
+	p, ok := a.policyFor(user)
+	if !ok || p.Quota <= 0 {
+		return -1
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	remaining := p.Quota - a.used[quotaKey(user)]
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// RecordUsage adds size bytes to the quota used by user (implements QuotaRecorder).
+func (a *PolicyAuthorizer) RecordUsage(user *User, size int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.used[quotaKey(user)] += size
+}
+
+func quotaKey(user *User) string {
+	if user == nil {
+		return ""
+	}
+	return strings.ToLower(user.Username)
+}
+
+// matchAddressPatterns reports whether addr matches any of the patterns. An empty pattern
+// list matches everything.
+func matchAddressPatterns(patterns []string, addr string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	addr = strings.ToLower(addr)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == addr {
+			return true
+		}
+		if ok, err := path.Match(pattern, addr); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestPolicyAuthorizer(t *testing.T) {
+	a := NewPolicyAuthorizer([]AuthorizationPolicy{
+		{
+			Username:          "alice",
+			AllowedSenders:    []string{"alice@example.com", "*@alice.example"},
+			AllowedRecipients: []string{"*@example.org"},
+			Quota:             100,
+		},
+		{Username: "*", AllowedSenders: []string{"*@default.example"}},
+	})
+	alice := &User{Username: "Alice"}
+	bob := &User{Username: "bob"}
+
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"alice exact sender", a.CanSendFrom(alice, "alice@example.com"), true},
+		{"alice wildcard sender", a.CanSendFrom(alice, "Anything@ALICE.example"), true},
+		{"alice foreign sender", a.CanSendFrom(alice, "bob@example.com"), false},
+		{"alice allowed recipient", a.CanSendTo(alice, "x@example.org"), true},
+		{"alice foreign recipient", a.CanSendTo(alice, "x@example.net"), false},
+		{"bob falls back to default policy", a.CanSendFrom(bob, "bob@default.example"), true},
+		{"bob default policy rejects", a.CanSendFrom(bob, "bob@example.com"), false},
+		{"bob default policy has no recipient list", a.CanSendTo(bob, "anyone@example.net"), true},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	if q := a.GetQuota(alice); q != 100 {
+		t.Fatalf("expected quota 100, got %d", q)
+	}
+	a.RecordUsage(alice, 60)
+	if q := a.GetQuota(alice); q != 40 {
+		t.Fatalf("expected remaining quota 40, got %d", q)
+	}
+	a.RecordUsage(alice, 60)
+	if q := a.GetQuota(alice); q != 0 {
+		t.Fatalf("expected exhausted quota 0, got %d", q)
+	}
+	if q := a.GetQuota(bob); q != -1 {
+		t.Fatalf("expected unlimited quota for bob, got %d", q)
+	}
+}
+
+func TestSessionEnforcesAuthorizer(t *testing.T) {
+	cfg := &Config{
+		Port:         2525,
+		MessageStore: nopStore{},
+		AuthorizationPolicies: []AuthorizationPolicy{{
+			Username:          "alice",
+			AllowedSenders:    []string{"alice@example.com"},
+			AllowedRecipients: []string{"*@example.org"},
+			Quota:             40,
+		}},
+	}
+	cfg.EnsureDefaults()
+
+	client, serverConn := connPair()
+	sess := NewSession(serverConn, cfg, nil)
+	go func() { _ = sess.Handle() }()
+	defer client.Close()
+
+	tp := textproto.NewConn(client)
+	cmd := func(line string) string {
+		t.Helper()
+		if line != "" {
+			if err := tp.PrintfLine("%s", line); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+		}
+		for {
+			reply, err := tp.ReadLine()
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			if len(reply) < 4 || reply[3] != '-' {
+				return reply
+			}
+		}
+	}
+
+	cmd("")
+	cmd("EHLO nopipelining.example.com")
+
+	// Unauthenticated sessions are not subject to the authorizer
+	if got := cmd("MAIL FROM:<someone@example.com>"); !strings.HasPrefix(got, "250") {
+		t.Fatalf("unauthenticated MAIL FROM should be accepted, got %q", got)
+	}
+	cmd("RSET")
+
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret"))
+	if got := cmd("AUTH PLAIN " + creds); !strings.HasPrefix(got, "235") {
+		t.Fatalf("AUTH failed: %q", got)
+	}
+
+	if got := cmd("MAIL FROM:<mallory@example.com>"); !strings.HasPrefix(got, "550 5.7.1") {
+		t.Fatalf("expected 550 5.7.1 for unauthorised sender, got %q", got)
+	}
+	if got := cmd("MAIL FROM:<alice@example.com>"); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected authorised sender to be accepted, got %q", got)
+	}
+	if got := cmd("RCPT TO:<bob@example.net>"); !strings.HasPrefix(got, "550 5.7.1") {
+		t.Fatalf("expected 550 5.7.1 for unauthorised recipient, got %q", got)
+	}
+	if got := cmd("RCPT TO:<bob@example.org>"); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected authorised recipient to be accepted, got %q", got)
+	}
+
+	cmd("DATA")
+	if got := cmd("Subject: quota\r\n\r\nThis body is longer than forty bytes in total.\r\n."); !strings.HasPrefix(got, "552 5.2.2") {
+		t.Fatalf("expected 552 5.2.2 for message over quota, got %q", got)
+	}
+
+	// The transaction is aborted; a small message still fits
+	cmd("MAIL FROM:<alice@example.com>")
+	cmd("RCPT TO:<bob@example.org>")
+	cmd("DATA")
+	if got := cmd("Subject: ok\r\n\r\nhi\r\n."); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected small message to be accepted, got %q", got)
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CACertFileName and CAKeyFileName are the names of the local CA's certificate and
+	// private key inside the tls_ca_dir.
+	CACertFileName = "ca.pem"
+	CAKeyFileName  = "ca-key.pem"
+
+	// caValidity is how long a newly created CA certificate is valid for.
+	caValidity = 10 * 365 * 24 * time.Hour
+
+	// leafCacheSize is the number of leaf certificates kept by a CertificateAuthority.
+	leafCacheSize = 256
+
+	// leafRenewBefore is how long before it expires a cached leaf certificate is replaced.
+	leafRenewBefore = CertValidityHours * time.Hour / 4
+)
+
+// CertificateAuthority is the local CA that signs the certificates BadSMTP serves, so
+// clients can verify them after trusting its certificate (see CertPEM). Leaf certificates
+// are issued per hostname and cached.
+type CertificateAuthority struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	leaves  *leafCache
+}
+
+// DefaultTLSCADir returns the directory the badsmtp command keeps its CA in by default,
+// ~/.badsmtp/ca.
+func DefaultTLSCADir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".badsmtp", "ca")
+	}
+	return filepath.Join(home, ".badsmtp", "ca")
+}
+
+// LoadOrCreateCA loads the CA from the CACertFileName and CAKeyFileName files in dir,
+// creating the directory and a new CA first if neither file exists.
+func LoadOrCreateCA(dir string) (*CertificateAuthority, error) {
+	certPath := filepath.Join(dir, CACertFileName)
+	keyPath := filepath.Join(dir, CAKeyFileName)
+
+	certPEM, certErr := os.ReadFile(certPath) //nolint:gosec // path comes from the operator's configuration
+	keyPEM, keyErr := os.ReadFile(keyPath)    //nolint:gosec // path comes from the operator's configuration
+	switch {
+	case errors.Is(certErr, fs.ErrNotExist) && errors.Is(keyErr, fs.ErrNotExist):
+		return createCA(dir)
+	case certErr != nil:
+		return nil, certErr
+	case keyErr != nil:
+		return nil, keyErr
+	}
+	return parseCA(certPEM, keyPEM)
+}
+
+// NewCertificateAuthority creates a CA that only lasts as long as the process.
+func NewCertificateAuthority() (*CertificateAuthority, error) {
+	certPEM, keyPEM, err := generateCA()
+	if err != nil {
+		return nil, err
+	}
+	return parseCA(certPEM, keyPEM)
+}
+
+func createCA(dir string) (*CertificateAuthority, error) {
+	certPEM, keyPEM, err := generateCA()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, CAKeyFileName), keyPEM, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, CACertFileName), certPEM, 0o644); err != nil { //nolint:gosec // the CA certificate is public
+		return nil, err
+	}
+	return parseCA(certPEM, keyPEM)
+}
+
+// generateCA returns the PEM encoded certificate and PKCS #8 key of a new CA.
+func generateCA() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %v", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			//nolint:misspell // 'Organization' is the stdlib field name
+			Organization: []string{"BadSMTP Test Server"},
+			CommonName:   "BadSMTP Local CA",
+		},
+		NotBefore:             now,
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal CA key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+func parseCA(certPEM, keyPEM []byte) (*CertificateAuthority, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA certificate or key: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA certificate: %v", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate %q is not a CA", cert.Subject.CommonName)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("CA certificate expired on %s; remove it to create a new CA", cert.NotAfter.Format(time.DateOnly))
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", pair.PrivateKey)
+	}
+	return &CertificateAuthority{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		leaves:  newLeafCache(leafCacheSize),
+	}, nil
+}
+
+// CertPEM returns the PEM encoded CA certificate, for adding to clients' trust stores.
+func (ca *CertificateAuthority) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Certificate returns a certificate for hostname signed by the CA. Certificates are
+// cached, and replaced shortly before they expire.
+func (ca *CertificateAuthority) Certificate(hostname string) (tls.Certificate, error) {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if cert, ok := ca.leaves.get(hostname, time.Now().Add(leafRenewBefore)); ok {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate private key: %v", err)
+	}
+	now := time.Now()
+	cert, err := ca.sign(certificateTemplate(hostname, now, now.Add(CertValidityHours*time.Hour)), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	ca.leaves.add(hostname, cert)
+	return cert, nil
+}
+
+// sign issues a certificate from template for key.
+func (ca *CertificateAuthority) sign(template *x509.Certificate, key crypto.Signer) (tls.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.SerialNumber = serial
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// publicKey returns the CA's public key, or nil without a CA.
+func (ca *CertificateAuthority) publicKey() crypto.PublicKey {
+	if ca == nil {
+		return nil
+	}
+	return ca.key.Public()
+}
+
+// randomSerial returns a random 128-bit certificate serial number, so certificates from
+// the same CA never share one.
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	return serial, nil
+}
+
+// loadCA loads or creates the CA in TLSCADir, or creates one for this process only
+// when TLSCADir is empty. A CA set by the caller is kept.
+func (c *Config) loadCA() error {
+	if c.CA != nil {
+		return nil
+	}
+	var err error
+	if c.TLSCADir == "" {
+		c.CA, err = NewCertificateAuthority()
+	} else {
+		c.CA, err = LoadOrCreateCA(c.TLSCADir)
+	}
+	return err
+}
+
+// issueCertificate returns a certificate for hostname signed by the CA, or a self-signed
+// one when no CA has been loaded.
+func (c *Config) issueCertificate(hostname string) (tls.Certificate, error) {
+	if c.CA == nil {
+		return c.GenerateSelfSignedCert(hostname)
+	}
+	return c.CA.Certificate(hostname)
+}
+
+// leafCache is a least recently used cache of leaf certificates by hostname.
+type leafCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Most recently used first
+	entries map[string]*list.Element
+}
+
+type leafEntry struct {
+	hostname string
+	cert     tls.Certificate
+}
+
+func newLeafCache(size int) *leafCache {
+	return &leafCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the cached certificate for hostname if it is still valid at validAt.
+func (c *leafCache) get(hostname string, validAt time.Time) (tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[hostname]
+	if !ok {
+		return tls.Certificate{}, false
+	}
+	entry := elem.Value.(*leafEntry)
+	if validAt.After(entry.cert.Leaf.NotAfter) {
+		c.order.Remove(elem)
+		delete(c.entries, hostname)
+		return tls.Certificate{}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.cert, true
+}
+
+// add caches cert for hostname, evicting the least recently used certificate when full.
+func (c *leafCache) add(hostname string, cert tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[hostname]; ok {
+		elem.Value.(*leafEntry).cert = cert
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[hostname] = c.order.PushFront(&leafEntry{hostname: hostname, cert: cert})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*leafEntry).hostname)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+	ca, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatalf("LoadOrCreateCA failed: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, CAKeyFileName))
+	if err != nil {
+		t.Fatalf("expected the CA key to be written: %v", err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		t.Errorf("expected a private CA key, got mode %v", info.Mode())
+	}
+
+	reloaded, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatalf("reloading the CA failed: %v", err)
+	}
+	if !bytes.Equal(ca.CertPEM(), reloaded.CertPEM()) {
+		t.Error("expected the CA to be loaded rather than created again")
+	}
+
+	if err := os.Remove(filepath.Join(dir, CAKeyFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreateCA(dir); err == nil {
+		t.Error("expected a CA certificate without its key to fail")
+	}
+}
+
+func TestCertificateAuthorityLeaves(t *testing.T) {
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertPEM())
+
+	cert, err := ca.Certificate("Mail.Example.com.")
+	if err != nil {
+		t.Fatalf("Certificate failed: %v", err)
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "mail.example.com"}); err != nil {
+		t.Errorf("expected the leaf to verify against the CA: %v", err)
+	}
+	again, err := ca.Certificate("mail.example.com")
+	if err != nil || !bytes.Equal(again.Certificate[0], cert.Certificate[0]) {
+		t.Error("expected the leaf certificate to be cached")
+	}
+
+	cache := newLeafCache(2)
+	for _, name := range []string{"a", "b", "a", "c"} {
+		c, _ := ca.Certificate(name)
+		cache.add(name, c)
+	}
+	validAt := time.Now()
+	if _, ok := cache.get("b", validAt); ok {
+		t.Error("expected the least recently used leaf to be evicted")
+	}
+	if _, ok := cache.get("a", validAt); !ok {
+		t.Error("expected a recently used leaf to be kept")
+	}
+	if _, ok := cache.get("c", validAt.Add(CertValidityHours*time.Hour)); ok {
+		t.Error("expected an expiring leaf to be dropped")
+	}
+}
+
+func TestSessionVerifiedSTARTTLS(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	if err := cfg.loadCA(); err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(cfg.CA.CertPEM())
+
+	client, serverConn := connPair()
+	t.Cleanup(func() { _ = client.Close() })
+	go func() { _ = NewSession(serverConn, cfg, nil).Handle() }()
+
+	tp := textproto.NewConn(client)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"EHLO nopipelining.example.com", "STARTTLS"} {
+		if err := tp.PrintfLine("%s", line); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := tp.ReadResponse(0); err != nil {
+			t.Fatalf("%s failed: %v", line, err)
+		}
+	}
+	tlsConn := tls.Client(client, &tls.Config{RootCAs: roots, ServerName: "nopipelining.example.com", MinVersion: tls.VersionTLS12})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("expected a verified handshake with the CA as root: %v", err)
+	}
+}
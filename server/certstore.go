@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+
+	"badsmtp/logging"
+)
+
+// TLSCertificatePair is a certificate file and its private key file, both PEM encoded.
+// The certificate file may hold intermediate certificates after the leaf.
+type TLSCertificatePair struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+}
+
+// CertificateStore holds the certificates loaded from the configured files and picks the
+// one to serve for a hostname. The certificates can be reloaded at any time with Reload,
+// e.g. when the files change.
+type CertificateStore struct {
+	pairs []TLSCertificatePair
+
+	mu    sync.RWMutex
+	certs []tls.Certificate
+}
+
+// NewCertificateStore loads the certificates in pairs.
+func NewCertificateStore(pairs []TLSCertificatePair) (*CertificateStore, error) {
+	certs, err := loadCertificatePairs(pairs)
+	if err != nil {
+		return nil, err
+	}
+	return &CertificateStore{pairs: pairs, certs: certs}, nil
+}
+
+// Reload loads the certificates again. On error, such as a certificate that no longer
+// matches its key, the current certificates are kept.
+func (s *CertificateStore) Reload() error {
+	certs, err := loadCertificatePairs(s.pairs)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.certs = certs
+	s.mu.Unlock()
+	return nil
+}
+
+// Files returns the paths of the certificate and key files.
+func (s *CertificateStore) Files() []string {
+	files := make([]string, 0, 2*len(s.pairs))
+	for _, p := range s.pairs {
+		files = append(files, p.CertFile, p.KeyFile)
+	}
+	return files
+}
+
+// Certificate returns the first certificate whose subject alternative names match
+// hostname, or the first certificate when none does.
+func (s *CertificateStore) Certificate(hostname string) tls.Certificate {
+	hostname = strings.TrimSuffix(hostname, ".")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, cert := range s.certs {
+		if cert.Leaf.VerifyHostname(hostname) == nil {
+			return cert
+		}
+	}
+	return s.certs[0]
+}
+
+func loadCertificatePairs(pairs []TLSCertificatePair) ([]tls.Certificate, error) {
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no certificate files")
+	}
+	certs := make([]tls.Certificate, 0, len(pairs))
+	for _, p := range pairs {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.CertFile, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// certificatePairs returns the configured certificate files: TLSCertFile and TLSKeyFile
+// first, then TLSCertificates.
+func (c *Config) certificatePairs() []TLSCertificatePair {
+	var pairs []TLSCertificatePair
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" {
+		pairs = append(pairs, TLSCertificatePair{CertFile: c.TLSCertFile, KeyFile: c.TLSKeyFile})
+	}
+	return append(pairs, c.TLSCertificates...)
+}
+
+// loadCertificates loads the configured certificate files into Certificates. A store set
+// by the caller is kept.
+func (c *Config) loadCertificates() error {
+	pairs := c.certificatePairs()
+	if c.Certificates != nil || len(pairs) == 0 {
+		return nil
+	}
+	store, err := NewCertificateStore(pairs)
+	if err != nil {
+		return err
+	}
+	c.Certificates = store
+	return nil
+}
+
+// serverCertificate returns the certificate to serve for hostname: one of the configured
+// certificates, or one issued by the local CA without any.
+func (c *Config) serverCertificate(hostname string) (tls.Certificate, error) {
+	if c.Certificates != nil {
+		return c.Certificates.Certificate(hostname), nil
+	}
+	return c.issueCertificate(hostname)
+}
+
+// watchCertificates reloads the configured certificates whenever one of their files
+// changes. Certificates that fail to load are logged and the previous ones are kept.
+func (s *Server) watchCertificates() {
+	store := s.config.Certificates
+	if store == nil {
+		return
+	}
+	watched := make(map[string]bool)
+	for _, path := range store.Files() {
+		if watched[path] {
+			continue
+		}
+		watched[path] = true
+		stop, err := watchFile(path, func() {
+			if err := store.Reload(); err != nil {
+				s.logger.Warn("Failed to reload TLS certificates; keeping the previous certificates",
+					logging.F("path", path), logging.F("err", err))
+				return
+			}
+			s.logger.Info("Reloaded TLS certificates", logging.F("path", path))
+		})
+		if err != nil {
+			s.logger.Warn("Cannot watch TLS certificate file for changes", logging.F("path", path), logging.F("err", err))
+			continue
+		}
+		s.stopWatchers = append(s.stopWatchers, stop)
+	}
+}
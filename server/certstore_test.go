@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificatePair writes a certificate for hostname, issued by ca, and its key to dir.
+func writeCertificatePair(t *testing.T, ca *CertificateAuthority, dir, name, hostname string) TLSCertificatePair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.sign(certificateTemplate(hostname, time.Now(), time.Now().Add(time.Hour)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := TLSCertificatePair{CertFile: filepath.Join(dir, name+".pem"), KeyFile: filepath.Join(dir, name+"-key.pem")}
+	if err := os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func TestCertificateStore(t *testing.T) {
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	first := writeCertificatePair(t, ca, dir, "first", "mail.example.com")
+	second := writeCertificatePair(t, ca, dir, "second", "*.example.org")
+
+	store, err := NewCertificateStore([]TLSCertificatePair{first, second})
+	if err != nil {
+		t.Fatalf("NewCertificateStore failed: %v", err)
+	}
+	for hostname, want := range map[string]string{
+		"mail.example.com":  "mail.example.com",
+		"smtp.example.org.": "*.example.org",
+		"other.example.net": "mail.example.com",
+	} {
+		if got := store.Certificate(hostname).Leaf.DNSNames[0]; got != want {
+			t.Errorf("Certificate(%q) = %s, want %s", hostname, got, want)
+		}
+	}
+
+	// A key that no longer matches its certificate keeps the current certificates
+	writeCertificatePair(t, ca, dir, "other", "other.example.net")
+	key, err := os.ReadFile(filepath.Join(dir, "other-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second.KeyFile, key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Error("expected a mismatched key to fail the reload")
+	}
+	if got := store.Certificate("smtp.example.org").Leaf.DNSNames[0]; got != "*.example.org" {
+		t.Errorf("expected the previous certificates to be kept, got %s", got)
+	}
+
+	if _, err := NewCertificateStore([]TLSCertificatePair{{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: first.KeyFile}}); err == nil {
+		t.Error("expected a missing certificate file to fail")
+	}
+}
+
+func TestServerReloadsCertificates(t *testing.T) {
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	pair := writeCertificatePair(t, ca, dir, "cert", "mail.example.com")
+	cfg := &Config{Port: 2525, TLSCertFile: pair.CertFile, TLSKeyFile: pair.KeyFile}
+	cfg.EnsureDefaults()
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	srv.watchCertificates()
+	t.Cleanup(func() {
+		for _, stop := range srv.stopWatchers {
+			stop()
+		}
+	})
+
+	before, err := srv.certificate("mail.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotate the certificate: the new files are served without a restart
+	writeCertificatePair(t, ca, dir, "cert", "mail.example.com")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		after, err := srv.certificate("mail.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(after.Certificate[0], before.Certificate[0]) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("certificate files were not reloaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSessionSTARTTLSCertificateBySNI(t *testing.T) {
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}, TLSCertificates: []TLSCertificatePair{
+		writeCertificatePair(t, ca, dir, "first", "first.example.com"),
+		writeCertificatePair(t, ca, dir, "second", "second.example.com"),
+	}}
+	cfg.EnsureDefaults()
+	if err := cfg.loadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, serverConn := connPair()
+	t.Cleanup(func() { _ = client.Close() })
+	go func() { _ = NewSession(serverConn, cfg, nil).Handle() }()
+	tp := textproto.NewConn(client)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"EHLO nopipelining.example.com", "STARTTLS"} {
+		if err := tp.PrintfLine("%s", line); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := tp.ReadResponse(0); err != nil {
+			t.Fatalf("%s failed: %v", line, err)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertPEM())
+	tlsConn := tls.Client(client, &tls.Config{RootCAs: roots, ServerName: "second.example.com", MinVersion: tls.VersionTLS12})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("expected the certificate for the SNI name: %v", err)
+	}
+}
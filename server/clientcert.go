@@ -0,0 +1,56 @@
+package server
+
+import (
+	"crypto/x509"
+
+	"badsmtp/smtp"
+)
+
+// peerCertificate returns the client certificate verified during the TLS handshake, or
+// nil when the client presented none or the session is not using TLS. Unverified
+// certificates are never returned.
+func (s *Session) peerCertificate() *x509.Certificate {
+	if s.tlsState == nil || len(s.tlsState.VerifiedChains) == 0 || len(s.tlsState.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return s.tlsState.VerifiedChains[0][0]
+}
+
+// clientCertInfo returns the subject and subject alternative names of the verified
+// client certificate, or ("", nil) without one.
+func (s *Session) clientCertInfo() (subject string, sans []string) {
+	cert := s.peerCertificate()
+	if cert == nil {
+		return "", nil
+	}
+	return cert.Subject.String(), certificateSANs(cert)
+}
+
+// clientCertError returns the simulated error selected by the common name of the client
+// certificate (e.g. cert550.relay.example.com), or nil.
+func (s *Session) clientCertError() *smtp.ErrorResult {
+	cert := s.peerCertificate()
+	if cert == nil {
+		return nil
+	}
+	return s.checkSimulatedError(cert.Subject.CommonName, ErrorCommandCert)
+}
+
+// certificateSANs lists the subject alternative names of cert with OpenSSL-style type
+// prefixes: DNS:, email:, IP: and URI:.
+func certificateSANs(cert *x509.Certificate) []string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	return sans
+}
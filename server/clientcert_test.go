@@ -0,0 +1,205 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority that issues client certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "BadSMTP Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a client certificate for commonName with an email address SAN.
+func (ca *testCA) issue(t *testing.T, commonName, email string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: commonName, Organization: []string{"Example"}},
+		EmailAddresses: []string{email},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsSession greets, upgrades the connection with STARTTLS presenting clientCerts and
+// returns a command function over TLS. The client must send EHLO again.
+func tlsSession(t *testing.T, cfg *Config, clientCerts []tls.Certificate) func(string) string {
+	t.Helper()
+	client, serverConn := connPair()
+	t.Cleanup(func() { _ = client.Close() })
+	sess := NewSession(serverConn, cfg, nil)
+	go func() { _ = sess.Handle() }()
+
+	var tp *textproto.Conn
+	cmd := func(line string) string {
+		t.Helper()
+		if line != "" {
+			if err := tp.PrintfLine("%s", line); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+		}
+		for {
+			reply, err := tp.ReadLine()
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			if len(reply) < 4 || reply[3] != '-' {
+				return reply
+			}
+		}
+	}
+
+	tp = textproto.NewConn(client)
+	cmd("")
+	cmd("EHLO nopipelining.example.com")
+	if got := cmd("STARTTLS"); !strings.HasPrefix(got, "220") {
+		t.Fatalf("expected STARTTLS to be accepted, got %q", got)
+	}
+	tlsConn := tls.Client(client, &tls.Config{InsecureSkipVerify: true, Certificates: clientCerts}) //nolint:gosec // self-signed test server
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	tp = textproto.NewConn(tlsConn)
+	return cmd
+}
+
+func TestSessionClientCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	store := &captureStore{}
+	cfg := &Config{Port: 2525, MessageStore: store, TLSClientAuth: TLSClientAuthRequest, ClientCAs: ca.pool}
+	cfg.EnsureDefaults()
+
+	cmd := tlsSession(t, cfg, []tls.Certificate{ca.issue(t, "relay.example.com", "relay@example.com")})
+	if got := cmd("EHLO nopipelining.example.com"); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected EHLO over TLS to succeed, got %q", got)
+	}
+	if got := cmd("AUTH EXTERNAL ="); !strings.HasPrefix(got, "235") {
+		t.Fatalf("expected AUTH EXTERNAL to succeed, got %q", got)
+	}
+	cmd("MAIL FROM:<relay@example.com>")
+	cmd("RCPT TO:<user@example.com>")
+	cmd("DATA")
+	if got := cmd("Subject: hi\r\n\r\nbody\r\n."); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected message to be accepted, got %q", got)
+	}
+
+	if len(store.messages) != 1 {
+		t.Fatalf("expected 1 stored message, got %d", len(store.messages))
+	}
+	msg := store.messages[0]
+	if msg.ClientCertSubject != "CN=relay.example.com,O=Example" {
+		t.Errorf("ClientCertSubject = %q", msg.ClientCertSubject)
+	}
+	if len(msg.ClientCertSANs) != 1 || msg.ClientCertSANs[0] != "email:relay@example.com" {
+		t.Errorf("ClientCertSANs = %v", msg.ClientCertSANs)
+	}
+}
+
+func TestSessionExternalRequiresCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}, TLSClientAuth: TLSClientAuthRequest, ClientCAs: ca.pool}
+	cfg.EnsureDefaults()
+
+	cmd := tlsSession(t, cfg, nil)
+	cmd("EHLO nopipelining.example.com")
+	if got := cmd("AUTH EXTERNAL ="); !strings.HasPrefix(got, "504") {
+		t.Fatalf("expected EXTERNAL to be unavailable without a certificate, got %q", got)
+	}
+}
+
+func TestSessionClientCertificatePatterns(t *testing.T) {
+	ca := newTestCA(t)
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}, TLSClientAuth: TLSClientAuthRequest, ClientCAs: ca.pool}
+	cfg.EnsureDefaults()
+
+	cmd := tlsSession(t, cfg, []tls.Certificate{ca.issue(t, "cert550_5.7.1.relay.example.com", "relay@example.com")})
+	cmd("EHLO nopipelining.example.com")
+	if got := cmd("MAIL FROM:<relay@example.com>"); !strings.HasPrefix(got, "550 5.7.1") {
+		t.Fatalf("expected MAIL to fail for the certificate pattern, got %q", got)
+	}
+	if got := cmd("AUTH EXTERNAL ="); !strings.HasPrefix(got, "550 5.7.1") {
+		t.Fatalf("expected AUTH EXTERNAL to fail for the certificate pattern, got %q", got)
+	}
+}
+
+func TestLoadClientCAs(t *testing.T) {
+	ca := newTestCA(t)
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{TLSClientAuth: TLSClientAuthRequire, TLSClientCAFile: path}
+	if err := cfg.loadClientCAs(); err != nil || cfg.ClientCAs == nil {
+		t.Fatalf("loadClientCAs() = %v", err)
+	}
+	tlsConfig := &tls.Config{}
+	cfg.applyClientAuth(tlsConfig)
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert || tlsConfig.ClientCAs != cfg.ClientCAs {
+		t.Errorf("unexpected client auth settings %v", tlsConfig.ClientAuth)
+	}
+
+	for _, bad := range []*Config{
+		{TLSClientAuth: "sometimes", TLSClientCAFile: path},
+		{TLSClientAuth: TLSClientAuthRequest},
+		{TLSClientAuth: TLSClientAuthRequest, TLSClientCAFile: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if err := bad.loadClientCAs(); err == nil {
+			t.Errorf("expected an error for %+v", bad)
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"strings"
 	"time"
 
+	"badsmtp/auth"
 	"badsmtp/logging"
 )
 
@@ -28,6 +29,8 @@ const (
 	DefaultGreetingDelayStart = 25200
 	// DefaultDropDelayStart is the first port number in the range used to trigger delayed drops.
 	DefaultDropDelayStart = 25600
+	// DefaultTLSBehaviourStart is the first port number in the range used to serve misbehaving TLS.
+	DefaultTLSBehaviourStart = 25800
 	// DefaultTLSPort is the port number to listen for implicit TLS connections (SMTPS).
 	DefaultTLSPort = 25465
 	// DefaultSTARTTLSPort is the port number to listen for STARTTLS connections (SMTP+STARTTLS).
@@ -36,6 +39,13 @@ const (
 	// DefaultTLSHostname is the default hostname used for generated self-signed certificates.
 	DefaultTLSHostname = "badsmtp.test"
 
+	// TLSClientAuthNone, TLSClientAuthRequest and TLSClientAuthRequire are the tls_client_auth
+	// modes: never ask for a client certificate, verify one if the client sends it, or
+	// refuse the handshake without a valid one.
+	TLSClientAuthNone    = "none"
+	TLSClientAuthRequest = "request"
+	TLSClientAuthRequire = "require"
+
 	// CertValidityHours is the number of hours that a generated certificate is valid for.
 	CertValidityHours = 24
 
@@ -193,6 +203,7 @@ type Config struct {
 	// Port range configurations
 	GreetingDelayPortStart int `mapstructure:"greeting_delay_port_start"`
 	DropDelayPortStart     int `mapstructure:"drop_delay_port_start"`
+	TLSBehaviourPortStart  int `mapstructure:"tls_behaviour_port_start"`
 
 	// TLS configuration
 	TLSCertFile  string `mapstructure:"tls_cert_file"`
@@ -200,6 +211,39 @@ type Config struct {
 	TLSPort      int    `mapstructure:"tls_port"`      // Port for implicit TLS (default 25465)
 	STARTTLSPort int    `mapstructure:"starttls_port"` // Port for STARTTLS (default 25587)
 	TLSHostname  string `mapstructure:"tls_hostname"`  // Hostname for TLS certificate (default: "badsmtp.test")
+	TLSBehaviour string `mapstructure:"-"`             // Implicit TLS misbehaviour, one of TLSBehaviours (set per port by AnalysePortBehaviour)
+
+	// More certificates, chosen by SNI or EHLO name; the files are reloaded when they change
+	TLSCertificates []TLSCertificatePair `mapstructure:"tls_certificates"`
+	Certificates    *CertificateStore    `mapstructure:"-"` // Loaded from TLSCertFile/TLSKeyFile and TLSCertificates by loadCertificates
+
+	// TLS protocol settings; ImplicitTLS and STARTTLS override them for one kind of listener
+	TLS               TLSSettings `mapstructure:"tls"`
+	ImplicitTLS       TLSSettings `mapstructure:"implicit_tls"`
+	STARTTLS          TLSSettings `mapstructure:"starttls"`
+	ImplicitTLSConfig *tls.Config `mapstructure:"-"` // Built from TLS and ImplicitTLS by loadTLSSettings
+	STARTTLSConfig    *tls.Config `mapstructure:"-"` // Built from TLS and STARTTLS by loadTLSSettings
+
+	// TLS secrets for decrypting captured traffic (debugging only)
+	TLSKeyLogFile string  `mapstructure:"tls_key_log_file"` // NSS key log file to append to (default: $SSLKEYLOGFILE, empty = disabled)
+	KeyLog        *KeyLog `mapstructure:"-"`                // Opened from TLSKeyLogFile by loadKeyLog
+
+	// Local CA that signs the generated certificates
+	TLSCADir string                `mapstructure:"tls_ca_dir"` // Directory holding the CA certificate and key, created on first use (empty = a CA per process)
+	CA       *CertificateAuthority `mapstructure:"-"`          // Loaded from TLSCADir by loadCA
+
+	// TLS client certificates (mutual TLS)
+	TLSClientCAFile string         `mapstructure:"tls_client_ca_file"` // PEM bundle of the CAs that issue client certificates
+	TLSClientAuth   string         `mapstructure:"tls_client_auth"`    // none (default), request or require
+	ClientCAs       *x509.CertPool `mapstructure:"-"`                  // Loaded from TLSClientCAFile by loadClientCAs
+
+	// LMTP (RFC 2033) delivery
+	LMTPPort int  `mapstructure:"lmtp_port"` // Port for LMTP connections (0 = disabled)
+	LMTP     bool `mapstructure:"-"`         // Speak LMTP instead of SMTP (set per port by AnalysePortBehaviour)
+
+	// Message submission (RFC 6409)
+	SubmissionPort int  `mapstructure:"submission_port"` // Port for submission (MSA) connections (0 = disabled)
+	Submission     bool `mapstructure:"-"`               // Require TLS before AUTH and AUTH before MAIL (set per port by AnalysePortBehaviour)
 
 	// Hostname-based mailbox routing
 	EnableHostnameRouting bool              `mapstructure:"enable_hostname_routing"` // Enable hostname-based routing
@@ -207,15 +251,50 @@ type Config struct {
 	// hostname -> mailbox directory mapping (for static config)
 	DefaultMailboxDir string `mapstructure:"default_mailbox_dir"` // fallback directory for unmapped hostnames
 
+	// Store messages from sessions with a tok<id> EHLO label in a sub-mailbox per token
+	TokenMailboxes bool `mapstructure:"token_mailboxes"`
+
+	// Built-in rate limiter (used when no custom RateLimiter is installed)
+	RateLimitMode                 string `mapstructure:"rate_limit_mode"`                   // "window" (default), "token_bucket" or "none"
+	RateLimitConnectionsPerMinute int    `mapstructure:"rate_limit_connections_per_minute"` // Per-IP connections per minute (default 60)
+	RateLimitMessagesPerMinute    int    `mapstructure:"rate_limit_messages_per_minute"`    // Per-IP messages per minute (default 120)
+	RateLimitConnectionBurst      int    `mapstructure:"rate_limit_connection_burst"`       // Token bucket capacity for connections
+	RateLimitMessageBurst         int    `mapstructure:"rate_limit_message_burst"`          // Token bucket capacity for messages
+	RateLimitMaxConcurrent        int    `mapstructure:"rate_limit_max_concurrent"`         // Simultaneous connections per IP (0 = unlimited)
+
+	// Accounts whose passwords are verified during AUTH (used when no custom Authenticator
+	// is installed; without any, the goodauth/badauth username patterns apply)
+	AuthUsers     []AuthUser `mapstructure:"auth_users"`
+	AuthUsersFile string     `mapstructure:"auth_users_file"` // YAML, JSON or htpasswd file with more users, reloaded on change
+
+	// Bearer token validation for XOAUTH2 and OAUTHBEARER (without either source, any
+	// token is accepted)
+	OAuthJWKSFile   string `mapstructure:"oauth_jwks_file"`   // JSON Web Key Set with the token signing keys
+	OAuthHMACSecret string `mapstructure:"oauth_hmac_secret"` // Shared secret for HS256/384/512 tokens
+	OAuthAudience   string `mapstructure:"oauth_audience"`    // Required aud claim (empty = not checked)
+	OAuthScope      string `mapstructure:"oauth_scope"`       // Required scope (empty = not checked)
+
+	// Per-user authorization policies (used when no custom Authorizer is installed)
+	AuthorizationPolicies []AuthorizationPolicy `mapstructure:"authorization_policies"`
+
+	// Session observer dispatch
+	AsyncObservers    bool `mapstructure:"async_observers"`     // Deliver observer events on per-observer goroutines
+	ObserverQueueSize int  `mapstructure:"observer_queue_size"` // Pending events per async observer (default 256)
+
 	// Extensions: Pluggable architecture for extending functionality
 	// These interfaces allow external packages to extend functionality
-	MessageStore     MessageStore     `mapstructure:"-"` // Where messages are stored (default: local files)
-	Authenticator    Authenticator    `mapstructure:"-"` // How users authenticate (default: goodauth/badauth patterns)
-	Authorizer       Authorizer       `mapstructure:"-"` // What authenticated users can do (default: allow all)
-	RateLimiter      RateLimiter      `mapstructure:"-"` // Connection/message rate limiting (default: no limits)
-	Observer         SessionObserver  `mapstructure:"-"` // Session event notifications (default: no-op)
-	CapabilityParser CapabilityParser `mapstructure:"-"` // EHLO hostname capability parsing (default: pass-through)
-	SMTPExtensions   []SMTPExtension  `mapstructure:"-"` // Custom SMTP commands and capabilities (default: empty slice)
+	MessageStore     MessageStore      `mapstructure:"-"` // Where messages are stored (default: local files)
+	Authenticator    Authenticator     `mapstructure:"-"` // How users authenticate (default: goodauth/badauth patterns)
+	Authorizer       Authorizer        `mapstructure:"-"` // What authenticated users can do (default: allow all)
+	RateLimiter      RateLimiter       `mapstructure:"-"` // Connection/message rate limiting (default: built-in per-IP limiter)
+	Observer         SessionObserver   `mapstructure:"-"` // Session event notifications (default: no-op)
+	Observers        []SessionObserver `mapstructure:"-"` // Additional observers, notified in order after Observer
+	CapabilityParser CapabilityParser  `mapstructure:"-"` // EHLO hostname capability parsing (default: pass-through)
+	ErrorSimulator   ErrorSimulator    `mapstructure:"-"` // Address-triggered errors (default: verb-prefixed patterns)
+	SMTPExtensions   []SMTPExtension   `mapstructure:"-"` // Custom SMTP commands and capabilities (default: empty slice)
+
+	// TokenValidator checks bearer tokens; NewServer builds it from the oauth_* keys
+	TokenValidator *auth.TokenValidator `mapstructure:"-"`
 
 	// Logging configuration
 	LogConfig logging.LogConfig `mapstructure:"-"`
@@ -246,6 +325,9 @@ func (c *Config) ensureScalarDefaults() {
 	if c.DropDelayPortStart == 0 {
 		c.DropDelayPortStart = DefaultDropDelayStart
 	}
+	if c.TLSBehaviourPortStart == 0 {
+		c.TLSBehaviourPortStart = DefaultTLSBehaviourStart
+	}
 	if c.TLSPort == 0 {
 		c.TLSPort = DefaultTLSPort
 	}
@@ -262,22 +344,36 @@ func (c *Config) ensureMapDefaults() {
 	if c.HostnameMailboxMap == nil {
 		c.HostnameMailboxMap = make(map[string]string)
 	}
+	if c.EnableHostnameRouting {
+		// BADSMTP_HOSTNAME_MAPPING_* variables add to (and override) configured mappings
+		loadHostnameMappingsViper(c)
+	}
 }
 
 func (c *Config) ensureExtensionDefaults() {
 	// Ensure extension defaults
 	if c.MessageStore == nil {
-		c.MessageStore = NewDefaultMessageStore(c.MailboxDir)
+		c.MessageStore = NewRoutingMessageStore(c.MailboxDir, c.GetMailboxDir)
 	}
 	if c.Authenticator == nil {
-		c.Authenticator = NewDefaultAuthenticator()
+		if len(c.AuthUsers) > 0 || c.AuthUsersFile != "" {
+			c.Authenticator = NewUserAuthenticator(c.AuthUsers)
+		} else {
+			c.Authenticator = NewDefaultAuthenticator()
+		}
 	}
 	if c.Authorizer == nil {
-		c.Authorizer = NewAllowAllAuthorizer()
+		// Users can carry their own allowed senders and quota, which PolicyAuthorizer enforces
+		if len(c.AuthorizationPolicies) > 0 || len(c.AuthUsers) > 0 || c.AuthUsersFile != "" {
+			c.Authorizer = NewPolicyAuthorizer(c.AuthorizationPolicies)
+		} else {
+			c.Authorizer = NewAllowAllAuthorizer()
+		}
 	}
 	if c.RateLimiter == nil {
-		// Use a simple in-memory rate limiter by default
-		c.RateLimiter = NewSimpleRateLimiter()
+		// Use a simple in-memory rate limiter by default, tuned by the rate_limit_* keys. An
+		// unknown rate_limit_mode leaves it unset for NewServer to report.
+		c.RateLimiter, _ = c.newRateLimiterFromConfig()
 	}
 	if c.Observer == nil {
 		c.Observer = &NoOpObserver{}
@@ -285,6 +381,18 @@ func (c *Config) ensureExtensionDefaults() {
 	if c.CapabilityParser == nil {
 		c.CapabilityParser = NewDefaultCapabilityParser()
 	}
+	if c.TokenMailboxes {
+		// Wrap once, even if EnsureDefaults runs again
+		if _, ok := c.CapabilityParser.(*TokenCapabilityParser); !ok {
+			c.CapabilityParser = NewTokenCapabilityParser(c.CapabilityParser)
+		}
+		if _, ok := c.MessageStore.(*TokenMessageStore); !ok {
+			c.MessageStore = NewTokenMessageStore(c.MessageStore, c.MailboxDir, c.GetMailboxDir)
+		}
+	}
+	if c.ErrorSimulator == nil {
+		c.ErrorSimulator = NewDefaultErrorSimulator()
+	}
 }
 
 // loadHostnameMappingsViper loads hostname mappings from environment variables.
@@ -308,21 +416,115 @@ func loadHostnameMappingsViper(config *Config) {
 	}
 }
 
+// loadTokenValidator builds TokenValidator from the oauth_* settings, reading the JWKS
+// file if one is configured. It leaves an existing validator in place.
+func (c *Config) loadTokenValidator() error {
+	if c.TokenValidator != nil || (c.OAuthJWKSFile == "" && c.OAuthHMACSecret == "") {
+		return nil
+	}
+	validator := &auth.TokenValidator{
+		Audience: c.OAuthAudience,
+		Scope:    c.OAuthScope,
+	}
+	if c.OAuthHMACSecret != "" {
+		validator.HMACSecret = []byte(c.OAuthHMACSecret)
+	}
+	if c.OAuthJWKSFile != "" {
+		keys, err := auth.LoadJWKS(c.OAuthJWKSFile)
+		if err != nil {
+			return err
+		}
+		validator.Keys = keys
+	}
+	c.TokenValidator = validator
+	return nil
+}
+
+// loadUsers checks the users in AuthUsers and adds those in AuthUsersFile. It needs the
+// built-in UserAuthenticator, which EnsureDefaults installs when either is set.
+func (c *Config) loadUsers() error {
+	ua, ok := c.Authenticator.(*UserAuthenticator)
+	if c.AuthUsersFile == "" && (len(c.AuthUsers) == 0 || !ok) {
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("auth_users_file cannot be used with a custom Authenticator")
+	}
+	users := append([]AuthUser(nil), c.AuthUsers...)
+	if c.AuthUsersFile != "" {
+		fileUsers, err := LoadUsersFile(c.AuthUsersFile)
+		if err != nil {
+			return fmt.Errorf("failed to load users file: %w", err)
+		}
+		users = append(users, fileUsers...)
+	}
+	return ua.SetUsers(users)
+}
+
+// loadClientCAs validates TLSClientAuth and reads the client CA bundle it needs. It
+// leaves an existing pool in place.
+func (c *Config) loadClientCAs() error {
+	switch c.TLSClientAuth {
+	case "", TLSClientAuthNone:
+		return nil
+	case TLSClientAuthRequest, TLSClientAuthRequire:
+	default:
+		return fmt.Errorf("unknown tls_client_auth mode %q (want none, request or require)", c.TLSClientAuth)
+	}
+	if c.ClientCAs != nil {
+		return nil
+	}
+	if c.TLSClientCAFile == "" {
+		return fmt.Errorf("tls_client_auth %q needs tls_client_ca_file", c.TLSClientAuth)
+	}
+	pemData, err := os.ReadFile(c.TLSClientCAFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return fmt.Errorf("no certificates found in client CA file %s", c.TLSClientCAFile)
+	}
+	c.ClientCAs = pool
+	return nil
+}
+
+// applyClientAuth sets the client certificate policy of tlsConfig from TLSClientAuth.
+// Only certificates that chain to ClientCAs are accepted.
+func (c *Config) applyClientAuth(tlsConfig *tls.Config) {
+	switch c.TLSClientAuth {
+	case TLSClientAuthRequest:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case TLSClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return
+	}
+	tlsConfig.ClientCAs = c.ClientCAs
+}
+
 // GetMailboxDir returns the appropriate mailbox directory for a given hostname.
+// Hostnames are matched case-insensitively, ignoring any port and trailing dot.
 func (c *Config) GetMailboxDir(hostname string) string {
 	if !c.EnableHostnameRouting {
 		return c.MailboxDir
 	}
 
-	// Clean hostname (remove port if present)
-	if h, _, ok := strings.Cut(hostname, ":"); ok {
+	// Clean hostname (remove port and trailing dot if present)
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
 		hostname = h
 	}
+	hostname = strings.TrimSuffix(hostname, ".")
 
 	// Look for exact hostname match in static mapping
 	if dir, exists := c.HostnameMailboxMap[hostname]; exists {
 		return dir
 	}
+	for name, dir := range c.HostnameMailboxMap {
+		if strings.EqualFold(strings.TrimSuffix(name, "."), hostname) {
+			return dir
+		}
+	}
 
 	// Use default directory for unmapped hostnames
 	if c.DefaultMailboxDir != "" {
@@ -355,33 +557,12 @@ func (c *Config) GenerateSelfSignedCert(hostname string) (tls.Certificate, error
 		return tls.Certificate{}, fmt.Errorf("failed to generate private key: %v", err)
 	}
 
-	// Certificate template
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			//nolint:misspell // 'Organization' is the stdlib field name
-			Organization:       []string{"BadSMTP Test Server"},
-			Country:            []string{"US"},
-			Province:           []string{"Test"},
-			Locality:           []string{"Test"},
-			OrganizationalUnit: []string{"Test"},
-			CommonName:         hostname,
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(CertValidityHours * time.Hour), // Valid for 24 hours
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-	}
-
-	// Add hostname as SAN
-	template.DNSNames = []string{hostname}
-	if ip := net.ParseIP(hostname); ip != nil {
-		template.IPAddresses = []net.IP{ip}
-	}
+	// Certificate valid for 24 hours
+	now := time.Now()
+	template := certificateTemplate(hostname, now, now.Add(CertValidityHours*time.Hour))
 
 	// Generate certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %v", err)
 	}
@@ -405,6 +586,35 @@ func (c *Config) GenerateSelfSignedCert(hostname string) (tls.Certificate, error
 	return cert, nil
 }
 
+// certificateTemplate returns a server certificate template for hostname, with the
+// hostname (or IP address) as the common name and subject alternative name.
+func certificateTemplate(hostname string, notBefore, notAfter time.Time) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			//nolint:misspell // 'Organization' is the stdlib field name
+			Organization:       []string{"BadSMTP Test Server"},
+			Country:            []string{"US"},
+			Province:           []string{"Test"},
+			Locality:           []string{"Test"},
+			OrganizationalUnit: []string{"Test"},
+			CommonName:         hostname,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	// Add hostname as SAN
+	template.DNSNames = []string{hostname}
+	if ip := net.ParseIP(hostname); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	}
+	return template
+}
+
 // AnalysePortBehaviour analyses the port number to determine connection behaviour.
 func (c *Config) AnalysePortBehaviour() {
 	port := c.Port
@@ -425,7 +635,22 @@ func (c *Config) AnalysePortBehaviour() {
 		}
 	}
 
+	// TLS misbehaviour: one behaviour per offset (default 25800..25809)
+	if c.TLSBehaviourPortStart != 0 && port >= c.TLSBehaviourPortStart && port < c.TLSBehaviourPortStart+len(TLSBehaviours) {
+		c.TLSBehaviour = TLSBehaviours[port-c.TLSBehaviourPortStart]
+	}
+
 	// No separate ImmediateDropPort anymore; immediate drop represented by DropDelayPortStart + offset 0
+
+	// LMTP listener
+	if c.LMTPPort != 0 && port == c.LMTPPort {
+		c.LMTP = true
+	}
+
+	// Submission (MSA) listener
+	if c.SubmissionPort != 0 && port == c.SubmissionPort {
+		c.Submission = true
+	}
 }
 
 // GetBehaviourDescription returns a human-readable description of the port behaviour.
@@ -444,6 +669,8 @@ func (c *Config) GetBehaviourDescription() string {
 			return "Immediate drop"
 		}
 		return fmt.Sprintf("Drop with delay: %ds", delay)
+	case c.TLSBehaviourPortStart != 0 && port >= c.TLSBehaviourPortStart && port < c.TLSBehaviourPortStart+len(TLSBehaviours):
+		return fmt.Sprintf("TLS behaviour: %s", TLSBehaviours[port-c.TLSBehaviourPortStart])
 	default:
 		return "Normal behaviour"
 	}
@@ -459,6 +686,9 @@ func (c *Config) ValidatePortConfiguration() error {
 	// Add port ranges (now small discrete ranges of DelayCount ports)
 	validator.AddRange(NewPortRange("greeting delay", c.GreetingDelayPortStart, RangeSize))
 	validator.AddRange(NewPortRange("drop delay", c.DropDelayPortStart, RangeSize))
+	if c.TLSBehaviourPortStart != 0 {
+		validator.AddRange(NewPortRange("TLS behaviour", c.TLSBehaviourPortStart, len(TLSBehaviours)-1))
+	}
 
 	// Add individual ports
 	validator.AddPort("normal", c.Port)
@@ -468,6 +698,12 @@ func (c *Config) ValidatePortConfiguration() error {
 		validator.AddPort("TLS", c.TLSPort)
 		validator.AddPort("STARTTLS", c.STARTTLSPort)
 	}
+	if c.LMTPPort != 0 {
+		validator.AddPort("LMTP", c.LMTPPort)
+	}
+	if c.SubmissionPort != 0 {
+		validator.AddPort("submission", c.SubmissionPort)
+	}
 
 	// Run all validations
 	if err := validator.ValidateAll(); err != nil {
@@ -506,11 +742,17 @@ func LoadConfig() (*Config, error) {
 
 	// Consolidate string env overrides into a map to reduce branching and cyclomatic complexity.
 	stringEnvMap := map[string]*string{
-		"BADSMTP_MAILBOXDIR":     &cfg.MailboxDir,
-		"BADSMTP_TLSCERTFILE":    &cfg.TLSCertFile,
-		"BADSMTP_TLSKEYFILE":     &cfg.TLSKeyFile,
-		"BADSMTP_TLSHOSTNAME":    &cfg.TLSHostname,
-		"BADSMTP_LISTEN_ADDRESS": &cfg.ListenAddress,
+		"BADSMTP_MAILBOXDIR":      &cfg.MailboxDir,
+		"BADSMTP_TLSCERTFILE":     &cfg.TLSCertFile,
+		"BADSMTP_TLSKEYFILE":      &cfg.TLSKeyFile,
+		"BADSMTP_TLSHOSTNAME":     &cfg.TLSHostname,
+		"BADSMTP_TLSCLIENTCAFILE": &cfg.TLSClientCAFile,
+		"BADSMTP_TLSCLIENTAUTH":   &cfg.TLSClientAuth,
+		"BADSMTP_TLSCADIR":        &cfg.TLSCADir,
+		"BADSMTP_TLSMINVERSION":   &cfg.TLS.MinVersion,
+		"BADSMTP_TLSMAXVERSION":   &cfg.TLS.MaxVersion,
+		"BADSMTP_TLSKEYLOGFILE":   &cfg.TLSKeyLogFile,
+		"BADSMTP_LISTEN_ADDRESS":  &cfg.ListenAddress,
 	}
 	for key, dest := range stringEnvMap {
 		if v := os.Getenv(key); v != "" {
@@ -523,8 +765,11 @@ func LoadConfig() (*Config, error) {
 		"BADSMTP_PORT":                   &cfg.Port,
 		"BADSMTP_GREETINGDELAYPORTSTART": &cfg.GreetingDelayPortStart,
 		"BADSMTP_DROPDELAYPORTSTART":     &cfg.DropDelayPortStart,
+		"BADSMTP_TLSBEHAVIOURPORTSTART":  &cfg.TLSBehaviourPortStart,
 		"BADSMTP_TLSPORT":                &cfg.TLSPort,
 		"BADSMTP_STARTTLSPORT":           &cfg.STARTTLSPort,
+		"BADSMTP_LMTPPORT":               &cfg.LMTPPort,
+		"BADSMTP_SUBMISSIONPORT":         &cfg.SubmissionPort,
 	}
 	for key, dest := range intEnvMap {
 		if v := os.Getenv(key); v != "" {
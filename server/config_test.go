@@ -309,3 +309,29 @@ func TestValidatePortConfiguration(t *testing.T) {
 		})
 	}
 }
+
+func TestGetMailboxDir(t *testing.T) {
+	config := &Config{
+		MailboxDir:         "/var/mail/default",
+		DefaultMailboxDir:  "/var/mail/unmapped",
+		HostnameMailboxMap: map[string]string{"MAIL.EXAMPLE.COM": "/var/mail/example"},
+	}
+
+	if dir := config.GetMailboxDir("mail.example.com"); dir != "/var/mail/default" {
+		t.Errorf("Expected MailboxDir when routing is disabled, got '%s'", dir)
+	}
+
+	config.EnableHostnameRouting = true
+	tests := map[string]string{
+		"mail.example.com":    "/var/mail/example",
+		"Mail.Example.Com.":   "/var/mail/example",
+		"mail.example.com:25": "/var/mail/example",
+		"other.example.com":   "/var/mail/unmapped",
+		"":                    "/var/mail/unmapped",
+	}
+	for hostname, want := range tests {
+		if dir := config.GetMailboxDir(hostname); dir != want {
+			t.Errorf("GetMailboxDir(%q) = '%s', want '%s'", hostname, dir, want)
+		}
+	}
+}
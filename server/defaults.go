@@ -17,6 +17,10 @@ const (
 
 	// ServerGreeting is the banner shown in the SMTP 220 greeting
 	ServerGreeting = "BadSMTP - The Reliably Unreliable Mail Server https://badsmtp.com"
+
+	// DefaultScramPassword is the password SCRAM clients use with the pattern-based
+	// DefaultAuthenticator, which accepts any password for the other mechanisms
+	DefaultScramPassword = "password"
 )
 
 var (
@@ -24,29 +28,62 @@ var (
 	stdLogger         = logging.NewStdoutLogger(&defaultsLoggerCfg)
 )
 
-// DefaultMessageStore stores messages to local files.
+// DefaultMessageStore stores messages to local Maildir directories.
 type DefaultMessageStore struct {
 	mailboxDir string
+	resolveDir func(hostname string) string // Optional per-hostname directory routing
+
+	mu        sync.Mutex
+	mailboxes map[string]*storage.Mailbox // Lazily created mailboxes keyed by directory
 }
 
-// NewDefaultMessageStore creates a file-based message store.
+// NewDefaultMessageStore creates a file-based message store writing to a single directory.
 func NewDefaultMessageStore(mailboxDir string) *DefaultMessageStore {
+	return NewRoutingMessageStore(mailboxDir, nil)
+}
+
+// NewRoutingMessageStore creates a file-based message store that picks the directory for
+// each message by passing Message.Hostname to resolveDir (typically Config.GetMailboxDir).
+// A nil resolveDir, or one returning "", stores to mailboxDir.
+func NewRoutingMessageStore(mailboxDir string, resolveDir func(hostname string) string) *DefaultMessageStore {
 	return &DefaultMessageStore{
 		mailboxDir: mailboxDir,
+		resolveDir: resolveDir,
+		mailboxes:  make(map[string]*storage.Mailbox),
 	}
 }
 
 // Store saves a message to a local file.
 func (dms *DefaultMessageStore) Store(msg *Message) error {
-	mailbox, err := storage.NewMailbox(dms.mailboxDir)
+	return dms.storeIn(dms.dirFor(msg.Hostname), msg)
+}
+
+// dirFor returns the mailbox directory for messages received for hostname.
+func (dms *DefaultMessageStore) dirFor(hostname string) string {
+	if dms.resolveDir != nil {
+		if routed := dms.resolveDir(hostname); routed != "" {
+			return routed
+		}
+	}
+	return dms.mailboxDir
+}
+
+// storeIn saves a message to the Maildir at dir.
+func (dms *DefaultMessageStore) storeIn(dir string, msg *Message) error {
+	mailbox, err := dms.mailbox(dir)
 	if err != nil {
 		return fmt.Errorf("failed to create mailbox: %w", err)
 	}
 
 	storageMsg := &storage.Message{
-		From:    msg.From,
-		To:      msg.To,
-		Content: msg.Content,
+		From:     msg.From,
+		To:       msg.To,
+		Content:  msg.Content,
+		BodyType: msg.BodyType,
+
+		ClientCertSubject: msg.ClientCertSubject,
+		ClientCertSANs:    msg.ClientCertSANs,
+		Token:             MessageToken(msg),
 	}
 
 	if err := mailbox.SaveMessage(storageMsg); err != nil {
@@ -56,10 +93,27 @@ func (dms *DefaultMessageStore) Store(msg *Message) error {
 	stdLogger.Info("Message stored locally",
 		logging.F("from", msg.From),
 		logging.F("to", msg.To),
-		logging.F("size", msg.Size))
+		logging.F("size", msg.Size),
+		logging.F("hostname", msg.Hostname),
+		logging.F("mailbox_dir", dir))
 	return nil
 }
 
+// mailbox returns the cached mailbox for dir, creating it on first use.
+func (dms *DefaultMessageStore) mailbox(dir string) (*storage.Mailbox, error) {
+	dms.mu.Lock()
+	defer dms.mu.Unlock()
+	if mailbox, ok := dms.mailboxes[dir]; ok {
+		return mailbox, nil
+	}
+	mailbox, err := storage.NewMailbox(dir)
+	if err != nil {
+		return nil, err
+	}
+	dms.mailboxes[dir] = mailbox
+	return mailbox, nil
+}
+
 // DefaultAuthenticator uses pattern-based authentication (goodauth/badauth).
 // This is the current OSS behaviour for testing SMTP clients.
 type DefaultAuthenticator struct{}
@@ -86,6 +140,13 @@ func (da *DefaultAuthenticator) Authenticate(username, _ string) (user *User, er
 	return user, nil
 }
 
+// LookupSecret returns DefaultScramPassword for every user (implements SecretProvider), so
+// SCRAM clients can authenticate in pattern mode. Usernames are still checked against the
+// patterns by Authenticate once the exchange completes.
+func (da *DefaultAuthenticator) LookupSecret(_ string) (string, bool) {
+	return DefaultScramPassword, true
+}
+
 // NoOpObserver is a no-op implementation of SessionObserver.
 // Used when no observers are registered.
 type NoOpObserver struct{}
@@ -143,20 +204,36 @@ type SimpleRateLimiter struct {
 	// limits
 	maxConnsPerMinute    int
 	maxMessagesPerMinute int
+	maxConcurrent        int // 0 means no limit on simultaneous connections
 }
 
 type clientState struct {
 	connections int
 	messages    int
+	active      int
 	resetAt     time.Time
 }
 
 // NewSimpleRateLimiter creates a rate limiter with default reasonable limits.
 func NewSimpleRateLimiter() *SimpleRateLimiter {
+	return NewSimpleRateLimiterWithLimits(defaultMaxConnsPerMinute, defaultMaxMessagesPerMinute, 0)
+}
+
+// NewSimpleRateLimiterWithLimits creates a fixed-window rate limiter with the given
+// per-IP limits. Non-positive per-minute limits fall back to the defaults; a
+// maxConcurrent of zero disables the simultaneous connection limit.
+func NewSimpleRateLimiterWithLimits(connsPerMinute, messagesPerMinute, maxConcurrent int) *SimpleRateLimiter {
+	if connsPerMinute <= 0 {
+		connsPerMinute = defaultMaxConnsPerMinute
+	}
+	if messagesPerMinute <= 0 {
+		messagesPerMinute = defaultMaxMessagesPerMinute
+	}
 	return &SimpleRateLimiter{
 		clients:              make(map[string]*clientState),
-		maxConnsPerMinute:    defaultMaxConnsPerMinute,
-		maxMessagesPerMinute: defaultMaxMessagesPerMinute,
+		maxConnsPerMinute:    connsPerMinute,
+		maxMessagesPerMinute: messagesPerMinute,
+		maxConcurrent:        maxConcurrent,
 	}
 }
 
@@ -181,6 +258,9 @@ func (r *SimpleRateLimiter) AllowConnection(clientIP string) (allowed bool, reas
 	if cs.connections >= r.maxConnsPerMinute {
 		return false, "rate limit exceeded: too many connections"
 	}
+	if r.maxConcurrent > 0 && cs.active >= r.maxConcurrent {
+		return false, "rate limit exceeded: too many concurrent connections"
+	}
 	return true, ""
 }
 
@@ -211,6 +291,7 @@ func (r *SimpleRateLimiter) RecordConnection(clientIP string) {
 	}
 	r.resetIfNeeded(cs)
 	cs.connections++
+	cs.active++
 }
 
 // RecordMessage records that a message was sent for accounting.
@@ -226,11 +307,14 @@ func (r *SimpleRateLimiter) RecordMessage(_ *User, clientIP string) {
 	cs.messages++
 }
 
-// ReleaseConnection records that a connection was closed.
-func (r *SimpleRateLimiter) ReleaseConnection(_ string) {
+// ReleaseConnection records that a connection was closed. Per-minute counts are kept
+// until the reset window expires; only the concurrent connection count is decremented.
+func (r *SimpleRateLimiter) ReleaseConnection(clientIP string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	// no-op for now; keep counts until reset window expires
+	if cs, ok := r.clients[clientIP]; ok && cs.active > 0 {
+		cs.active--
+	}
 }
 
 // AllowAllAuthorizer allows all sending operations (default OSS behaviour).
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"badsmtp/logging"
+	"badsmtp/smtp"
+)
+
+const (
+	// dsnReportingMTA identifies BadSMTP in generated delivery status notifications.
+	dsnReportingMTA = "badsmtp.test"
+	// dsnRetryPeriod is the Will-Retry-Until horizon reported for delayed recipients.
+	dsnRetryPeriod = 4 * 24 * time.Hour
+)
+
+// dsnRecipient is one per-recipient section of a delivery status notification.
+type dsnRecipient struct {
+	address  string
+	orcpt    string // Original-Recipient from ORCPT, "" if not supplied
+	trigger  *smtp.DSNTrigger
+	received time.Time
+}
+
+// dsnSubjects maps a DSN action to the Subject suffix and explanatory text of the report.
+var dsnSubjects = map[string][2]string{
+	smtp.DSNActionFailed:    {"Failure", "Your message could not be delivered to the following recipients:"},
+	smtp.DSNActionDelayed:   {"Delay", "Delivery to the following recipients has been delayed. Delivery will be retried:"},
+	smtp.DSNActionDelivered: {"Success", "Your message was delivered to the following recipients:"},
+}
+
+// generateDSNs delivers RFC 3464 delivery status notifications for an accepted message to
+// its envelope sender, through the configured MessageStore. Recipients request them with
+// dsnfail@, dsndelay@ or dsnsuccess@ addresses, or with NOTIFY=SUCCESS for a normal
+// delivery. NOTIFY, when supplied, must include the matching condition. No notification
+// is ever sent to the null reverse-path.
+func (s *Session) generateDSNs(msg *Message) {
+	if msg.From == "" {
+		return
+	}
+
+	byAction := make(map[string][]dsnRecipient)
+	var actions []string
+	now := time.Now()
+	for _, rcpt := range msg.To {
+		params := msg.RcptParams[rcpt]
+		trigger := smtp.ExtractDSNTrigger(rcpt)
+		if trigger == nil {
+			if !smtp.NotifyConditions(params[smtp.ParamNotify])[smtp.NotifySuccess] {
+				continue
+			}
+			trigger = &smtp.DSNTrigger{Action: smtp.DSNActionDelivered, Status: "2.0.0"}
+		}
+		if notify, ok := params[smtp.ParamNotify]; ok && !smtp.NotifyConditions(notify)[trigger.Condition()] {
+			continue
+		}
+
+		if _, seen := byAction[trigger.Action]; !seen {
+			actions = append(actions, trigger.Action)
+		}
+		byAction[trigger.Action] = append(byAction[trigger.Action], dsnRecipient{
+			address:  rcpt,
+			orcpt:    smtp.DecodeXText(params[smtp.ParamOrcpt]),
+			trigger:  trigger,
+			received: now,
+		})
+	}
+
+	for _, action := range actions {
+		dsn := buildDSN(msg, action, byAction[action])
+		if err := s.config.MessageStore.Store(dsn); err != nil {
+			s.logger.Error("Failed to store delivery status notification", err,
+				logging.F("action", action),
+				logging.F("to", msg.From))
+			continue
+		}
+		s.logger.Info("Generated delivery status notification",
+			logging.F("action", action),
+			logging.F("to", msg.From),
+			logging.F("recipients", len(byAction[action])))
+	}
+}
+
+// buildDSN renders a multipart/report; report-type=delivery-status message for one action.
+func buildDSN(original *Message, action string, recipients []dsnRecipient) *Message {
+	now := time.Now()
+	boundary := fmt.Sprintf("=_badsmtp_dsn_%d", now.UnixNano())
+	subject := dsnSubjects[action]
+
+	var b strings.Builder
+	headers := map[string]string{
+		"From":           fmt.Sprintf("Mail Delivery System <MAILER-DAEMON@%s>", dsnReportingMTA),
+		"To":             "<" + original.From + ">",
+		"Subject":        "Delivery Status Notification (" + subject[0] + ")",
+		"Date":           now.Format(time.RFC1123Z),
+		"Message-ID":     fmt.Sprintf("<%d.dsn@%s>", now.UnixNano(), dsnReportingMTA),
+		"Auto-Submitted": "auto-replied",
+		"MIME-Version":   "1.0",
+		"Content-Type":   fmt.Sprintf("multipart/report; report-type=delivery-status; boundary=%q", boundary),
+	}
+	for _, name := range []string{"From", "To", "Subject", "Date", "Message-ID", "Auto-Submitted", "MIME-Version", "Content-Type"} {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, headers[name])
+	}
+	b.WriteString("\r\n")
+
+	// Human-readable part
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\n%s\r\n\r\n", boundary, subject[1])
+	for _, r := range recipients {
+		fmt.Fprintf(&b, "  <%s>: %s\r\n", r.address, r.trigger.Status)
+	}
+	b.WriteString("\r\n")
+
+	// Machine-readable delivery-status part
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", dsnReportingMTA)
+	if envid := original.MailParams[smtp.ParamEnvID]; envid != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", smtp.DecodeXText(envid))
+	}
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n", recipients[0].received.Format(time.RFC1123Z))
+	for _, r := range recipients {
+		b.WriteString("\r\n")
+		if r.orcpt != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s\r\n", r.orcpt)
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", r.address)
+		fmt.Fprintf(&b, "Action: %s\r\n", r.trigger.Action)
+		fmt.Fprintf(&b, "Status: %s\r\n", r.trigger.Status)
+		if r.trigger.Action != smtp.DSNActionDelivered {
+			code := r.trigger.Code()
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %d %s %s\r\n", code, r.trigger.Status, smtp.GetErrorMessage(code))
+		}
+		if r.trigger.Action == smtp.DSNActionDelayed {
+			fmt.Fprintf(&b, "Will-Retry-Until: %s\r\n", r.received.Add(dsnRetryPeriod).Format(time.RFC1123Z))
+		}
+	}
+	b.WriteString("\r\n")
+
+	// Returned content: headers only for RET=HDRS, otherwise the full message
+	if strings.EqualFold(original.MailParams[smtp.ParamRet], "HDRS") {
+		fmt.Fprintf(&b, "--%s\r\nContent-Type: text/rfc822-headers\r\n\r\n%s\r\n", boundary, messageHeaderBlock(original.Content))
+	} else {
+		fmt.Fprintf(&b, "--%s\r\nContent-Type: message/rfc822\r\n\r\n%s\r\n", boundary, strings.TrimRight(original.Content, "\r\n"))
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+
+	content := b.String()
+	dsn := &Message{
+		From:      "",
+		To:        []string{original.From},
+		Content:   content,
+		Headers:   headers,
+		Size:      len(content),
+		ClientIP:  original.ClientIP,
+		Hostname:  original.Hostname,
+		Timestamp: now.Format(time.RFC3339),
+	}
+	// Keep the notification in the sender's token sub-mailbox
+	if token := MessageToken(original); token != "" {
+		dsn.Metadata = map[string]interface{}{MetadataToken: token}
+	}
+	return dsn
+}
+
+// messageHeaderBlock returns the header section of a message, without the blank separator line.
+func messageHeaderBlock(content string) string {
+	if i := strings.Index(content, "\r\n\r\n"); i >= 0 {
+		return content[:i]
+	}
+	if i := strings.Index(content, "\n\n"); i >= 0 {
+		return content[:i]
+	}
+	return strings.TrimRight(content, "\r\n")
+}
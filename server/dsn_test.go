@@ -0,0 +1,92 @@
+package server
+
+import (
+	"mime"
+	"strings"
+	"testing"
+)
+
+func TestSessionGeneratesDSN(t *testing.T) {
+	store := &captureStore{}
+	cfg := &Config{Port: 2525, MessageStore: store}
+	cfg.EnsureDefaults()
+	cmd := paramSession(t, cfg, "nopipelining.example.com")
+
+	steps := []struct{ line, want string }{
+		{"MAIL FROM:<sender@example.com> RET=HDRS ENVID=QQ314159", "250"},
+		{"RCPT TO:<dsnfail_5.1.1@example.com> ORCPT=rfc822;orig+2Bx@example.com", "250"},
+		{"RCPT TO:<dsndelay@example.com> NOTIFY=FAILURE", "250"},
+		{"RCPT TO:<ok@example.com> NOTIFY=SUCCESS", "250"},
+		{"RCPT TO:<quiet@example.com>", "250"},
+		{"DATA", "354"},
+		{"Subject: original\r\n\r\nbody text\r\n.", "250"},
+	}
+	for _, step := range steps {
+		if got := cmd(step.line); !strings.HasPrefix(got, step.want) {
+			t.Fatalf("%q: got %q, want %s", step.line, got, step.want)
+		}
+	}
+	cmd("QUIT")
+
+	// Original message, then a failure DSN and a success DSN; the delay DSN was
+	// suppressed by NOTIFY=FAILURE.
+	if len(store.messages) != 3 {
+		t.Fatalf("expected 3 stored messages, got %d", len(store.messages))
+	}
+
+	failure := store.messages[1]
+	if failure.From != "" || len(failure.To) != 1 || failure.To[0] != "sender@example.com" {
+		t.Fatalf("DSN envelope should be <> -> sender, got %q -> %v", failure.From, failure.To)
+	}
+	mediaType, params, err := mime.ParseMediaType(failure.Headers["Content-Type"])
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("unexpected DSN Content-Type %q", failure.Headers["Content-Type"])
+	}
+	for _, want := range []string{
+		"Original-Envelope-Id: QQ314159",
+		"Original-Recipient: rfc822;orig+x@example.com",
+		"Final-Recipient: rfc822; dsnfail_5.1.1@example.com",
+		"Action: failed",
+		"Status: 5.1.1",
+		"Diagnostic-Code: smtp; 550 5.1.1",
+		"Content-Type: text/rfc822-headers",
+	} {
+		if !strings.Contains(failure.Content, want) {
+			t.Errorf("failure DSN missing %q:\n%s", want, failure.Content)
+		}
+	}
+	if strings.Contains(failure.Content, "body text") {
+		t.Error("RET=HDRS DSN should not include the message body")
+	}
+
+	success := store.messages[2]
+	if !strings.Contains(success.Content, "Action: delivered") || !strings.Contains(success.Content, "Final-Recipient: rfc822; ok@example.com") {
+		t.Errorf("unexpected success DSN:\n%s", success.Content)
+	}
+	if strings.Contains(success.Content, "quiet@example.com") {
+		t.Error("recipient without NOTIFY=SUCCESS should not be reported as delivered")
+	}
+}
+
+func TestDSNDisabledAndNullSender(t *testing.T) {
+	store := &captureStore{}
+	cfg := &Config{Port: 2525, MessageStore: store}
+	cfg.EnsureDefaults()
+
+	cmd := paramSession(t, cfg, "nopipelining-nodsn.example.com")
+	if got := cmd("MAIL FROM:<sender@example.com> RET=FULL"); !strings.HasPrefix(got, "555 5.5.4") {
+		t.Fatalf("expected RET to be refused with nodsn, got %q", got)
+	}
+
+	// Bounces are never generated for the null reverse-path
+	cmd("MAIL FROM:<>")
+	cmd("RCPT TO:<dsnfail@example.com>")
+	cmd("DATA")
+	if got := cmd("Subject: bounce\r\n\r\nhi\r\n."); !strings.HasPrefix(got, "250") {
+		t.Fatalf("message rejected: %q", got)
+	}
+	cmd("QUIT")
+	if len(store.messages) != 1 {
+		t.Fatalf("expected only the original message, got %d", len(store.messages))
+	}
+}
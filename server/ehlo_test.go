@@ -177,6 +177,8 @@ func TestAuthMechanismKeywords(t *testing.T) {
 		{"authlogin.example.com", "LOGIN"},
 		{"authcram.example.com", "CRAM-MD5"},
 		{"authoauth.example.com", "XOAUTH2"},
+		{"authscram.example.com", "SCRAM-SHA-256"},
+		{"authntlm.example.com", "NTLM"},
 	}
 
 	for _, c := range cases {
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"badsmtp/logging"
+	"badsmtp/smtp"
+)
+
+// ErrorCommandRcptData is the command passed to ErrorSimulator.CheckError for the
+// per-recipient reply sent after DATA or BDAT LAST in LMTP mode. The address is the
+// recipient.
+const ErrorCommandRcptData = "RCPTDATA"
+
+// ErrorCommandAuthUser is the command passed to ErrorSimulator.CheckError for the reply
+// to a completed AUTH exchange. The address is the username the client authenticated
+// with (e.g. auth454@example.com).
+const ErrorCommandAuthUser = "AUTHUSER"
+
+// ErrorCommandCert is the command passed to ErrorSimulator.CheckError for the replies to
+// MAIL and AUTH EXTERNAL from a client that presented a TLS client certificate. The
+// address is the certificate's subject common name (e.g. cert550.relay.example.com).
+const ErrorCommandCert = "CERT"
+
+// DefaultErrorSimulator implements the verb-prefixed address patterns from smtp/errors.go
+// (e.g. mail452@, rcpt550_5.1.1@, helo500.). It is used when Config.ErrorSimulator is nil.
+type DefaultErrorSimulator struct{}
+
+// NewDefaultErrorSimulator creates the pattern-based error simulator.
+func NewDefaultErrorSimulator() *DefaultErrorSimulator {
+	return &DefaultErrorSimulator{}
+}
+
+// defaultErrorExtractors maps each command to the pattern it responds to.
+var defaultErrorExtractors = map[string]func(string) *smtp.ErrorResult{
+	smtp.CmdHELO:         smtp.ExtractHeloError,
+	smtp.CmdEHLO:         smtp.ExtractHeloError,
+	smtp.CmdLHLO:         smtp.ExtractHeloError,
+	smtp.CmdMAIL:         smtp.ExtractMailFromError,
+	smtp.CmdRCPT:         smtp.ExtractRcptToError,
+	smtp.CmdDATA:         smtp.ExtractDataError,
+	smtp.CmdBDAT:         smtp.ExtractBdatError,
+	smtp.CmdRSET:         smtp.ExtractRsetError,
+	smtp.CmdNOOP:         smtp.ExtractNoopError,
+	smtp.CmdQUIT:         smtp.ExtractQuitError,
+	smtp.CmdSTARTTLS:     smtp.ExtractStartTLSError,
+	smtp.CmdAUTH:         smtp.ExtractAuthError,
+	ErrorCommandRcptData: smtp.ExtractRcptDataError,
+	ErrorCommandAuthUser: smtp.ExtractAuthUserError,
+	ErrorCommandCert:     smtp.ExtractCertError,
+}
+
+// CheckError matches address against the pattern for command.
+func (d *DefaultErrorSimulator) CheckError(address, command string) (code, message string, shouldError bool) {
+	extract, ok := defaultErrorExtractors[strings.ToUpper(command)]
+	if !ok {
+		return "", "", false
+	}
+	result := extract(address)
+	if result == nil {
+		return "", "", false
+	}
+	code = strconv.Itoa(result.Code)
+	if result.Enhanced != "" {
+		code += " " + result.Enhanced
+	}
+	return code, result.ResponseText(), true
+}
+
+// parseSimulatedError converts an ErrorSimulator reply into an ErrorResult. code is a
+// 3-digit reply code, optionally followed by a space and an enhanced status code
+// (e.g. "550 5.7.1"); an empty message uses the standard text for the code.
+func parseSimulatedError(code, message string) (*smtp.ErrorResult, error) {
+	fields := strings.Fields(code)
+	if len(fields) == 0 || len(fields) > 2 || len(fields[0]) != 3 {
+		return nil, fmt.Errorf("invalid simulated error code %q", code)
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || n < 200 || n > 599 {
+		return nil, fmt.Errorf("invalid simulated error code %q", code)
+	}
+	result := &smtp.ErrorResult{Code: n, Text: message}
+	if len(fields) == 2 {
+		result.Enhanced = fields[1]
+	}
+	result.Message = strings.TrimSpace(fmt.Sprintf("%s %s", code, result.ResponseText()))
+	return result, nil
+}
+
+// checkSimulatedError asks the configured ErrorSimulator whether address triggers an
+// error for command, falling back to the default patterns when none is configured.
+// Malformed replies from custom simulators are logged and ignored.
+func (s *Session) checkSimulatedError(address, command string) *smtp.ErrorResult {
+	simulator := s.config.ErrorSimulator
+	if simulator == nil {
+		simulator = NewDefaultErrorSimulator()
+	}
+	code, message, shouldError := simulator.CheckError(address, command)
+	if !shouldError {
+		return nil
+	}
+	result, err := parseSimulatedError(code, message)
+	if err != nil {
+		s.logger.Warn("Ignoring malformed simulated error",
+			logging.F("command", command),
+			logging.F("trigger", address),
+			logging.F("err", err))
+		return nil
+	}
+	return result
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"badsmtp/smtp"
+)
+
+func TestDefaultErrorSimulator(t *testing.T) {
+	sim := NewDefaultErrorSimulator()
+	tests := []struct {
+		address  string
+		command  string
+		wantCode string
+		wantErr  bool
+	}{
+		{"mail452@example.com", smtp.CmdMAIL, "452", true},
+		{"rcpt550_5.1.1@example.com", smtp.CmdRCPT, "550 5.1.1", true},
+		{"bdat552@example.com", smtp.CmdBDAT, "552", true},
+		{"helo421.example.com", smtp.CmdEHLO, "421", true},
+		{"rcptdata452_4.2.2@example.com", ErrorCommandRcptData, "452 4.2.2", true},
+		{"mail452@example.com", smtp.CmdRCPT, "", false},
+		{"user@example.com", smtp.CmdMAIL, "", false},
+		{"mail452@example.com", "VRFY", "", false},
+	}
+	for _, tt := range tests {
+		code, message, shouldError := sim.CheckError(tt.address, tt.command)
+		if shouldError != tt.wantErr || code != tt.wantCode {
+			t.Errorf("CheckError(%q, %q) = %q, %v; want %q, %v", tt.address, tt.command, code, shouldError, tt.wantCode, tt.wantErr)
+		}
+		if shouldError && message == "" {
+			t.Errorf("CheckError(%q, %q) returned an empty message", tt.address, tt.command)
+		}
+	}
+}
+
+func TestParseSimulatedError(t *testing.T) {
+	result, err := parseSimulatedError("452 4.2.2", "Mailbox full")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Code != 452 || result.Enhanced != "4.2.2" || result.ResponseText() != "Mailbox full" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	for _, code := range []string{"", "45", "abc", "999", "452 4.2.2 extra"} {
+		if _, err := parseSimulatedError(code, ""); err == nil {
+			t.Errorf("expected %q to be rejected", code)
+		}
+	}
+}
+
+// teamErrorSimulator triggers errors from a "full-" local-part prefix and otherwise
+// defers to the built-in patterns.
+type teamErrorSimulator struct{ commands []string }
+
+func (s *teamErrorSimulator) CheckError(address, command string) (code, message string, shouldError bool) {
+	s.commands = append(s.commands, command)
+	if command == smtp.CmdRCPT && strings.HasPrefix(address, "full-") {
+		return "452 4.2.2", "Mailbox full", true
+	}
+	if command == smtp.CmdNOOP && strings.HasPrefix(address, "noisy-") {
+		return "bogus", "", true
+	}
+	return NewDefaultErrorSimulator().CheckError(address, command)
+}
+
+func TestCustomErrorSimulator(t *testing.T) {
+	sim := &teamErrorSimulator{}
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}, ErrorSimulator: sim}
+	cfg.EnsureDefaults()
+	cmd := paramSession(t, cfg, "nopipelining.example.com")
+
+	cmd("MAIL FROM:<noisy-sender@example.com>")
+	if got := cmd("RCPT TO:<full-user@example.com>"); got != "452 4.2.2 Mailbox full" {
+		t.Fatalf("expected custom RCPT error, got %q", got)
+	}
+	if got := cmd("RCPT TO:<rcpt550@example.com>"); !strings.HasPrefix(got, "550") {
+		t.Fatalf("expected built-in RCPT pattern to still apply, got %q", got)
+	}
+	if got := cmd("NOOP"); got != "250 OK" {
+		t.Fatalf("expected malformed simulated error to be ignored, got %q", got)
+	}
+
+	for _, want := range []string{smtp.CmdEHLO, smtp.CmdMAIL, smtp.CmdDATA, smtp.CmdBDAT, smtp.CmdAUTH, smtp.CmdRCPT} {
+		found := false
+		for _, c := range sim.commands {
+			if c == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected CheckError to be consulted for %s, got %v", want, sim.commands)
+		}
+	}
+}
+
+func TestBdatErrorPattern(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	cmd := paramSession(t, cfg, "nopipelining.example.com")
+
+	cmd("MAIL FROM:<bdat552_5.3.4@example.com>")
+	cmd("RCPT TO:<user@example.com>")
+	if got := cmd("BDAT 5\r\nhello"); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected intermediate chunk to be accepted, got %q", got)
+	}
+	if got := cmd("BDAT 0 LAST"); !strings.HasPrefix(got, "552 5.3.4") {
+		t.Fatalf("expected BDAT LAST to fail, got %q", got)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"badsmtp/auth"
 	"badsmtp/smtp"
 )
 
@@ -18,7 +19,7 @@ type User struct {
 
 // Message represents an SMTP message with all relevant context.
 type Message struct {
-	From    string            // Envelope sender (MAIL FROM)
+	From    string            // Envelope sender (MAIL FROM); empty for the null reverse-path <>
 	To      []string          // Envelope recipients (RCPT TO)
 	Content string            // Full message content including headers
 	Headers map[string]string // Parsed headers
@@ -26,9 +27,20 @@ type Message struct {
 
 	// Context
 	ClientIP  string // Client IP address
-	Hostname  string // Server hostname used
+	Hostname  string // Hostname the message was received for (SNI, reverse DNS or EHLO name)
 	TLSUsed   bool   // Whether TLS was used
 	Timestamp string // ISO 8601 timestamp
+	BodyType  string // Declared body type: "7BIT" (default), "8BITMIME" or "BINARYMIME"
+
+	// Verified TLS client certificate ("" and nil when none was presented)
+	ClientCertSubject string   // Subject distinguished name
+	ClientCertSANs    []string // Subject alternative names, as in SessionContext
+
+	// ESMTP parameters, keyed by upper-cased keyword (e.g. "SIZE", "BODY", "SMTPUTF8")
+	MailParams map[string]string            // Accepted MAIL FROM parameters
+	RcptParams map[string]map[string]string // Accepted RCPT TO parameters, by recipient
+
+	Metadata map[string]interface{} // Session metadata from extensions (e.g. the token from a tok<id> label)
 }
 
 // MessageStore handles storage of received messages.
@@ -42,10 +54,27 @@ type MessageStore interface {
 // Implementations can validate against APIs, databases, LDAP, etc.
 type Authenticator interface {
 	// Authenticate validates credentials and returns a User if successful.
-	// Returns nil user and error if authentication fails.
+	// Returns nil user and error if authentication fails. password is the cleartext
+	// password for PLAIN and LOGIN, and empty for other mechanisms.
 	Authenticate(username, password string) (*User, error)
 }
 
+// CredentialsAuthenticator is an optional interface for Authenticators that check the
+// secret proved during AUTH. When the configured Authenticator implements it,
+// AuthenticateCredentials is called instead of Authenticate, so challenge-response
+// mechanisms such as CRAM-MD5 can be verified without a cleartext password.
+type CredentialsAuthenticator interface {
+	AuthenticateCredentials(creds *auth.Credentials) (*User, error)
+}
+
+// SecretProvider is an optional interface for Authenticators that can hand out a user's
+// password. SCRAM needs the password during the exchange, so the SCRAM mechanisms are
+// only usable when the configured Authenticator implements it.
+type SecretProvider interface {
+	// LookupSecret returns the password for username, or false if the user is unknown.
+	LookupSecret(username string) (secret string, ok bool)
+}
+
 // SessionObserver receives notifications about session events.
 // Multiple observers can be registered to monitor/react to events.
 type SessionObserver interface {
@@ -75,6 +104,10 @@ type SessionContext struct {
 	TLSActive     bool                   // Whether TLS is active
 	MessagesSent  int                    // Number of messages sent in this session
 	Metadata      map[string]interface{} // Custom metadata from extensions (e.g., parsed tokens)
+
+	// Verified TLS client certificate ("" and nil when none was presented)
+	ClientCertSubject string   // Subject distinguished name
+	ClientCertSANs    []string // Subject alternative names, e.g. "DNS:relay.example.com", "email:a@example.com"
 }
 
 // RateLimiter controls connection and message rates.
@@ -108,10 +141,24 @@ type Authorizer interface {
 	GetQuota(user *User) int64
 }
 
+// QuotaRecorder is an optional interface for Authorizers that track quota usage.
+// When the configured Authorizer implements it, RecordUsage is called with the message
+// size after each message from an authenticated user is stored.
+type QuotaRecorder interface {
+	RecordUsage(user *User, size int64)
+}
+
 // ErrorSimulator allows custom error simulation logic.
-// The default implementation uses email pattern matching (450@, 550@, etc.)
+// The default implementation uses email pattern matching (mail452@, rcpt550_5.1.1@, etc.)
+//
+// CheckError is called with the MAIL FROM address for MAIL, DATA, BDAT, RSET, NOOP,
+// QUIT, STARTTLS and AUTH (the delayed commands are checked when MAIL FROM is accepted),
+// with each recipient for RCPT and ErrorCommandRcptData, with the greeting hostname
+// for HELO, EHLO and LHLO, and with the authenticated username for ErrorCommandAuthUser.
 type ErrorSimulator interface {
 	// CheckError examines an address and returns error if pattern matches.
+	// code is a 3-digit reply code, optionally followed by an enhanced status code
+	// (e.g. "550" or "550 5.7.1"); an empty message uses the standard text for the code.
 	CheckError(address string, command string) (code string, message string, shouldError bool)
 }
 
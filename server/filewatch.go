@@ -0,0 +1,65 @@
+package server
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileWatchDebounce is how long watchFile waits for a burst of events to settle, so a
+// file written in several steps is only reloaded once.
+const fileWatchDebounce = 100 * time.Millisecond
+
+// watchFile calls onChange whenever the file at path is written or replaced. It watches
+// the parent directory, so replacing the file with a rename (as editors and deployment
+// tools do) is noticed too. The returned function stops watching.
+func watchFile(path string, onChange func()) (stop func(), err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	target := filepath.Clean(path)
+	var (
+		mu    sync.Mutex
+		timer *time.Timer
+	)
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != target || !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+					continue
+				}
+				mu.Lock()
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(fileWatchDebounce, onChange)
+				mu.Unlock()
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		_ = watcher.Close()
+		mu.Lock()
+		if timer != nil {
+			timer.Stop()
+		}
+		mu.Unlock()
+	}, nil
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// KeyLogFileEnv is the environment variable that, as for browsers and curl, names a file
+// to write TLS secrets to when tls_key_log_file is not set.
+const KeyLogFileEnv = "SSLKEYLOGFILE"
+
+// KeyLog writes TLS secrets in the NSS key log format, so that captured sessions can be
+// decrypted, e.g. by Wireshark. Each session's secrets follow a comment line naming the
+// session, so a capture can be matched with the session's log entries.
+type KeyLog struct {
+	name string
+
+	mu      sync.Mutex
+	w       io.Writer
+	comment string                  // Last comment written
+	pending map[net.Conn]*keyLogger // Handshakes whose session is not known yet
+}
+
+// NewKeyLog returns a KeyLog writing to w; name identifies w in log messages.
+func NewKeyLog(name string, w io.Writer) *KeyLog {
+	return &KeyLog{name: name, w: w, pending: make(map[net.Conn]*keyLogger)}
+}
+
+// OpenKeyLog returns a KeyLog appending to the file at path, which is created if needed.
+func OpenKeyLog(path string) (*KeyLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600) //nolint:gosec // path comes from the operator's configuration
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyLog(path, f), nil
+}
+
+// Name returns the name of the file the secrets are written to.
+func (l *KeyLog) Name() string {
+	return l.name
+}
+
+// write writes line, preceded by the comment line unless the previous line had the same one.
+func (l *KeyLog) write(comment string, line []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if comment != l.comment {
+		if _, err := fmt.Fprintf(l.w, "# %s\n", comment); err != nil {
+			return err
+		}
+		l.comment = comment
+	}
+	_, err := l.w.Write(line)
+	return err
+}
+
+// forSession returns a KeyLogWriter for a handshake within a known session, described by
+// comment.
+func (l *KeyLog) forSession(comment string) io.Writer {
+	return &keyLogger{log: l, comment: comment}
+}
+
+// forConn returns a KeyLogWriter for the handshake on conn, before the session is known.
+// The secrets are held back until identify names the session.
+func (l *KeyLog) forConn(conn net.Conn) io.Writer {
+	kl := &keyLogger{log: l}
+	l.mu.Lock()
+	l.pending[conn] = kl
+	l.mu.Unlock()
+	return kl
+}
+
+// identify writes the secrets held back for conn after comment.
+func (l *KeyLog) identify(conn net.Conn, comment string) {
+	l.mu.Lock()
+	kl, ok := l.pending[conn]
+	delete(l.pending, conn)
+	l.mu.Unlock()
+	if ok {
+		kl.identify(comment)
+	}
+}
+
+// keyLogger is the KeyLogWriter of one TLS handshake.
+type keyLogger struct {
+	log *KeyLog
+
+	mu      sync.Mutex
+	comment string   // Empty until the session is known
+	held    [][]byte // Lines written before then
+}
+
+func (k *keyLogger) Write(line []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.comment == "" {
+		k.held = append(k.held, bytes.Clone(line))
+		return len(line), nil
+	}
+	if err := k.log.write(k.comment, line); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
+
+func (k *keyLogger) identify(comment string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.comment = comment
+	for _, line := range k.held {
+		_ = k.log.write(comment, line)
+	}
+	k.held = nil
+}
+
+// loadKeyLog opens TLSKeyLogFile, or the file named by SSLKEYLOGFILE without one. A key
+// log set by the caller is kept.
+func (c *Config) loadKeyLog() error {
+	if c.KeyLog != nil {
+		return nil
+	}
+	path := c.TLSKeyLogFile
+	if path == "" {
+		path = os.Getenv(KeyLogFileEnv)
+	}
+	if path == "" {
+		return nil
+	}
+	keyLog, err := OpenKeyLog(path)
+	if err != nil {
+		return fmt.Errorf("failed to open TLS key log file: %w", err)
+	}
+	c.KeyLog = keyLog
+	return nil
+}
+
+// identifyKeyLog writes the secrets held back for the implicit TLS handshake on conn, if
+// any, after comment.
+func (c *Config) identifyKeyLog(conn net.Conn, comment string) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if c.KeyLog == nil || !ok {
+		return
+	}
+	c.KeyLog.identify(tlsConn.NetConn(), comment)
+}
+
+// keyLogComment returns the key log comment naming a session.
+func keyLogComment(sessionID string, conn net.Conn) string {
+	return fmt.Sprintf("BadSMTP session %s, client %s", sessionID, conn.RemoteAddr())
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keyLogLines returns the lines written to buf so far.
+func keyLogLines(keyLog *KeyLog, buf *bytes.Buffer) []string {
+	keyLog.mu.Lock()
+	defer keyLog.mu.Unlock()
+	return strings.Split(strings.TrimSpace(buf.String()), "\n")
+}
+
+// checkKeyLog checks that the secrets the client logged were logged by the server,
+// after a comment naming a session.
+func checkKeyLog(t *testing.T, lines []string, clientKeys *bytes.Buffer) {
+	t.Helper()
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "# BadSMTP session sess_") {
+		t.Fatalf("expected a comment naming the session first, got %q", lines)
+	}
+	for _, want := range strings.Split(strings.TrimSpace(clientKeys.String()), "\n") {
+		found := false
+		for _, line := range lines[1:] {
+			found = found || line == want
+		}
+		if !found {
+			t.Errorf("expected the server to log %q", want)
+		}
+	}
+}
+
+func TestSessionSTARTTLSKeyLog(t *testing.T) {
+	var buf, clientKeys bytes.Buffer
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}, KeyLog: NewKeyLog("test", &buf)}
+	cfg.EnsureDefaults()
+	if err := cfg.loadTLSSettings(); err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := &tls.Config{InsecureSkipVerify: true, KeyLogWriter: &clientKeys} //nolint:gosec // only the key log is checked
+	if _, err := startTLSClient(t, cfg, clientConfig); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	checkKeyLog(t, keyLogLines(cfg.KeyLog, &buf), &clientKeys)
+}
+
+func TestServerImplicitTLSKeyLog(t *testing.T) {
+	var buf, clientKeys bytes.Buffer
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}, KeyLog: NewKeyLog("test", &buf)}
+	cfg.EnsureDefaults()
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	listener, err := srv.createTLSListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			srv.serveTLS(conn, cfg, 0)
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, KeyLogWriter: &clientKeys}) //nolint:gosec // only the key log is checked
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	// The secrets are written once the session exists, before its greeting
+	if _, _, err := textproto.NewConn(conn).ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	checkKeyLog(t, keyLogLines(cfg.KeyLog, &buf), &clientKeys)
+}
+
+func TestLoadKeyLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.log")
+	t.Setenv(KeyLogFileEnv, path)
+	cfg := &Config{}
+	if err := cfg.loadKeyLog(); err != nil {
+		t.Fatalf("loadKeyLog failed: %v", err)
+	}
+	if cfg.KeyLog == nil || cfg.KeyLog.Name() != path {
+		t.Fatalf("expected %s to name the key log file", KeyLogFileEnv)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm()&0o077 != 0 {
+		t.Errorf("expected a private key log file: %v", err)
+	}
+
+	cfg = &Config{TLSKeyLogFile: filepath.Join(t.TempDir(), "missing", "keys.log")}
+	if err := cfg.loadKeyLog(); err == nil {
+		t.Error("expected an unwritable key log file to fail")
+	}
+
+	// Secrets held back for a connection follow the comment naming its session
+	var buf bytes.Buffer
+	keyLog := NewKeyLog("test", &buf)
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+	w := keyLog.forConn(server)
+	_, _ = w.Write([]byte("CLIENT_RANDOM aa bb\n"))
+	_, _ = keyLog.forSession("other").Write([]byte("CLIENT_RANDOM cc dd\n"))
+	keyLog.identify(server, "session one")
+	_, _ = w.Write([]byte("CLIENT_RANDOM ee ff\n"))
+	if want := "# other\nCLIENT_RANDOM cc dd\n# session one\nCLIENT_RANDOM aa bb\nCLIENT_RANDOM ee ff\n"; buf.String() != want {
+		t.Errorf("unexpected key log:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestLMTPPortEnablesLMTP(t *testing.T) {
+	cfg := &Config{Port: 2424, LMTPPort: 2424}
+	cfg.EnsureDefaults()
+	cfg.AnalysePortBehaviour()
+	if !cfg.LMTP {
+		t.Fatal("expected LMTP mode on the LMTP port")
+	}
+
+	other := &Config{Port: 2525, LMTPPort: 2424}
+	other.EnsureDefaults()
+	other.AnalysePortBehaviour()
+	if other.LMTP {
+		t.Fatal("expected SMTP mode on other ports")
+	}
+}
+
+func TestLMTPSessionPerRecipientReplies(t *testing.T) {
+	store := &captureStore{}
+	cfg := &Config{Port: 2525, LMTP: true, MessageStore: store}
+	cfg.EnsureDefaults()
+
+	client, serverConn := connPair()
+	defer client.Close()
+	sess := NewSession(serverConn, cfg, nil)
+	go func() { _ = sess.Handle() }()
+
+	tp := textproto.NewConn(client)
+	readReply := func() string {
+		t.Helper()
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			if len(line) < 4 || line[3] != '-' {
+				return line
+			}
+		}
+	}
+	send := func(line string) string {
+		t.Helper()
+		_ = tp.PrintfLine("%s", line)
+		return readReply()
+	}
+
+	if greeting := readReply(); !strings.Contains(greeting, " LMTP ") {
+		t.Fatalf("expected LMTP greeting, got %q", greeting)
+	}
+	if got := send("EHLO nopipelining.example.com"); !strings.HasPrefix(got, "500") {
+		t.Fatalf("expected EHLO to be refused in LMTP mode, got %q", got)
+	}
+	if got := send("LHLO nopipelining.example.com"); !strings.HasPrefix(got, "250") {
+		t.Fatalf("LHLO failed: %q", got)
+	}
+	send("MAIL FROM:<sender@example.com>")
+	send("RCPT TO:<one@example.com>")
+	send("RCPT TO:<rcptdata452_4.2.2@example.com>")
+	send("RCPT TO:<two@example.com>")
+
+	send("DATA")
+	_ = tp.PrintfLine("Subject: lmtp\r\n\r\nhello\r\n.")
+	want := []string{"250 2.1.5 <one@example.com>", "452 4.2.2", "250 2.1.5 <two@example.com>"}
+	for _, w := range want {
+		if got := readReply(); !strings.HasPrefix(got, w) {
+			t.Fatalf("expected reply %q, got %q", w, got)
+		}
+	}
+
+	// BDAT LAST gets per-recipient replies too
+	send("MAIL FROM:<sender@example.com>")
+	send("RCPT TO:<rcptdata550@example.com>")
+	go func() { _, _ = client.Write([]byte("BDAT 5 LAST\r\nhelloNOOP\r\n")) }()
+	if got := readReply(); !strings.HasPrefix(got, "550") {
+		t.Fatalf("expected 550 for BDAT recipient, got %q", got)
+	}
+	if got := readReply(); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected NOOP reply, got %q", got)
+	}
+
+	if len(store.messages) != 1 {
+		t.Fatalf("expected 1 stored message, got %d", len(store.messages))
+	}
+	if to := store.messages[0].To; len(to) != 2 || to[0] != "one@example.com" || to[1] != "two@example.com" {
+		t.Fatalf("expected only delivered recipients to be stored, got %v", to)
+	}
+}
+
+func TestSMTPSessionRejectsLHLO(t *testing.T) {
+	conn := newMockConn()
+	session := NewSession(conn, newTestConfig(), nil)
+	conn.writeInput("LHLO client.example.com\r\nQUIT\r\n")
+	if err := session.Handle(); err != nil {
+		t.Fatalf("Session handle failed: %v", err)
+	}
+	if !strings.Contains(conn.getOutput(), "500 Command not recognised") {
+		t.Fatalf("expected LHLO to be refused in SMTP mode, got %q", conn.getOutput())
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"badsmtp/logging"
+)
+
+// DefaultObserverQueueSize is the number of pending events an AsyncObserver buffers
+// before it starts dropping events for a slow observer.
+const DefaultObserverQueueSize = 256
+
+// SimulatedError is passed to SessionObserver.OnError when a pattern-triggered error
+// response (e.g. mail550@, rcpt452_4.2.2@, helo421.) is sent to the client.
+type SimulatedError struct {
+	Code     int    // 3-digit SMTP response code
+	Enhanced string // Optional RFC 2034 enhanced code
+	Trigger  string // Address or hostname that triggered the error
+}
+
+// Error implements the error interface.
+func (e *SimulatedError) Error() string {
+	if e.Enhanced != "" {
+		return fmt.Sprintf("simulated error %d %s triggered by %s", e.Code, e.Enhanced, e.Trigger)
+	}
+	return fmt.Sprintf("simulated error %d triggered by %s", e.Code, e.Trigger)
+}
+
+// MultiObserver fans session events out to several observers, in registration order.
+// A panicking observer is logged and does not prevent the remaining observers from running.
+type MultiObserver struct {
+	observers []SessionObserver
+}
+
+// NewMultiObserver creates an observer that notifies each of the given observers in order.
+// Nil observers are ignored.
+func NewMultiObserver(observers ...SessionObserver) *MultiObserver {
+	m := &MultiObserver{}
+	for _, o := range observers {
+		if o != nil {
+			m.observers = append(m.observers, o)
+		}
+	}
+	return m
+}
+
+// Observers returns the observers notified by this MultiObserver.
+func (m *MultiObserver) Observers() []SessionObserver {
+	return m.observers
+}
+
+func (m *MultiObserver) each(event string, fn func(SessionObserver)) {
+	for _, o := range m.observers {
+		callObserver(o, event, fn)
+	}
+}
+
+// callObserver invokes fn on o, recovering from any panic so a faulty observer cannot
+// take down the SMTP session.
+func callObserver(o SessionObserver, event string, fn func(SessionObserver)) {
+	defer func() {
+		if r := recover(); r != nil {
+			stdLogger.Error("Session observer panicked", fmt.Errorf("%v", r),
+				logging.F("event", event),
+				logging.F("observer", fmt.Sprintf("%T", o)))
+		}
+	}()
+	fn(o)
+}
+
+// OnConnect notifies all observers of a new connection.
+func (m *MultiObserver) OnConnect(session *SessionContext) {
+	m.each("connect", func(o SessionObserver) { o.OnConnect(session) })
+}
+
+// OnAuth notifies all observers of a successful authentication.
+func (m *MultiObserver) OnAuth(session *SessionContext, user *User) {
+	m.each("auth", func(o SessionObserver) { o.OnAuth(session, user) })
+}
+
+// OnMessage notifies all observers of a received message.
+func (m *MultiObserver) OnMessage(session *SessionContext, msg *Message) {
+	m.each("message", func(o SessionObserver) { o.OnMessage(session, msg) })
+}
+
+// OnError notifies all observers of a session error.
+func (m *MultiObserver) OnError(session *SessionContext, err error, command string) {
+	m.each("error", func(o SessionObserver) { o.OnError(session, err, command) })
+}
+
+// OnDisconnect notifies all observers that the client disconnected.
+func (m *MultiObserver) OnDisconnect(session *SessionContext, duration string) {
+	m.each("disconnect", func(o SessionObserver) { o.OnDisconnect(session, duration) })
+}
+
+// AsyncObserver delivers events to a wrapped observer on its own goroutine, so a slow
+// observer never stalls the SMTP conversation. Events are delivered in order; when the
+// queue is full, further events are dropped and logged until the observer catches up.
+// Close must be called to release the worker goroutine.
+type AsyncObserver struct {
+	observer SessionObserver
+	queue    chan func()
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewAsyncObserver wraps observer so that its events are delivered asynchronously.
+// A queueSize of zero or less uses DefaultObserverQueueSize.
+func NewAsyncObserver(observer SessionObserver, queueSize int) *AsyncObserver {
+	if queueSize <= 0 {
+		queueSize = DefaultObserverQueueSize
+	}
+	a := &AsyncObserver{
+		observer: observer,
+		queue:    make(chan func(), queueSize),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AsyncObserver) run() {
+	for fn := range a.queue {
+		fn()
+	}
+}
+
+func (a *AsyncObserver) enqueue(event string, fn func(SessionObserver)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.queue <- func() { callObserver(a.observer, event, fn) }:
+	default:
+		stdLogger.Warn("Session observer queue full; dropping event",
+			logging.F("event", event),
+			logging.F("observer", fmt.Sprintf("%T", a.observer)))
+	}
+}
+
+// Close stops accepting events. Events already queued are still delivered, after which
+// the worker goroutine exits; Close itself never waits for the observer.
+func (a *AsyncObserver) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	a.closed = true
+	close(a.queue)
+}
+
+// OnConnect queues a connect notification.
+func (a *AsyncObserver) OnConnect(session *SessionContext) {
+	a.enqueue("connect", func(o SessionObserver) { o.OnConnect(session) })
+}
+
+// OnAuth queues an authentication notification.
+func (a *AsyncObserver) OnAuth(session *SessionContext, user *User) {
+	a.enqueue("auth", func(o SessionObserver) { o.OnAuth(session, user) })
+}
+
+// OnMessage queues a message notification.
+func (a *AsyncObserver) OnMessage(session *SessionContext, msg *Message) {
+	a.enqueue("message", func(o SessionObserver) { o.OnMessage(session, msg) })
+}
+
+// OnError queues an error notification.
+func (a *AsyncObserver) OnError(session *SessionContext, err error, command string) {
+	a.enqueue("error", func(o SessionObserver) { o.OnError(session, err, command) })
+}
+
+// OnDisconnect queues a disconnect notification.
+func (a *AsyncObserver) OnDisconnect(session *SessionContext, duration string) {
+	a.enqueue("disconnect", func(o SessionObserver) { o.OnDisconnect(session, duration) })
+}
+
+// sessionObservers builds the observer chain for one session from Config.Observer and
+// Config.Observers. When AsyncObservers is set, each observer is wrapped in its own
+// AsyncObserver; the returned closers must be closed when the session ends.
+func (c *Config) sessionObservers() (observer *MultiObserver, closers []*AsyncObserver) {
+	all := make([]SessionObserver, 0, len(c.Observers)+1)
+	if c.Observer != nil {
+		if _, noop := c.Observer.(*NoOpObserver); !noop {
+			all = append(all, c.Observer)
+		}
+	}
+	for _, o := range c.Observers {
+		if o != nil {
+			all = append(all, o)
+		}
+	}
+
+	if !c.AsyncObservers {
+		return NewMultiObserver(all...), nil
+	}
+
+	wrapped := make([]SessionObserver, 0, len(all))
+	for _, o := range all {
+		a := NewAsyncObserver(o, c.ObserverQueueSize)
+		closers = append(closers, a)
+		wrapped = append(wrapped, a)
+	}
+	return NewMultiObserver(wrapped...), closers
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver records the events it receives, in order.
+type recordingObserver struct {
+	mu       sync.Mutex
+	events   []string
+	contexts []*SessionContext
+	errs     []error
+	block    chan struct{} // when non-nil, every callback waits on it
+}
+
+func (r *recordingObserver) record(event string, ctx *SessionContext) {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	r.contexts = append(r.contexts, ctx)
+}
+
+func (r *recordingObserver) OnConnect(ctx *SessionContext)       { r.record("connect", ctx) }
+func (r *recordingObserver) OnAuth(ctx *SessionContext, _ *User) { r.record("auth", ctx) }
+func (r *recordingObserver) OnMessage(ctx *SessionContext, _ *Message) {
+	r.record("message", ctx)
+}
+func (r *recordingObserver) OnError(ctx *SessionContext, err error, command string) {
+	r.mu.Lock()
+	r.errs = append(r.errs, err)
+	r.mu.Unlock()
+	r.record("error:"+command, ctx)
+}
+func (r *recordingObserver) OnDisconnect(ctx *SessionContext, _ string) { r.record("disconnect", ctx) }
+
+func (r *recordingObserver) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+// runObservedSession drives a full SMTP conversation against a session using cfg.
+func runObservedSession(t *testing.T, cfg *Config) {
+	t.Helper()
+	client, serverConn := connPair()
+	sess := NewSession(serverConn, cfg, nil)
+	done := make(chan struct{})
+	go func() {
+		_ = sess.Handle()
+		close(done)
+	}()
+
+	tp := textproto.NewConn(client)
+	defer tp.Close()
+
+	expect := func(prefix string) {
+		t.Helper()
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			if !strings.HasPrefix(line, prefix) {
+				t.Fatalf("expected %q, got %q", prefix, line)
+			}
+			if len(line) < 4 || line[3] != '-' {
+				return
+			}
+		}
+	}
+
+	expect("220")
+	_ = tp.PrintfLine("EHLO nopipelining.example.com")
+	expect("250")
+	_ = tp.PrintfLine("AUTH PLAIN AHVzZXIAcGFzcw==")
+	expect("235")
+	_ = tp.PrintfLine("MAIL FROM:<sender@example.com>")
+	expect("250")
+	_ = tp.PrintfLine("RCPT TO:<rcpt550@example.com>")
+	expect("550")
+	_ = tp.PrintfLine("RCPT TO:<ok@example.com>")
+	expect("250")
+	_ = tp.PrintfLine("DATA")
+	expect("354")
+	_ = tp.PrintfLine("Subject: hi\r\n\r\nbody\r\n.")
+	expect("250")
+	_ = tp.PrintfLine("QUIT")
+	expect("221")
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session did not finish")
+	}
+}
+
+type nopStore struct{}
+
+func (nopStore) Store(_ *Message) error { return nil }
+
+func TestObserversReceiveSessionEvents(t *testing.T) {
+	first := &recordingObserver{}
+	second := &recordingObserver{}
+
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	cfg.Observer = first
+	cfg.Observers = []SessionObserver{second}
+
+	runObservedSession(t, cfg)
+
+	want := []string{"connect", "auth", "error:RCPT", "message", "disconnect"}
+	for name, obs := range map[string]*recordingObserver{"first": first, "second": second} {
+		got := obs.snapshot()
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("%s observer: expected events %v, got %v", name, want, got)
+		}
+	}
+
+	// All events share the logger's session ID
+	id := first.contexts[0].ID
+	if !strings.HasPrefix(id, "sess_") {
+		t.Fatalf("expected session ID from SMTPLogger, got %q", id)
+	}
+	for _, ctx := range first.contexts {
+		if ctx.ID != id {
+			t.Fatalf("session ID changed between events: %q vs %q", id, ctx.ID)
+		}
+	}
+
+	// The simulated RCPT error is reported as a SimulatedError
+	var simErr *SimulatedError
+	if len(first.errs) != 1 || !errors.As(first.errs[0], &simErr) || simErr.Code != 550 {
+		t.Fatalf("expected one simulated 550 error, got %v", first.errs)
+	}
+
+	// Context snapshots reflect session progress
+	if first.contexts[0].Authenticated {
+		t.Error("connect context should not be authenticated")
+	}
+	last := first.contexts[len(first.contexts)-1]
+	if !last.Authenticated || last.User == nil || last.User.Username != "user" {
+		t.Errorf("disconnect context should carry the authenticated user, got %+v", last)
+	}
+	if last.MessagesSent != 1 {
+		t.Errorf("expected MessagesSent 1, got %d", last.MessagesSent)
+	}
+}
+
+func TestAsyncObserverDoesNotStallSession(t *testing.T) {
+	slow := &recordingObserver{block: make(chan struct{})}
+
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	cfg.Observers = []SessionObserver{slow}
+	cfg.AsyncObservers = true
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		runObservedSession(t, cfg)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session stalled on slow async observer")
+	}
+	if got := slow.snapshot(); len(got) != 0 {
+		t.Fatalf("blocked observer should not have completed any events yet, got %v", got)
+	}
+	close(slow.block)
+
+	// Queued events are still delivered, in order, once the observer catches up
+	want := strings.Join([]string{"connect", "auth", "error:RCPT", "message", "disconnect"}, ",")
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Join(slow.snapshot(), ",") != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected events %v delivered in order, got %v", want, slow.snapshot())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMultiObserverRecoversFromPanic(t *testing.T) {
+	after := &recordingObserver{}
+	m := NewMultiObserver(&panicObserver{}, after)
+
+	m.OnConnect(&SessionContext{ID: "sess_test"})
+
+	if got := after.snapshot(); len(got) != 1 || got[0] != "connect" {
+		t.Fatalf("observer after a panicking one was not notified: %v", got)
+	}
+}
+
+type panicObserver struct{ NoOpObserver }
+
+func (*panicObserver) OnConnect(_ *SessionContext) { panic("boom") }
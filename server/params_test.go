@@ -0,0 +1,152 @@
+package server
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// paramSession starts a session greeted with the given EHLO name and returns a
+// function that sends one command and returns the final reply line.
+func paramSession(t *testing.T, cfg *Config, ehlo string) func(string) string {
+	t.Helper()
+	client, serverConn := connPair()
+	t.Cleanup(func() { _ = client.Close() })
+	sess := NewSession(serverConn, cfg, nil)
+	go func() { _ = sess.Handle() }()
+
+	tp := textproto.NewConn(client)
+	cmd := func(line string) string {
+		t.Helper()
+		if line != "" {
+			if err := tp.PrintfLine("%s", line); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+		}
+		for {
+			reply, err := tp.ReadLine()
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			if len(reply) < 4 || reply[3] != '-' {
+				return reply
+			}
+		}
+	}
+	cmd("")
+	cmd("EHLO " + ehlo)
+	return cmd
+}
+
+func TestSessionMailParameters(t *testing.T) {
+	tests := []struct {
+		name string
+		ehlo string
+		mail string
+		want string
+	}{
+		{"declared size within limit", "size1000.example.com", "MAIL FROM:<a@example.com> SIZE=999", "250"},
+		{"declared size over limit", "size1000.example.com", "MAIL FROM:<a@example.com> SIZE=999999999", "552 5.3.4"},
+		{"size disabled", "nosize.example.com", "MAIL FROM:<a@example.com> SIZE=10", "555 5.5.4"},
+		{"8bitmime enabled", "client.example.com", "MAIL FROM:<a@example.com> BODY=8BITMIME", "250"},
+		{"8bitmime disabled", "no8bit.example.com", "MAIL FROM:<a@example.com> BODY=8BITMIME", "555 5.5.4"},
+		{"smtputf8 disabled", "nosmtputf8.example.com", "MAIL FROM:<a@example.com> SMTPUTF8", "555 5.5.4"},
+		{"auth parameter", "client.example.com", "MAIL FROM:<a@example.com> AUTH=<>", "250"},
+		{"auth disabled", "noauth.example.com", "MAIL FROM:<a@example.com> AUTH=<>", "555 5.5.4"},
+		{"unknown parameter", "client.example.com", "MAIL FROM:<a@example.com> XFOO=1", "555 5.5.4"},
+		{"malformed size", "client.example.com", "MAIL FROM:<a@example.com> SIZE=big", "501 5.5.4"},
+		{"rcpt parameter on mail", "client.example.com", "MAIL FROM:<a@example.com> NOTIFY=NEVER", "555 5.5.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+			cfg.EnsureDefaults()
+			cmd := paramSession(t, cfg, "nopipelining-"+tt.ehlo)
+			if got := cmd(tt.mail); !strings.HasPrefix(got, tt.want) {
+				t.Fatalf("%s: got %q, want prefix %q", tt.mail, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionStoresParameters(t *testing.T) {
+	store := &captureStore{}
+	cfg := &Config{Port: 2525, MessageStore: store}
+	cfg.EnsureDefaults()
+	cmd := paramSession(t, cfg, "nopipelining-nodsn.example.com")
+
+	if got := cmd("MAIL FROM:<a@example.com> size=20 BODY=8BITMIME"); !strings.HasPrefix(got, "250") {
+		t.Fatalf("MAIL rejected: %q", got)
+	}
+	if got := cmd("RCPT TO:<b@example.com> NOTIFY=NEVER"); !strings.HasPrefix(got, "555 5.5.4") {
+		t.Fatalf("expected DSN parameter to be refused without DSN, got %q", got)
+	}
+	cmd("RCPT TO:<b@example.com>")
+	cmd("DATA")
+	if got := cmd("Subject: params\r\n\r\nhi\r\n."); !strings.HasPrefix(got, "250") {
+		t.Fatalf("message rejected: %q", got)
+	}
+	cmd("QUIT")
+
+	if len(store.messages) != 1 {
+		t.Fatalf("expected 1 stored message, got %d", len(store.messages))
+	}
+	params := store.messages[0].MailParams
+	if params["SIZE"] != "20" || params["BODY"] != "8BITMIME" {
+		t.Fatalf("unexpected stored MAIL parameters %v", params)
+	}
+}
+
+func TestSessionBinaryMIME(t *testing.T) {
+	tests := []struct {
+		name string
+		ehlo string
+		want string
+	}{
+		{"advertised with chunking", "client.example.com", "250"},
+		{"disabled by label", "nobinarymime.example.com", "555 5.5.4"},
+		{"disabled with chunking", "nochunking.example.com", "555 5.5.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+			cfg.EnsureDefaults()
+			cmd := paramSession(t, cfg, "nopipelining-"+tt.ehlo)
+			if got := cmd("MAIL FROM:<a@example.com> BODY=BINARYMIME"); !strings.HasPrefix(got, tt.want) {
+				t.Fatalf("got %q, want prefix %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionBinaryMIMERequiresBDAT(t *testing.T) {
+	store := &captureStore{}
+	cfg := &Config{Port: 2525, MessageStore: store}
+	cfg.EnsureDefaults()
+	cmd := paramSession(t, cfg, "nopipelining.example.com")
+
+	cmd("MAIL FROM:<a@example.com> BODY=BINARYMIME")
+	cmd("RCPT TO:<b@example.com>")
+	if got := cmd("DATA"); !strings.HasPrefix(got, "503 5.5.1") {
+		t.Fatalf("expected DATA to be refused for BINARYMIME, got %q", got)
+	}
+	if got := cmd("BDAT 5 LAST\r\nhello"); !strings.HasPrefix(got, "250") {
+		t.Fatalf("BDAT rejected: %q", got)
+	}
+
+	cmd("MAIL FROM:<a@example.com>")
+	cmd("RCPT TO:<b@example.com>")
+	cmd("DATA")
+	cmd("Subject: plain\r\n\r\nhi\r\n.")
+	cmd("QUIT")
+
+	if len(store.messages) != 2 {
+		t.Fatalf("expected 2 stored messages, got %d", len(store.messages))
+	}
+	if got := store.messages[0].BodyType; got != "BINARYMIME" {
+		t.Fatalf("expected BINARYMIME body type, got %q", got)
+	}
+	if got := store.messages[1].BodyType; got != "7BIT" {
+		t.Fatalf("expected default 7BIT body type, got %q", got)
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limiter modes accepted by Config.RateLimitMode.
+const (
+	// RateLimitModeWindow uses SimpleRateLimiter: fixed one-minute counters per client IP.
+	RateLimitModeWindow = "window"
+	// RateLimitModeTokenBucket uses TokenBucketRateLimiter: smooth refill with a burst allowance.
+	RateLimitModeTokenBucket = "token_bucket"
+	// RateLimitModeNone disables rate limiting.
+	RateLimitModeNone = "none"
+)
+
+// Response codes used when the rate limiter rejects a connection or message.
+const (
+	rateLimitConnectionEnhanced = "4.7.0"
+	rateLimitMessageEnhanced    = "4.7.1"
+)
+
+// TokenBucketRateLimiter is an in-memory per-IP rate limiter using token buckets.
+// Each client IP has one bucket for connections and one for messages; buckets refill
+// continuously at the configured per-minute rate up to their burst capacity. Unlike
+// SimpleRateLimiter's fixed windows, this lets clients observe gradual recovery after
+// being throttled, which is useful for testing back-off behaviour.
+type TokenBucketRateLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*bucketState
+
+	connRate      float64 // tokens per second
+	connBurst     float64
+	messageRate   float64 // tokens per second
+	messageBurst  float64
+	maxConcurrent int // 0 means no limit on simultaneous connections
+}
+
+type bucketState struct {
+	connTokens    float64
+	messageTokens float64
+	active        int
+	updatedAt     time.Time
+}
+
+// NewTokenBucketRateLimiter creates a token bucket rate limiter. Rates are tokens per
+// minute; a non-positive burst defaults to the per-minute rate. Non-positive rates fall
+// back to the SimpleRateLimiter defaults.
+func NewTokenBucketRateLimiter(connsPerMinute, connBurst, messagesPerMinute, messageBurst, maxConcurrent int) *TokenBucketRateLimiter {
+	if connsPerMinute <= 0 {
+		connsPerMinute = defaultMaxConnsPerMinute
+	}
+	if messagesPerMinute <= 0 {
+		messagesPerMinute = defaultMaxMessagesPerMinute
+	}
+	if connBurst <= 0 {
+		connBurst = connsPerMinute
+	}
+	if messageBurst <= 0 {
+		messageBurst = messagesPerMinute
+	}
+	return &TokenBucketRateLimiter{
+		clients:       make(map[string]*bucketState),
+		connRate:      float64(connsPerMinute) / time.Minute.Seconds(),
+		connBurst:     float64(connBurst),
+		messageRate:   float64(messagesPerMinute) / time.Minute.Seconds(),
+		messageBurst:  float64(messageBurst),
+		maxConcurrent: maxConcurrent,
+	}
+}
+
+// bucket returns the refilled bucket state for clientIP. Caller must hold r.mu.
+func (r *TokenBucketRateLimiter) bucket(clientIP string) *bucketState {
+	now := time.Now()
+	b, ok := r.clients[clientIP]
+	if !ok {
+		b = &bucketState{connTokens: r.connBurst, messageTokens: r.messageBurst, updatedAt: now}
+		r.clients[clientIP] = b
+		return b
+	}
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	b.connTokens = min(r.connBurst, b.connTokens+elapsed*r.connRate)
+	b.messageTokens = min(r.messageBurst, b.messageTokens+elapsed*r.messageRate)
+	b.updatedAt = now
+	return b
+}
+
+// AllowConnection checks whether a connection token is available for clientIP.
+func (r *TokenBucketRateLimiter) AllowConnection(clientIP string) (allowed bool, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.bucket(clientIP)
+	if b.connTokens < 1 {
+		return false, fmt.Sprintf("rate limit exceeded: too many connections, retry in %s", retryAfter(b.connTokens, r.connRate))
+	}
+	if r.maxConcurrent > 0 && b.active >= r.maxConcurrent {
+		return false, "rate limit exceeded: too many concurrent connections"
+	}
+	return true, ""
+}
+
+// AllowMessage checks whether a message token is available for clientIP.
+func (r *TokenBucketRateLimiter) AllowMessage(_ *User, clientIP string) (allowed bool, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.bucket(clientIP)
+	if b.messageTokens < 1 {
+		return false, fmt.Sprintf("rate limit exceeded: too many messages, retry in %s", retryAfter(b.messageTokens, r.messageRate))
+	}
+	return true, ""
+}
+
+// RecordConnection consumes a connection token for clientIP.
+func (r *TokenBucketRateLimiter) RecordConnection(clientIP string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.bucket(clientIP)
+	b.connTokens--
+	b.active++
+}
+
+// RecordMessage consumes a message token for clientIP.
+func (r *TokenBucketRateLimiter) RecordMessage(_ *User, clientIP string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.bucket(clientIP)
+	b.messageTokens--
+}
+
+// ReleaseConnection records that a connection from clientIP was closed.
+func (r *TokenBucketRateLimiter) ReleaseConnection(clientIP string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b, ok := r.clients[clientIP]; ok && b.active > 0 {
+		b.active--
+	}
+}
+
+// retryAfter returns how long until a bucket holding tokens reaches one full token.
+func retryAfter(tokens, ratePerSecond float64) time.Duration {
+	if ratePerSecond <= 0 {
+		return time.Minute
+	}
+	wait := time.Duration((1 - tokens) / ratePerSecond * float64(time.Second))
+	return wait.Round(time.Second)
+}
+
+// newRateLimiterFromConfig builds the built-in rate limiter selected by RateLimitMode.
+func (c *Config) newRateLimiterFromConfig() (RateLimiter, error) {
+	switch strings.ToLower(strings.TrimSpace(c.RateLimitMode)) {
+	case "", RateLimitModeWindow:
+		return NewSimpleRateLimiterWithLimits(
+			c.RateLimitConnectionsPerMinute, c.RateLimitMessagesPerMinute, c.RateLimitMaxConcurrent), nil
+	case RateLimitModeNone, "off", "disabled":
+		return NewNoOpRateLimiter(), nil
+	case RateLimitModeTokenBucket, "token-bucket", "tokenbucket":
+		return NewTokenBucketRateLimiter(
+			c.RateLimitConnectionsPerMinute, c.RateLimitConnectionBurst,
+			c.RateLimitMessagesPerMinute, c.RateLimitMessageBurst,
+			c.RateLimitMaxConcurrent), nil
+	default:
+		return nil, fmt.Errorf("unknown rate_limit_mode %q (want window, token_bucket or none)", c.RateLimitMode)
+	}
+}
+
+// loadRateLimiter builds the rate limiter selected by RateLimitMode, reporting an unknown
+// mode. It leaves an existing rate limiter in place.
+func (c *Config) loadRateLimiter() error {
+	if c.RateLimiter != nil {
+		return nil
+	}
+	limiter, err := c.newRateLimiterFromConfig()
+	if err != nil {
+		return err
+	}
+	c.RateLimiter = limiter
+	return nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bufio"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimpleRateLimiterConcurrentLimit(t *testing.T) {
+	rl := NewSimpleRateLimiterWithLimits(10, 10, 1)
+
+	if ok, _ := rl.AllowConnection("192.0.2.1"); !ok {
+		t.Fatal("first connection should be allowed")
+	}
+	rl.RecordConnection("192.0.2.1")
+
+	if ok, reason := rl.AllowConnection("192.0.2.1"); ok || !strings.Contains(reason, "concurrent") {
+		t.Fatalf("second simultaneous connection should be denied, got ok=%v reason=%q", ok, reason)
+	}
+
+	rl.ReleaseConnection("192.0.2.1")
+	if ok, _ := rl.AllowConnection("192.0.2.1"); !ok {
+		t.Fatal("connection should be allowed after release")
+	}
+}
+
+func TestTokenBucketRateLimiter(t *testing.T) {
+	// 60 per minute = 1 token per second, burst of 2
+	rl := NewTokenBucketRateLimiter(60, 2, 60, 1, 0)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.AllowConnection("192.0.2.1"); !ok {
+			t.Fatalf("connection %d should be allowed within burst", i)
+		}
+		rl.RecordConnection("192.0.2.1")
+	}
+	ok, reason := rl.AllowConnection("192.0.2.1")
+	if ok {
+		t.Fatal("connection beyond burst should be denied")
+	}
+	if !strings.Contains(reason, "retry in") {
+		t.Errorf("expected retry hint in reason, got %q", reason)
+	}
+
+	// Other clients have their own buckets
+	if ok, _ := rl.AllowConnection("192.0.2.2"); !ok {
+		t.Fatal("a different client IP should not be throttled")
+	}
+
+	if ok, _ := rl.AllowMessage(nil, "192.0.2.1"); !ok {
+		t.Fatal("first message should be allowed")
+	}
+	rl.RecordMessage(nil, "192.0.2.1")
+	if ok, _ := rl.AllowMessage(nil, "192.0.2.1"); ok {
+		t.Fatal("message beyond burst should be denied")
+	}
+
+	// Simulate time passing so the bucket refills
+	rl.mu.Lock()
+	rl.clients["192.0.2.1"].updatedAt = time.Now().Add(-2 * time.Second)
+	rl.mu.Unlock()
+	if ok, _ := rl.AllowMessage(nil, "192.0.2.1"); !ok {
+		t.Fatal("message should be allowed after refill")
+	}
+}
+
+func TestRateLimiterFromConfig(t *testing.T) {
+	tests := []struct {
+		mode string
+		want interface{}
+	}{
+		{"", &SimpleRateLimiter{}},
+		{"window", &SimpleRateLimiter{}},
+		{"token_bucket", &TokenBucketRateLimiter{}},
+		{"none", &NoOpRateLimiter{}},
+	}
+	for _, tt := range tests {
+		cfg := &Config{RateLimitMode: tt.mode, RateLimitConnectionsPerMinute: 5}
+		cfg.EnsureDefaults()
+		switch tt.want.(type) {
+		case *SimpleRateLimiter:
+			rl, ok := cfg.RateLimiter.(*SimpleRateLimiter)
+			if !ok || rl.maxConnsPerMinute != 5 {
+				t.Errorf("mode %q: expected SimpleRateLimiter with 5 conns/min, got %#v", tt.mode, cfg.RateLimiter)
+			}
+		case *TokenBucketRateLimiter:
+			if _, ok := cfg.RateLimiter.(*TokenBucketRateLimiter); !ok {
+				t.Errorf("mode %q: expected TokenBucketRateLimiter, got %T", tt.mode, cfg.RateLimiter)
+			}
+		case *NoOpRateLimiter:
+			if _, ok := cfg.RateLimiter.(*NoOpRateLimiter); !ok {
+				t.Errorf("mode %q: expected NoOpRateLimiter, got %T", tt.mode, cfg.RateLimiter)
+			}
+		}
+	}
+}
+
+func TestUnknownRateLimitMode(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}, RateLimitMode: "token_buckets"}
+	cfg.EnsureDefaults()
+	if cfg.RateLimiter != nil {
+		t.Errorf("expected no rate limiter for an unknown mode, got %T", cfg.RateLimiter)
+	}
+	if _, err := NewServer(cfg); err == nil || !strings.Contains(err.Error(), "token_buckets") {
+		t.Errorf("expected NewServer to reject the unknown mode, got %v", err)
+	}
+}
+
+func TestServerRejectsRateLimitedConnection(t *testing.T) {
+	cfg := &Config{Port: 2525, RateLimitMode: RateLimitModeTokenBucket, RateLimitConnectionsPerMinute: 1}
+	cfg.EnsureDefaults()
+	srv := &Server{config: cfg, logger: stdLogger, sessions: make(map[*Session]struct{})}
+
+	// Exhaust the single connection token
+	cfg.RateLimiter.RecordConnection("pipe")
+
+	client, serverConn := connPair()
+	defer client.Close()
+	go srv.handleConnectionForPort(serverConn, cfg.Port)
+
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read greeting: %v", err)
+	}
+	if !strings.HasPrefix(line, "421 4.7.0 rate limit exceeded") {
+		t.Fatalf("expected 421 4.7.0 greeting, got %q", line)
+	}
+}
+
+// denyMessagesLimiter allows connections but refuses every message.
+type denyMessagesLimiter struct{ NoOpRateLimiter }
+
+func (d *denyMessagesLimiter) AllowMessage(_ *User, _ string) (ok bool, reason string) {
+	return false, "rate limit exceeded: too many messages"
+}
+
+func TestSessionRejectsRateLimitedMessage(t *testing.T) {
+	cfg := &Config{Port: 2525, RateLimiter: &denyMessagesLimiter{}}
+	cfg.EnsureDefaults()
+
+	client, serverConn := connPair()
+	sess := NewSession(serverConn, cfg, nil)
+	go func() { _ = sess.Handle() }()
+	defer client.Close()
+
+	tp := textproto.NewConn(client)
+	readReply := func() string {
+		t.Helper()
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			if len(line) < 4 || line[3] != '-' {
+				return line
+			}
+		}
+	}
+
+	readReply()
+	_ = tp.PrintfLine("EHLO nopipelining.example.com")
+	readReply()
+	_ = tp.PrintfLine("MAIL FROM:<a@example.com>")
+	readReply()
+	_ = tp.PrintfLine("RCPT TO:<b@example.com>")
+	readReply()
+
+	_ = tp.PrintfLine("DATA")
+	if got := readReply(); !strings.HasPrefix(got, "450 4.7.1 rate limit exceeded") {
+		t.Fatalf("expected 450 4.7.1 for DATA, got %q", got)
+	}
+
+	// BDAT consumes the chunk before rejecting so the session stays in sync;
+	// the following NOOP is sent straight after the chunk data.
+	go func() { _, _ = client.Write([]byte("BDAT 5 LAST\r\nhelloNOOP\r\n")) }()
+	if got := readReply(); !strings.HasPrefix(got, "450 4.7.1") {
+		t.Fatalf("expected 450 4.7.1 for BDAT, got %q", got)
+	}
+	if got := readReply(); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected session to remain usable after rejection, got %q", got)
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMessagesRoutedByHostname(t *testing.T) {
+	base := t.TempDir()
+	exampleDir := filepath.Join(base, "example")
+	defaultDir := filepath.Join(base, "default")
+	cfg := &Config{
+		Port:                  2525,
+		MailboxDir:            filepath.Join(base, "unused"),
+		EnableHostnameRouting: true,
+		HostnameMailboxMap:    map[string]string{"mail.example.com": exampleDir},
+		DefaultMailboxDir:     defaultDir,
+	}
+	cfg.EnsureDefaults()
+
+	routeMessage(t, cfg, "", "nopipelining.mail.example.com")
+	routeMessage(t, cfg, "", "mail.example.com")
+	routeMessage(t, cfg, "", "client.example.net")
+
+	countNew := func(dir string) int {
+		entries, err := os.ReadDir(filepath.Join(dir, "new"))
+		if err != nil {
+			return 0
+		}
+		return len(entries)
+	}
+	if n := countNew(exampleDir); n != 1 {
+		t.Errorf("expected 1 message routed to mapped mailbox, got %d", n)
+	}
+	if n := countNew(defaultDir); n != 2 {
+		t.Errorf("expected 2 messages in default mailbox, got %d", n)
+	}
+	if _, err := os.Stat(cfg.MailboxDir); !os.IsNotExist(err) {
+		t.Errorf("expected unused MailboxDir not to be created, stat err=%v", err)
+	}
+
+	store, ok := cfg.MessageStore.(*DefaultMessageStore)
+	if !ok {
+		t.Fatalf("expected DefaultMessageStore, got %T", cfg.MessageStore)
+	}
+	if len(store.mailboxes) != 2 {
+		t.Errorf("expected 2 cached mailboxes, got %d", len(store.mailboxes))
+	}
+}
+
+// routeMessage sends one message in a session for localHostname, greeting with ehlo.
+func routeMessage(t *testing.T, cfg *Config, localHostname, ehlo string) {
+	t.Helper()
+	client, serverConn := connPair()
+	defer client.Close()
+	sess := NewSessionWithHostname(serverConn, cfg, nil, localHostname)
+	go func() { _ = sess.Handle() }()
+
+	tp := textproto.NewConn(client)
+	readReply := func() string {
+		t.Helper()
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			if len(line) < 4 || line[3] != '-' {
+				return line
+			}
+		}
+	}
+
+	readReply()
+	for _, line := range []string{"EHLO " + ehlo, "MAIL FROM:<a@example.com>", "RCPT TO:<b@example.com>", "DATA"} {
+		_ = tp.PrintfLine("%s", line)
+		readReply()
+	}
+	_ = tp.PrintfLine("Subject: routed\r\n\r\nhello\r\n.")
+	if got := readReply(); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected message to be accepted, got %q", got)
+	}
+	_ = tp.PrintfLine("QUIT")
+	readReply()
+}
+
+func TestMessagesRoutedByEHLOForLoopbackHostname(t *testing.T) {
+	// The reverse DNS of a loopback address names no mail domain, so the EHLO name routes
+	localHostname := "localhost"
+	if names, err := net.LookupAddr("127.0.0.1"); err == nil && len(names) > 0 {
+		localHostname = strings.TrimSuffix(names[0], ".")
+	}
+	exampleDir := filepath.Join(t.TempDir(), "example")
+	cfg := &Config{
+		Port:                  2525,
+		MailboxDir:            t.TempDir(),
+		EnableHostnameRouting: true,
+		HostnameMailboxMap:    map[string]string{"mail.example.com": exampleDir},
+	}
+	cfg.EnsureDefaults()
+
+	routeMessage(t, cfg, localHostname, "mail.example.com")
+	if entries, err := os.ReadDir(filepath.Join(exampleDir, "new")); err != nil || len(entries) != 1 {
+		t.Errorf("expected the message routed by EHLO name with local hostname %q, got %d (%v)", localHostname, len(entries), err)
+	}
+
+	for name, generic := range map[string]bool{
+		"localhost.": true, "LOCALHOST.localdomain": true, "ip6-localhost": true, "127.0.0.1": true, "::1": true,
+		"mx.example.com": false, "localhost-mx.example.com": false,
+	} {
+		if got := isGenericHostname(name); got != generic {
+			t.Errorf("isGenericHostname(%q) = %v, want %v", name, got, generic)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"badsmtp/logging"
+	"badsmtp/smtp"
 	"badsmtp/storage"
 )
 
@@ -31,6 +32,9 @@ const (
 
 	// DefaultShutdownTimeout is the graceful shutdown timeout used by the server
 	DefaultShutdownTimeout = 10 * time.Second
+	// TLSHandshakeTimeout bounds implicit TLS and STARTTLS handshakes, so a client that
+	// never completes one does not hold its connection (and rate limiter slot) forever
+	TLSHandshakeTimeout = 30 * time.Second
 )
 
 // Server represents an SMTP test server instance
@@ -48,6 +52,13 @@ type Server struct {
 	sessionsMu sync.Mutex
 	sessionsWG sync.WaitGroup
 
+	// stopWatchers stop the file watchers started by Start
+	stopWatchers []func()
+
+	// handshakeCtx is cancelled by Shutdown, aborting implicit TLS handshakes still in progress
+	handshakeCtx     context.Context
+	cancelHandshakes context.CancelFunc
+
 	// shutdown flag
 	shuttingDown int32
 	// done is closed when shutdown completes; Start waits on it so process can exit
@@ -67,6 +78,38 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, fmt.Errorf("port configuration error: %w", err)
 	}
 
+	if err := config.loadTokenValidator(); err != nil {
+		return nil, fmt.Errorf("OAuth configuration error: %w", err)
+	}
+
+	if err := config.loadRateLimiter(); err != nil {
+		return nil, fmt.Errorf("rate limit configuration error: %w", err)
+	}
+
+	if err := config.loadUsers(); err != nil {
+		return nil, fmt.Errorf("authentication configuration error: %w", err)
+	}
+
+	if err := config.loadClientCAs(); err != nil {
+		return nil, fmt.Errorf("TLS client certificate configuration error: %w", err)
+	}
+
+	if err := config.loadTLSSettings(); err != nil {
+		return nil, fmt.Errorf("TLS settings error: %w", err)
+	}
+
+	if err := config.loadKeyLog(); err != nil {
+		return nil, fmt.Errorf("TLS key log configuration error: %w", err)
+	}
+
+	if err := config.loadCA(); err != nil {
+		return nil, fmt.Errorf("TLS CA configuration error: %w", err)
+	}
+
+	if err := config.loadCertificates(); err != nil {
+		return nil, fmt.Errorf("TLS certificate configuration error: %w", err)
+	}
+
 	// Analyse port behaviour based on configuration
 	config.AnalysePortBehaviour()
 
@@ -94,12 +137,15 @@ func NewServer(config *Config) (*Server, error) {
 		}
 	}
 
+	handshakeCtx, cancelHandshakes := context.WithCancel(context.Background())
 	return &Server{
-		config:   config,
-		mailbox:  mailbox,
-		logger:   logger,
-		sessions: make(map[*Session]struct{}),
-		done:     make(chan struct{}),
+		config:           config,
+		mailbox:          mailbox,
+		logger:           logger,
+		sessions:         make(map[*Session]struct{}),
+		handshakeCtx:     handshakeCtx,
+		cancelHandshakes: cancelHandshakes,
+		done:             make(chan struct{}),
 	}, nil
 }
 
@@ -108,6 +154,26 @@ func (s *Server) GetMailbox() *storage.Mailbox {
 	return s.mailbox
 }
 
+// TokenMailbox returns the sub-mailbox holding the messages sent with a tok<id> EHLO label
+// (see Config.TokenMailboxes), so a test run can inspect only its own messages. With
+// hostname routing, it is the sub-mailbox for hostnames without a mapping; see
+// HostnameTokenMailbox.
+func (s *Server) TokenMailbox(token string) (*storage.Mailbox, error) {
+	return s.HostnameTokenMailbox("", token)
+}
+
+// HostnameTokenMailbox returns the token's sub-mailbox inside the mailbox that messages
+// for hostname are routed to, which is where TokenMessageStore stores them.
+func (s *Server) HostnameTokenMailbox(hostname, token string) (*storage.Mailbox, error) {
+	if s.mailbox == nil {
+		return nil, fmt.Errorf("no mailbox directory configured")
+	}
+	if !ValidToken(token) {
+		return nil, fmt.Errorf("invalid token %q", token)
+	}
+	return storage.NewMailbox(TokenMailboxDir(s.config.GetMailboxDir(hostname), token))
+}
+
 // Start begins listening on all configured ports
 func (s *Server) Start() error {
 	// Install a termination handler to perform graceful shutdown on SIGINT/SIGTERM
@@ -124,17 +190,34 @@ func (s *Server) Start() error {
 		}
 	}()
 
+	// Reload the users file and certificates when they change
+	s.watchUsersFile()
+	s.watchCertificates()
+
 	// Start normal behaviour port
 	go s.startPortListener(s.config.Port, "Normal behaviour")
 
 	// Start all special behaviour ports using discrete DelayOptions offsets
 	go s.startPortRangeListeners(s.config.GreetingDelayPortStart, PortRangeSize, "Greeting delay")
 	go s.startPortRangeListeners(s.config.DropDelayPortStart, PortRangeSize, "Drop delay")
+	if s.config.TLSBehaviourPortStart != 0 {
+		go s.startTLSBehaviourListeners()
+	}
 
 	// Start TLS ports (always available with self-signed certificates)
 	go s.startTLSPortListener(s.config.TLSPort, "Implicit TLS")
 	go s.startPortListener(s.config.STARTTLSPort, "STARTTLS")
 
+	// Start LMTP port if configured
+	if s.config.LMTPPort != 0 {
+		go s.startPortListener(s.config.LMTPPort, "LMTP")
+	}
+
+	// Start submission port if configured
+	if s.config.SubmissionPort != 0 {
+		go s.startPortListener(s.config.SubmissionPort, "Submission")
+	}
+
 	// Log the started ports and ranges explicitly
 	// (we intentionally log the base/range rather than the full slice of ports)
 
@@ -142,10 +225,19 @@ func (s *Server) Start() error {
 		logging.F("normal_port", s.config.Port),
 		logging.F("greeting_delay_ports", fmt.Sprintf("%d-%d", s.config.GreetingDelayPortStart, s.config.GreetingDelayPortStart+PortRangeEnd)),
 		logging.F("drop_delay_ports", fmt.Sprintf("%d-%d", s.config.DropDelayPortStart, s.config.DropDelayPortStart+PortRangeEnd)),
+		logging.F("tls_behaviour_ports", fmt.Sprintf("%d-%d", s.config.TLSBehaviourPortStart, s.config.TLSBehaviourPortStart+len(TLSBehaviours)-1)),
 		logging.F("tls_port", s.config.TLSPort),
+		logging.F("tls_ca_dir", s.config.TLSCADir),
 		logging.F("starttls_port", s.config.STARTTLSPort),
+		logging.F("lmtp_port", s.config.LMTPPort),
+		logging.F("submission_port", s.config.SubmissionPort),
 		logging.F("log_level", s.config.LogConfig.Level.String()),
 		logging.F("log_output", s.config.LogConfig.Output))
+	if s.config.KeyLog != nil {
+		s.logger.Warn("TLS KEY LOGGING IS ENABLED: the secrets of every TLS session are written to the key log file, "+
+			"and anyone who can read it can decrypt captured traffic. Use this for debugging only.",
+			logging.F("tls_key_log_file", s.config.KeyLog.Name()))
+	}
 
 	// Keep main goroutine alive until shutdown completes.
 	<-s.done
@@ -208,33 +300,38 @@ func (s *Server) startPortRangeListeners(startPort, count int, description strin
 	}
 }
 
+// startTLSBehaviourListeners starts one listener per TLS behaviour. The connections are
+// plain TCP; the misbehaving handshake is done by handleConnectionForPort.
+func (s *Server) startTLSBehaviourListeners() {
+	for i, behaviour := range TLSBehaviours {
+		go s.startPortListener(s.config.TLSBehaviourPortStart+i, fmt.Sprintf("TLS behaviour (%s)", behaviour))
+	}
+}
+
 // createTLSListener builds a tls.Config with dynamic certificate generation and
 // starts listening on the given port. It returns the listener or an error.
 func (s *Server) createTLSListener(port int) (net.Listener, error) {
 	// Create TLS configuration with dynamic certificate generation
-	tlsConfig := &tls.Config{
-		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			hostname := hello.ServerName
-			if hostname == "" {
-				hostname = s.config.GetTLSHostname()
-			}
-
-			// Try to load certificate from files first
-			if s.config.HasTLS() {
-				if cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile); err == nil {
-					return &cert, nil
-				}
-				s.logger.Warn("Failed to load TLS certificate from files, generating self-signed for", logging.F("hostname", hostname))
-			}
-
-			// Generate self-signed certificate for the requested hostname
-			cert, err := s.config.GenerateSelfSignedCert(hostname)
-			if err != nil {
-				return nil, fmt.Errorf("failed to generate self-signed certificate: %v", err)
-			}
-			return &cert, nil
-		},
-		MinVersion: MinTLSVersion,
+	tlsConfig := s.config.newImplicitTLSConfig()
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		hostname := hello.ServerName
+		if hostname == "" {
+			hostname = s.config.GetTLSHostname()
+		}
+		cert, err := s.certificate(hostname)
+		if err != nil {
+			return nil, err
+		}
+		return &cert, nil
+	}
+	if s.config.KeyLog != nil {
+		// Give each connection its own KeyLogWriter, so its secrets can be labelled with the session
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			connConfig := tlsConfig.Clone()
+			connConfig.GetConfigForClient = nil
+			connConfig.KeyLogWriter = s.config.KeyLog.forConn(hello.Conn)
+			return connConfig, nil
+		}
 	}
 
 	addr := net.JoinHostPort(s.config.ListenAddress, fmt.Sprintf("%d", port))
@@ -245,6 +342,16 @@ func (s *Server) createTLSListener(port int) (net.Listener, error) {
 	return listener, nil
 }
 
+// certificate returns the configured certificate matching hostname, or issues one for
+// hostname from the local CA.
+func (s *Server) certificate(hostname string) (tls.Certificate, error) {
+	cert, err := s.config.serverCertificate(hostname)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to issue certificate: %v", err)
+	}
+	return cert, nil
+}
+
 func (s *Server) startTLSPortListener(port int, description string) {
 	// Create the listener using helper
 	listener, err := s.createTLSListener(port)
@@ -303,11 +410,23 @@ func (s *Server) startTLSPortListener(port int, description string) {
 }
 
 func (s *Server) handleConnectionForPort(conn net.Conn, port int) {
+	release, ok := s.admitConnection(conn, port)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Create a config specific to this port
 	portConfig := *s.config
 	portConfig.Port = port
 	portConfig.AnalysePortBehaviour()
 
+	// TLS behaviour ports speak TLS from the start, misbehaving during the handshake
+	if portConfig.TLSBehaviour != "" {
+		s.serveTLSBehaviour(conn, &portConfig, port)
+		return
+	}
+
 	// Extract hostname from local address if possible
 	hostname := s.extractHostname(conn)
 
@@ -322,11 +441,34 @@ func (s *Server) handleConnectionForPort(conn net.Conn, port int) {
 }
 
 func (s *Server) handleTLSConnectionForPort(conn net.Conn, port int) {
+	release, ok := s.admitConnection(conn, port)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Create a config specific to this port
 	portConfig := *s.config
 	portConfig.Port = port
 	portConfig.AnalysePortBehaviour()
 
+	s.serveTLS(conn, &portConfig, port)
+}
+
+// serveTLS runs a session over an implicit TLS connection.
+func (s *Server) serveTLS(conn net.Conn, portConfig *Config, port int) {
+	// Complete the handshake up front so the SNI name and any client certificate are
+	// known before the session starts. The session is not registered yet, so the handshake
+	// is bounded by TLSHandshakeTimeout and aborted by Shutdown.
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := s.handshake(tlsConn); err != nil {
+			portConfig.identifyKeyLog(conn, fmt.Sprintf("BadSMTP TLS handshake failed, client %s", conn.RemoteAddr()))
+			s.logger.Warn("TLS handshake failed", logging.F("port", port), logging.F("err", err))
+			_ = conn.Close()
+			return
+		}
+	}
+
 	// Extract hostname from local address or TLS SNI
 	hostname := s.extractHostname(conn)
 	if tlsConn, ok := conn.(*tls.Conn); ok {
@@ -337,11 +479,13 @@ func (s *Server) handleTLSConnectionForPort(conn net.Conn, port int) {
 		}
 	}
 
-	session := NewSessionWithHostname(conn, &portConfig, s.mailbox, hostname)
+	session := NewSessionWithHostname(conn, portConfig, s.mailbox, hostname)
 	// For implicit TLS, mark the connection as already TLS-enabled
 	if tlsConn, ok := conn.(*tls.Conn); ok {
 		tlsState := tlsConn.ConnectionState()
 		session.tlsState = &tlsState
+		session.logTLSInfo(&tlsState)
+		portConfig.identifyKeyLog(conn, keyLogComment(session.logger.GetSessionID(), conn))
 	}
 
 	// register active session so shutdown can close it
@@ -353,6 +497,62 @@ func (s *Server) handleTLSConnectionForPort(conn net.Conn, port int) {
 	}
 }
 
+// handshake performs the server side of an implicit TLS handshake.
+func (s *Server) handshake(tlsConn *tls.Conn) error {
+	parent := s.handshakeCtx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, TLSHandshakeTimeout)
+	defer cancel()
+	return tlsConn.HandshakeContext(ctx)
+}
+
+// admitConnection consults the configured RateLimiter for a newly accepted connection.
+// If the connection is allowed it is recorded and a release func is returned that must be
+// called when the session ends. If it is denied, the client receives a 421 4.7.0 greeting
+// and the connection is closed.
+func (s *Server) admitConnection(conn net.Conn, port int) (release func(), ok bool) {
+	limiter := s.config.RateLimiter
+	if limiter == nil {
+		return func() {}, true
+	}
+
+	clientIP := remoteIP(conn)
+	if allowed, reason := limiter.AllowConnection(clientIP); !allowed {
+		s.logger.Warn("Connection rejected by rate limiter",
+			logging.F("client_ip", clientIP),
+			logging.F("port", port),
+			logging.F("reason", reason))
+		if err := conn.SetWriteDeadline(time.Now().Add(maxWriteDeadline)); err != nil {
+			s.logger.Debug("failed to set write deadline for rate limit rejection", logging.F("err", err))
+		}
+		resp := fmt.Sprintf("%d %s %s", smtp.Code421, rateLimitConnectionEnhanced, reason)
+		if _, err := conn.Write([]byte(resp + "\r\n")); err != nil {
+			s.logger.Debug("failed to write rate limit rejection", logging.F("err", err))
+		}
+		if err := conn.Close(); err != nil {
+			s.logger.Debug("failed to close rate limited connection", logging.F("err", err))
+		}
+		return nil, false
+	}
+
+	limiter.RecordConnection(clientIP)
+	return func() { limiter.ReleaseConnection(clientIP) }, true
+}
+
+// remoteIP returns the client IP address of conn without the port.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
 // extractHostname attempts to extract the hostname from the connection
 func (s *Server) extractHostname(conn net.Conn) string {
 	// For SMTP, the hostname is typically the local address the client connected to
@@ -467,8 +667,14 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		return nil
 	}
 
-	// Stop accepting new connections
+	// Stop accepting new connections, and abort handshakes that have not become sessions
 	s.closeAllListeners()
+	if s.cancelHandshakes != nil {
+		s.cancelHandshakes()
+	}
+	for _, stop := range s.stopWatchers {
+		stop()
+	}
 
 	count := s.activeSessionCount()
 	if count == 0 {
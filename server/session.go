@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -62,8 +63,12 @@ type Capabilities struct {
 	EnhancedStatusCodes bool // ENHANCEDSTATUSCODES - uses enhanced status codes
 	SMTPUTF8            bool // SMTPUTF8 - supports UTF-8 in addresses
 	Chunking            bool // CHUNKING - supports BDAT command
+	BinaryMIME          bool // BINARYMIME - binary message bodies via BDAT (RFC 3030)
 	STARTTLS            bool // STARTTLS - TLS upgrade available
 	EightBitMIME        bool // 8BITMIME - 8-bit MIME support
+	Auth                bool // AUTH - at least one SASL mechanism advertised
+	ChannelBinding      bool // AUTH SCRAM-*-PLUS - channel binding mechanisms advertised
+	DSN                 bool // DSN - delivery status notifications (RFC 3461)
 }
 
 // Session represents a single SMTP client connection
@@ -75,6 +80,8 @@ type Session struct {
 	heloName      string
 	mailFrom      string
 	rcptTo        []string
+	mailParams    smtp.Parameters            // ESMTP parameters accepted on MAIL FROM
+	rcptParams    map[string]smtp.Parameters // ESMTP parameters accepted on RCPT TO, by recipient
 	authenticated bool
 	config        *Config
 	mailbox       *storage.Mailbox
@@ -84,6 +91,14 @@ type Session struct {
 	startTime     time.Time
 	capabilities  Capabilities           // SMTP extensions enabled for this session
 	metadata      map[string]interface{} // Custom metadata from extensions (e.g., parsed tokens from EHLO hostname)
+	user          *User                  // Authenticated user (nil until AUTH succeeds)
+	messagesSent  int                    // Number of messages accepted in this session
+	submission    submissionPolicy       // Submission (MSA) rules from the port or EHLO labels
+	tlsBehaviour  string                 // STARTTLS misbehaviour from a tls<behaviour> EHLO label
+
+	// Session event observers (Config.Observer + Config.Observers)
+	observer        *MultiObserver
+	observerClosers []*AsyncObserver
 
 	// Per-session command delay in seconds (set by EHLO dlay<N>)
 	commandDelay int
@@ -100,6 +115,7 @@ type Session struct {
 
 	// Error simulation results extracted from MAIL FROM and triggered at specific commands
 	dataErrorResult     *smtp.ErrorResult // Stores DATA error from MAIL FROM for delayed execution
+	bdatErrorResult     *smtp.ErrorResult // Stores BDAT error from MAIL FROM for delayed execution
 	rsetErrorResult     *smtp.ErrorResult // Stores RSET error from MAIL FROM for delayed execution
 	quitErrorResult     *smtp.ErrorResult // Stores QUIT error from MAIL FROM for delayed execution
 	startTLSErrorResult *smtp.ErrorResult // Stores STARTTLS error from MAIL FROM for delayed execution
@@ -125,18 +141,22 @@ func NewSessionWithHostname(conn net.Conn, config *Config, mailbox *storage.Mail
 		baseLogger = logging.NewStdoutLogger(&loggerConfig)
 	}
 	smtpLogger := logging.NewSMTPLogger(baseLogger, conn, hostname)
+	observer, observerClosers := config.sessionObservers()
 
 	session := &Session{
-		conn:           conn,
-		state:          smtp.StateGreeting,
-		config:         config,
-		mailbox:        mailbox,
-		hostname:       hostname,
-		logger:         smtpLogger,
-		startTime:      time.Now(),
-		advertisedSize: 0,                            // 0 means fallback to global MaxMessageSize
-		metadata:       make(map[string]interface{}), // Initialise metadata map for extensions
-	}
+		conn:            conn,
+		state:           smtp.StateGreeting,
+		config:          config,
+		mailbox:         mailbox,
+		hostname:        hostname,
+		logger:          smtpLogger,
+		startTime:       time.Now(),
+		advertisedSize:  0,                            // 0 means fallback to global MaxMessageSize
+		metadata:        make(map[string]interface{}), // Initialise metadata map for extensions
+		observer:        observer,
+		observerClosers: observerClosers,
+	}
+	session.applySubmissionPolicy(nil)
 
 	return session
 }
@@ -146,6 +166,7 @@ func (s *Session) Handle() error {
 	// Log connection establishment
 	tlsEnabled := s.tlsState != nil
 	s.logger.LogConnection(s.config.Port, tlsEnabled)
+	s.observer.OnConnect(s.sessionContext())
 
 	defer func() {
 		duration := time.Since(s.startTime)
@@ -153,6 +174,10 @@ func (s *Session) Handle() error {
 		if closeErr := s.conn.Close(); closeErr != nil {
 			s.logger.Error("Error closing connection", closeErr)
 		}
+		s.observer.OnDisconnect(s.sessionContext(), duration.String())
+		for _, c := range s.observerClosers {
+			c.Close()
+		}
 	}()
 
 	if err := s.setupSessionBehaviourAndGreet(); err != nil {
@@ -215,6 +240,7 @@ func (s *Session) runCommandLoop() error {
 				return nil
 			}
 			s.logger.Error("Error handling command", err, logging.F("command", line))
+			s.observer.OnError(s.sessionContext(), err, commandName(line))
 			return err
 		}
 	}
@@ -404,6 +430,7 @@ func (s *Session) commandHandlers() map[string]func(*smtp.Command) error {
 	return map[string]func(*smtp.Command) error{
 		smtp.CmdHELO:     func(c *smtp.Command) error { return s.handleHelo(c) },
 		smtp.CmdEHLO:     func(c *smtp.Command) error { return s.handleHelo(c) },
+		smtp.CmdLHLO:     func(c *smtp.Command) error { return s.handleHelo(c) },
 		smtp.CmdAUTH:     func(c *smtp.Command) error { return s.handleAuth(c) },
 		smtp.CmdMAIL:     func(c *smtp.Command) error { return s.handleMail(c) },
 		smtp.CmdRCPT:     func(c *smtp.Command) error { return s.handleRcpt(c) },
@@ -430,18 +457,25 @@ func (s *Session) handleHelo(cmd *smtp.Command) error {
 		return s.writeResponse("503 Bad sequence of commands")
 	}
 
+	// LMTP sessions must greet with LHLO, and LHLO is not an SMTP command (RFC 2033 section 4.1)
+	if s.config.LMTP != (cmd.Name == smtp.CmdLHLO) {
+		if s.config.LMTP {
+			return s.writeResponse("500 5.5.1 Command not recognised; use LHLO for LMTP")
+		}
+		return s.writeResponse("500 Command not recognised")
+	}
+
 	hostname := cmd.Args[0]
 	s.heloName = hostname
 
 	// Check for HELO/EHLO error patterns first
-	if errorResult := smtp.ExtractHeloError(hostname); errorResult != nil {
-		s.logger.LogErrorSimulation(errorResult.Code, hostname, cmd.Name)
-		return s.writeResponse(s.formatErrorResult(errorResult))
+	if errorResult := s.checkSimulatedError(hostname, cmd.Name); errorResult != nil {
+		return s.writeSimulatedError(errorResult, hostname, cmd.Name)
 	}
 
 	s.state = smtp.StateMail
 
-	if cmd.Name == smtp.CmdEHLO {
+	if cmd.Name == smtp.CmdEHLO || cmd.Name == smtp.CmdLHLO {
 		return s.handleEhlo(hostname)
 	}
 
@@ -482,6 +516,8 @@ func (s *Session) handleEhlo(hostname string) error {
 		}
 	}
 
+	parts = s.applyTLSBehaviour(parts)
+	s.applySubmissionPolicy(parts)
 	response := s.buildEhloResponseFromParts(hostname, parts)
 	return s.writeResponse(strings.Join(response, "\r\n"))
 }
@@ -522,10 +558,14 @@ func (s *Session) buildEhloResponse(hostname string) []string {
 
 // addStandardCapabilities adds all standard SMTP capabilities to the EHLO response.
 func (s *Session) addStandardCapabilities(response *[]string, parts []string) {
-	// AUTH - enabled by default
-	if !hasCapability(parts, "noauth") {
+	// AUTH - enabled by default, hidden before STARTTLS when the session requires TLS
+	s.capabilities.Auth = false
+	s.capabilities.ChannelBinding = false
+	if !hasCapability(parts, "noauth") && !s.authRequiresTLS() {
 		authMechanisms := s.getAuthMechanisms(parts)
 		if authMechanisms != "" {
+			s.capabilities.Auth = true
+			s.capabilities.ChannelBinding = strings.Contains(authMechanisms, "-PLUS")
 			*response = append(*response, fmt.Sprintf("%d-AUTH %s", smtp.Code250, authMechanisms))
 		}
 	}
@@ -536,6 +576,12 @@ func (s *Session) addStandardCapabilities(response *[]string, parts []string) {
 		*response = append(*response, fmt.Sprintf("%d-8BITMIME", smtp.Code250))
 	}
 
+	// DSN - enabled by default
+	s.capabilities.DSN = !hasCapability(parts, "nodsn")
+	if s.capabilities.DSN {
+		*response = append(*response, fmt.Sprintf("%d-DSN", smtp.Code250))
+	}
+
 	// SIZE - enabled by default, but allow hostname to set a custom value using `size<digits>`
 	s.capabilities.Size = !hasCapability(parts, "nosize")
 	if s.capabilities.Size {
@@ -565,6 +611,12 @@ func (s *Session) addStandardCapabilities(response *[]string, parts []string) {
 		*response = append(*response, fmt.Sprintf("%d-CHUNKING", smtp.Code250))
 	}
 
+	// BINARYMIME - enabled by default, but only offered together with CHUNKING (RFC 3030)
+	s.capabilities.BinaryMIME = s.capabilities.Chunking && !hasCapability(parts, "nobinarymime")
+	if s.capabilities.BinaryMIME {
+		*response = append(*response, fmt.Sprintf("%d-BINARYMIME", smtp.Code250))
+	}
+
 	// SMTPUTF8 - enabled by default
 	s.capabilities.SMTPUTF8 = !hasCapability(parts, "nosmtputf8")
 	if s.capabilities.SMTPUTF8 {
@@ -620,78 +672,171 @@ func (s *Session) handleAuth(cmd *smtp.Command) error {
 		return s.writeResponse("503 Bad sequence of commands")
 	}
 
+	// Submission mode refuses to accept credentials over cleartext (RFC 4954 section 4)
+	if s.authRequiresTLS() {
+		return s.writeResponse(s.formatStatus(smtp.Code538, "5.7.11", "Encryption required for requested authentication mechanism"))
+	}
+
 	// Check for AUTH error configured from MAIL FROM
 	if s.authErrorResult != nil {
-		s.logger.LogErrorSimulation(s.authErrorResult.Code, s.mailFrom, "AUTH")
-		return s.writeResponse(s.formatErrorResult(s.authErrorResult))
+		return s.writeSimulatedError(s.authErrorResult, s.mailFrom, "AUTH")
 	}
 
 	mech := cmd.Args[0]
-	handler := auth.NewHandler(mech)
+	handler := auth.NewHandlerWithOptions(mech, s.authHandlerOptions())
 	if handler == nil {
 		return s.writeResponse("504 Authentication mechanism not supported")
 	}
 
-	username, err := handler.Authenticate(s.conn, append([]string{cmd.Name}, cmd.Args...))
+	// Challenges and responses go through the session reader so pipelined bytes stay in
+	// order; the session is in StateAuth until the exchange completes
+	prevState := s.state
+	s.logger.LogStateTransition(prevState.String(), smtp.StateAuth.String(), "AUTH")
+	s.state = smtp.StateAuth
+	ex := auth.NewExchange(s, s.textReader())
+	creds, err := handler.Authenticate(ex, append([]string{cmd.Name}, cmd.Args...))
+	if err == nil {
+		err = auth.ApplyExchangePatterns(ex, creds)
+	}
+	s.state = prevState
+	if errors.Is(err, auth.ErrDropConnection) {
+		s.logger.LogAuthentication(mech, creds.Username, false)
+		s.logger.LogBehaviourTriggered("auth_drop", s.config.Port, 0)
+		return io.EOF
+	}
 	if err != nil {
+		username := ""
+		if creds != nil {
+			username = creds.Username
+		}
 		s.logger.LogAuthentication(mech, username, false)
+		s.observer.OnError(s.sessionContext(), err, smtp.CmdAUTH)
+		if errors.Is(err, auth.ErrCancelled) {
+			return s.writeResponse(s.formatStatus(smtp.Code501, "5.7.0", "Authentication cancelled"))
+		}
 		return s.writeResponse("535 Authentication failed")
 	}
+	username := creds.Username
+
+	// Usernames such as auth454@example.com choose the reply to the completed exchange
+	if errorResult := s.checkSimulatedError(username, ErrorCommandAuthUser); errorResult != nil {
+		s.logger.LogAuthentication(mech, username, false)
+		return s.writeSimulatedError(errorResult, username, "AUTH")
+	}
+
+	// For EXTERNAL, so do certificate common names such as cert535.relay.example.com
+	if creds.Certificate != nil {
+		if errorResult := s.clientCertError(); errorResult != nil {
+			s.logger.LogAuthentication(mech, username, false)
+			return s.writeSimulatedError(errorResult, creds.Certificate.Subject.CommonName, "AUTH")
+		}
+	}
 
 	// Use the extension Authenticator interface for validation
-	user, err := s.config.Authenticator.Authenticate(username, "")
+	user, err := s.authenticate(creds)
 	if err != nil {
 		s.logger.LogAuthentication(mech, username, false)
+		s.observer.OnError(s.sessionContext(), err, smtp.CmdAUTH)
 		return s.writeResponse("535 Authentication failed")
 	}
 
 	// Check if user is active
 	if !user.Active {
 		s.logger.LogAuthentication(mech, username, false)
+		s.observer.OnError(s.sessionContext(), fmt.Errorf("account inactive: %s", username), smtp.CmdAUTH)
 		return s.writeResponse("535 Authentication failed: account inactive")
 	}
 
 	s.authenticated = true
+	s.user = user
 	s.state = smtp.StateMail
 	s.logger.LogAuthentication(mech, username, true)
+	s.observer.OnAuth(s.sessionContext(), user)
 	return s.writeResponse("235 Authentication successful")
 }
 
+// authHandlerOptions returns the session state passed to SASL mechanisms.
+func (s *Session) authHandlerOptions() auth.HandlerOptions {
+	opts := auth.HandlerOptions{
+		TLSState:        s.tlsState,
+		ChannelBinding:  s.capabilities.ChannelBinding,
+		TokenValidator:  s.config.TokenValidator,
+		PeerCertificate: s.peerCertificate(),
+	}
+	if sp, ok := s.config.Authenticator.(SecretProvider); ok {
+		opts.LookupSecret = sp.LookupSecret
+	}
+	return opts
+}
+
+// authenticate checks creds with the configured Authenticator, passing the full
+// credentials when it implements CredentialsAuthenticator.
+func (s *Session) authenticate(creds *auth.Credentials) (*User, error) {
+	if ca, ok := s.config.Authenticator.(CredentialsAuthenticator); ok {
+		return ca.AuthenticateCredentials(creds)
+	}
+	return s.config.Authenticator.Authenticate(creds.Username, creds.Password)
+}
+
 func (s *Session) handleMail(cmd *smtp.Command) error {
 	if s.state != smtp.StateMail {
 		return s.writeResponse("503 Bad sequence of commands")
 	}
 
-	// Extract raw mailbox from argument
-	raw := smtp.ExtractMailboxFromArg(cmd.Args[0])
-	if raw == "" {
-		return s.writeResponse("501 Syntax error in parameters")
+	if s.submission.requireAuth && !s.authenticated {
+		return s.writeResponse(s.formatStatus(smtp.Code530, "5.7.0", "Authentication required"))
 	}
 
-	// Validate mailbox according to session capabilities (SMTPUTF8)
-	if !smtp.IsValidMailbox(raw, s.capabilities.SMTPUTF8) {
-		return s.writeResponse("501 Syntax error in parameters")
+	// Client certificate common names such as cert550.relay.example.com fail every MAIL
+	if errorResult := s.clientCertError(); errorResult != nil {
+		return s.writeSimulatedError(errorResult, s.peerCertificate().Subject.CommonName, "MAIL")
 	}
 
-	// Normalise for internal storage (preserve local-part case, lowercase domain)
-	fromAddr := smtp.NormaliseMailbox(raw)
+	// The null reverse-path (MAIL FROM:<>) is stored as an empty sender
+	fromAddr := ""
+	if !smtp.IsNullReversePath(cmd.Args[0]) {
+		// Extract raw mailbox from argument
+		raw := smtp.ExtractMailboxFromArg(cmd.Args[0])
+		if raw == "" {
+			return s.writeResponse("501 Syntax error in parameters")
+		}
+
+		// Validate mailbox according to session capabilities (SMTPUTF8)
+		if !smtp.IsValidMailbox(raw, s.capabilities.SMTPUTF8) {
+			return s.writeResponse("501 Syntax error in parameters")
+		}
+
+		// Normalise for internal storage (preserve local-part case, lowercase domain)
+		fromAddr = smtp.NormaliseMailbox(raw)
+	}
+
+	params, paramErr := s.checkParameters(smtp.CmdMAIL, cmd.Args[1:])
+	if paramErr != nil {
+		return s.writeResponse(s.formatStatus(paramErr.Code, paramErr.Enhanced, paramErr.Message))
+	}
 
 	// Check for MAIL FROM specific error patterns (mail452@example.com, mail550_571@example.com)
-	if errorResult := smtp.ExtractMailFromError(fromAddr); errorResult != nil {
-		s.logger.LogErrorSimulation(errorResult.Code, fromAddr, "MAIL")
-		return s.writeResponse(s.formatErrorResult(errorResult))
+	if errorResult := s.checkSimulatedError(fromAddr, smtp.CmdMAIL); errorResult != nil {
+		return s.writeSimulatedError(errorResult, fromAddr, "MAIL")
+	}
+
+	// Authenticated users may only use sender addresses their Authorizer permits
+	if s.authenticated && s.config.Authorizer != nil && !s.config.Authorizer.CanSendFrom(s.user, fromAddr) {
+		return s.writeAuthorizationFailure(smtp.CmdMAIL, fmt.Sprintf("Sender address %s not authorised for this user", fromAddr))
 	}
 
 	// Extract ALL error patterns from MAIL FROM for delayed execution at their respective commands
 	// This allows one MAIL FROM address to configure errors for multiple commands
-	s.dataErrorResult = smtp.ExtractDataError(fromAddr)
-	s.rsetErrorResult = smtp.ExtractRsetError(fromAddr)
-	s.quitErrorResult = smtp.ExtractQuitError(fromAddr)
-	s.startTLSErrorResult = smtp.ExtractStartTLSError(fromAddr)
-	s.noopErrorResult = smtp.ExtractNoopError(fromAddr)
-	s.authErrorResult = smtp.ExtractAuthError(fromAddr)
+	s.dataErrorResult = s.checkSimulatedError(fromAddr, smtp.CmdDATA)
+	s.bdatErrorResult = s.checkSimulatedError(fromAddr, smtp.CmdBDAT)
+	s.rsetErrorResult = s.checkSimulatedError(fromAddr, smtp.CmdRSET)
+	s.quitErrorResult = s.checkSimulatedError(fromAddr, smtp.CmdQUIT)
+	s.startTLSErrorResult = s.checkSimulatedError(fromAddr, smtp.CmdSTARTTLS)
+	s.noopErrorResult = s.checkSimulatedError(fromAddr, smtp.CmdNOOP)
+	s.authErrorResult = s.checkSimulatedError(fromAddr, smtp.CmdAUTH)
 
 	s.mailFrom = fromAddr
+	s.mailParams = params
 	s.logger.LogStateTransition(s.state.String(), smtp.StateRcpt.String(), "MAIL")
 	s.state = smtp.StateRcpt
 	return s.writeResponse("250 OK")
@@ -708,21 +853,41 @@ func (s *Session) handleRcpt(cmd *smtp.Command) error {
 		return s.writeResponse("501 Syntax error in parameters")
 	}
 
-	// Validate mailbox according to session capabilities (SMTPUTF8)
-	if !smtp.IsValidMailbox(raw, s.capabilities.SMTPUTF8) {
-		return s.writeResponse("501 Syntax error in parameters")
+	var toAddr string
+	if smtp.IsPostmaster(raw) {
+		// RCPT TO:<postmaster> must be accepted without a domain (RFC 5321 section 4.5.1)
+		toAddr = smtp.PostmasterMailbox
+	} else {
+		// Validate mailbox according to session capabilities (SMTPUTF8)
+		if !smtp.IsValidMailbox(raw, s.capabilities.SMTPUTF8) {
+			return s.writeResponse("501 Syntax error in parameters")
+		}
+
+		// Normalise for internal use
+		toAddr = smtp.NormaliseMailbox(raw)
 	}
 
-	// Normalise for internal use
-	toAddr := smtp.NormaliseMailbox(raw)
+	params, paramErr := s.checkParameters(smtp.CmdRCPT, cmd.Args[1:])
+	if paramErr != nil {
+		return s.writeResponse(s.formatStatus(paramErr.Code, paramErr.Enhanced, paramErr.Message))
+	}
 
 	// Check for RCPT TO specific error patterns first (rcpt452@example.com, rcpt550_571@example.com)
-	if errorResult := smtp.ExtractRcptToError(toAddr); errorResult != nil {
-		s.logger.LogErrorSimulation(errorResult.Code, toAddr, "RCPT")
-		return s.writeResponse(s.formatErrorResult(errorResult))
+	if errorResult := s.checkSimulatedError(toAddr, smtp.CmdRCPT); errorResult != nil {
+		return s.writeSimulatedError(errorResult, toAddr, "RCPT")
+	}
+
+	if s.authenticated && s.config.Authorizer != nil && !s.config.Authorizer.CanSendTo(s.user, toAddr) {
+		return s.writeAuthorizationFailure(smtp.CmdRCPT, fmt.Sprintf("Recipient address %s not authorised for this user", toAddr))
 	}
 
 	s.rcptTo = append(s.rcptTo, toAddr)
+	if len(params) > 0 {
+		if s.rcptParams == nil {
+			s.rcptParams = make(map[string]smtp.Parameters)
+		}
+		s.rcptParams[toAddr] = params
+	}
 	// Stay in StateRcpt to allow multiple recipients
 	return s.writeResponse("250 OK")
 }
@@ -790,10 +955,19 @@ func (s *Session) handleData() error {
 		return s.writeResponse("503 Bad sequence of commands")
 	}
 
+	// A BINARYMIME body can only be sent with BDAT (RFC 3030 section 3)
+	if strings.EqualFold(s.mailParams.Get(smtp.ParamBody), smtp.BodyBinaryMIME) {
+		return s.writeResponse(s.formatStatus(smtp.Code503, "5.5.1", "DATA not permitted for BODY=BINARYMIME; use BDAT"))
+	}
+
 	// Check for DATA error set up from MAIL FROM command first
 	if s.dataErrorResult != nil {
-		s.logger.LogErrorSimulation(s.dataErrorResult.Code, s.mailFrom, "DATA")
-		return s.writeResponse(s.formatErrorResult(s.dataErrorResult))
+		return s.writeSimulatedError(s.dataErrorResult, s.mailFrom, "DATA")
+	}
+
+	// Consult the rate limiter before accepting message content
+	if allowed, reason := s.allowMessage(); !allowed {
+		return s.writeRateLimited(reason, smtp.CmdDATA)
 	}
 
 	// Log message start
@@ -813,17 +987,87 @@ func (s *Session) handleData() error {
 		return err
 	}
 
+	if !s.withinQuota(len(messageContent)) {
+		s.resetSessionState()
+		return s.writeQuotaExceeded(smtp.CmdDATA)
+	}
+
+	return s.completeTransaction(messageContent)
+}
+
+// completeTransaction stores an accepted message and sends the final reply for the
+// transaction: a single reply in SMTP mode, or one per recipient in LMTP mode.
+func (s *Session) completeTransaction(content string) error {
+	content = s.fixSubmittedMessage(content)
+	if s.config.LMTP {
+		return s.completeLMTPTransaction(content)
+	}
+
 	// Store the message using the injected handler
-	if err := s.storeMessage(messageContent); err != nil {
+	if err := s.storeMessage(content); err != nil {
 		return s.handleStorageError(err)
 	}
 
 	// Reset session state for next message
+	s.bdatBuffer = nil
 	s.resetSessionState()
 
 	return s.writeResponse("250 OK Message accepted for delivery")
 }
 
+// completeLMTPTransaction sends one reply per accepted recipient, in RCPT order
+// (RFC 2033 section 4.2). Recipients matching a rcptdata<NNN>@ pattern fail with that
+// reply; the message is stored once for the remaining recipients.
+func (s *Session) completeLMTPTransaction(content string) error {
+	recipients := s.rcptTo
+	replies := make([]string, len(recipients))
+	failed := make([]bool, len(recipients))
+	var delivered []string
+	for i, rcpt := range recipients {
+		if result := s.checkSimulatedError(rcpt, ErrorCommandRcptData); result != nil {
+			s.reportSimulatedError(result, rcpt, smtp.CmdDATA)
+			replies[i] = s.formatErrorResult(result)
+			failed[i] = true
+			continue
+		}
+		delivered = append(delivered, rcpt)
+		replies[i] = s.formatStatus(smtp.Code250, "2.1.5", fmt.Sprintf("<%s> Message accepted for delivery", rcpt))
+	}
+
+	if len(delivered) > 0 {
+		s.rcptTo = delivered
+		if err := s.storeMessage(content); err != nil {
+			failure := s.storageErrorResponse(err)
+			for i := range recipients {
+				if !failed[i] {
+					replies[i] = failure
+				}
+			}
+		}
+	}
+
+	s.bdatBuffer = nil
+	s.resetSessionState()
+
+	for _, reply := range replies {
+		if err := s.writeResponse(reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// textReader returns the session's shared line reader, creating it if needed.
+func (s *Session) textReader() *textproto.Reader {
+	if s.connReader == nil {
+		s.connReader = bufio.NewReader(s.conn)
+	}
+	if s.connTP == nil {
+		s.connTP = textproto.NewReader(s.connReader)
+	}
+	return s.connTP
+}
+
 // readMessageContent reads the message content from the connection with size limits
 func (s *Session) readMessageContent() (string, error) {
 	// Use textproto.Reader.ReadDotBytes which correctly handles the SMTP dot-stuffing and termination
@@ -885,10 +1129,16 @@ func (s *Session) storeMessage(content string) error {
 		Headers:   headers,
 		Size:      len(content),
 		ClientIP:  s.logger.GetClientIP(),
-		Hostname:  s.hostname,
+		Hostname:  s.routingHostname(),
 		TLSUsed:   s.tlsState != nil,
 		Timestamp: time.Now().Format(time.RFC3339),
+		BodyType:  s.bodyType(),
+
+		MailParams: s.mailParams,
+		RcptParams: s.recipientParams(),
+		Metadata:   s.metadataSnapshot(),
 	}
+	msg.ClientCertSubject, msg.ClientCertSANs = s.clientCertInfo()
 	// If we successfully parsed bodyBytes, update Size to reflect body length instead
 	if len(bodyBytes) > 0 {
 		msg.Size = len(bodyBytes)
@@ -902,22 +1152,37 @@ func (s *Session) storeMessage(content string) error {
 
 	if err != nil {
 		s.logger.LogMessageStorageError(s.mailFrom, s.rcptTo, msg.Size, storageType, err)
+		s.observer.OnError(s.sessionContext(), err, smtp.CmdDATA)
 		return err
 	}
 
 	s.logger.LogMessageStored(s.mailFrom, s.rcptTo, msg.Size, storageType, duration)
+	if s.config.RateLimiter != nil {
+		s.config.RateLimiter.RecordMessage(s.user, s.logger.GetClientIP())
+	}
+	if recorder, ok := s.config.Authorizer.(QuotaRecorder); ok && s.authenticated {
+		recorder.RecordUsage(s.user, int64(len(content)))
+	}
+	s.messagesSent++
+	s.observer.OnMessage(s.sessionContext(), msg)
+	s.generateDSNs(msg)
 	return nil
 }
 
 // handleStorageError converts storage errors to appropriate SMTP responses
 func (s *Session) handleStorageError(err error) error {
+	return s.writeResponse(s.storageErrorResponse(err))
+}
+
+// storageErrorResponse returns the SMTP response for a storage error.
+func (s *Session) storageErrorResponse(err error) string {
 	if strings.Contains(err.Error(), "not active") {
-		return s.writeResponse("550 Requested action not taken: mailbox unavailable")
+		return "550 Requested action not taken: mailbox unavailable"
 	}
 	if strings.Contains(err.Error(), "quota") {
-		return s.writeResponse("452 Requested action not taken: insufficient system storage")
+		return "452 Requested action not taken: insufficient system storage"
 	}
-	return s.writeResponse("450 Requested action not taken: mailbox temporarily unavailable")
+	return "450 Requested action not taken: mailbox temporarily unavailable"
 }
 
 // resetSessionState resets the session state for the next message
@@ -926,9 +1191,12 @@ func (s *Session) resetSessionState() {
 	s.state = smtp.StateMail
 	s.rcptTo = nil
 	s.mailFrom = ""
+	s.mailParams = nil
+	s.rcptParams = nil
 
 	// Reset all error simulation results for next message
 	s.dataErrorResult = nil
+	s.bdatErrorResult = nil
 	s.rsetErrorResult = nil
 	s.quitErrorResult = nil
 	s.startTLSErrorResult = nil
@@ -939,23 +1207,23 @@ func (s *Session) resetSessionState() {
 func (s *Session) handleRset() error {
 	// Check for RSET error configured from MAIL FROM
 	if s.rsetErrorResult != nil {
-		s.logger.LogErrorSimulation(s.rsetErrorResult.Code, s.mailFrom, "RSET")
 		// Don't reset state on error - let the client try again
-		return s.writeResponse(s.formatErrorResult(s.rsetErrorResult))
+		return s.writeSimulatedError(s.rsetErrorResult, s.mailFrom, "RSET")
 	}
 
 	s.logger.LogStateTransition(s.state.String(), smtp.StateMail.String(), "RSET")
 	s.state = smtp.StateMail
 	s.mailFrom = ""
 	s.rcptTo = nil
+	s.mailParams = nil
+	s.rcptParams = nil
 	return s.writeResponse("250 OK")
 }
 
 func (s *Session) handleNoop() error {
 	// Check for NOOP error configured from MAIL FROM
 	if s.noopErrorResult != nil {
-		s.logger.LogErrorSimulation(s.noopErrorResult.Code, s.mailFrom, "NOOP")
-		return s.writeResponse(s.formatErrorResult(s.noopErrorResult))
+		return s.writeSimulatedError(s.noopErrorResult, s.mailFrom, "NOOP")
 	}
 
 	return s.writeResponse("250 OK")
@@ -987,81 +1255,110 @@ func (s *Session) setupSessionBehaviourAndGreet() error {
 		identity = s.config.TLSHostname
 	}
 
-	if err := s.writeResponse(fmt.Sprintf("%d %s ESMTP %s", smtp.Code220, identity, ServerGreeting)); err != nil {
+	protocol := "ESMTP"
+	if s.config.LMTP {
+		protocol = "LMTP"
+	}
+	if err := s.writeResponse(fmt.Sprintf("%d %s %s %s", smtp.Code220, identity, protocol, ServerGreeting)); err != nil {
 		return err
 	}
 	s.state = smtp.StateHelo
 	return nil
 }
 
-// obtainTLSCertificate loads TLS certs from files or generates a self-signed certificate.
+// obtainTLSCertificate returns the configured certificate matching hostname, or issues
+// one from the local CA.
 func (s *Session) obtainTLSCertificate(hostname string) (tls.Certificate, error) {
-	var cert tls.Certificate
-	var err error
-	if s.config.HasTLS() {
-		cert, err = tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
-		if err != nil {
-			s.logger.Warn("Failed to load TLS certificate from files, generating self-signed",
-				logging.F("hostname", hostname),
-				logging.F("cert_file", s.config.TLSCertFile),
-				logging.F("key_file", s.config.TLSKeyFile))
-			cert, err = s.config.GenerateSelfSignedCert(hostname)
-			if err != nil {
-				return tls.Certificate{}, fmt.Errorf("failed to generate self-signed certificate: %v", err)
-			}
+	cert, err := s.config.serverCertificate(hostname)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to issue certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// startTLSConfig returns the TLS configuration for STARTTLS. The certificate is chosen
+// for the client's SNI name, or for hostname when the client sends none.
+func (s *Session) startTLSConfig(hostname string) *tls.Config {
+	tlsConfig := s.config.newSTARTTLSConfig()
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := hello.ServerName
+		if name == "" {
+			name = hostname
 		}
-	} else {
-		cert, err = s.config.GenerateSelfSignedCert(hostname)
+		cert, err := s.obtainTLSCertificate(name)
 		if err != nil {
-			return tls.Certificate{}, fmt.Errorf("failed to generate self-signed certificate: %v", err)
+			return nil, err
 		}
+		return &cert, nil
 	}
-	return cert, nil
+	return tlsConfig
 }
 
-// upgradeToTLS performs the TLS handshake, updates the session connection and logs the result.
+// upgradeToTLS performs the TLS handshake with cert, updates the session connection and logs the result.
 func (s *Session) upgradeToTLS(cert *tls.Certificate) error {
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{*cert},
-		MinVersion:   tls.VersionTLS12,
-	}
+	tlsConfig := s.config.newSTARTTLSConfig()
+	tlsConfig.Certificates = []tls.Certificate{*cert}
+	return s.handshakeTLS(tlsConfig)
+}
 
+// handshakeTLS performs the TLS handshake with tlsConfig, updates the session connection
+// and logs the result.
+func (s *Session) handshakeTLS(tlsConfig *tls.Config) error {
+	if s.config.KeyLog != nil {
+		tlsConfig.KeyLogWriter = s.config.KeyLog.forSession(keyLogComment(s.logger.GetSessionID(), s.conn))
+	}
 	tlsConn := tls.Server(s.conn, tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), TLSHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
 		s.logger.LogTLSHandshake(false, "", "", err)
 		return fmt.Errorf("TLS handshake failed: %v", err)
 	}
 
 	s.conn = tlsConn
+	// Read everything after the handshake through TLS. Plaintext the client sent after
+	// STARTTLS is discarded rather than treated as commands (RFC 3207 section 6).
+	s.connReader = bufio.NewReader(s.conn)
+	s.connTP = textproto.NewReader(s.connReader)
 	tlsState := tlsConn.ConnectionState()
 	s.tlsState = &tlsState
 	s.logTLSInfo(&tlsState)
 	return nil
 }
 
-// logTLSInfo extracts friendly TLS version and cipher names and logs the handshake success.
+// logTLSInfo extracts friendly TLS version, cipher and curve names and logs the handshake
+// success, with whether the session was resumed and the client's SNI name.
 func (s *Session) logTLSInfo(tlsState *tls.ConnectionState) {
 	tlsVersion := "unknown"
 	cipher := "unknown"
-	if tlsState != nil && tlsState.Version != 0 {
-		switch tlsState.Version {
-		case tls.VersionTLS12:
-			tlsVersion = "TLS 1.2"
-		case tls.VersionTLS13:
-			tlsVersion = "TLS 1.3"
-		}
+	if tlsState == nil {
+		s.logger.LogTLSHandshake(true, tlsVersion, cipher, nil)
+		return
+	}
+	if tlsState.Version != 0 {
+		// VersionName names SSL 3.0 to TLS 1.3, and formats anything else as hex
+		tlsVersion = tls.VersionName(tlsState.Version)
 	}
-	if tlsState != nil && tlsState.CipherSuite != 0 {
+	if tlsState.CipherSuite != 0 {
 		cipher = tls.CipherSuiteName(tlsState.CipherSuite)
 	}
-	s.logger.LogTLSHandshake(true, tlsVersion, cipher, nil)
+	fields := []logging.Field{logging.F("resumed", tlsState.DidResume)}
+	if tlsState.CurveID != 0 {
+		fields = append(fields, logging.F("curve", tlsState.CurveID.String()))
+	}
+	if tlsState.ServerName != "" {
+		fields = append(fields, logging.F("sni", tlsState.ServerName))
+	}
+	if tlsState.NegotiatedProtocol != "" {
+		fields = append(fields, logging.F("alpn", tlsState.NegotiatedProtocol))
+	}
+	s.logger.LogTLSHandshake(true, tlsVersion, cipher, nil, fields...)
 }
 
 func (s *Session) handleStartTLS() error {
 	// Check for STARTTLS error configured from MAIL FROM
 	if s.startTLSErrorResult != nil {
-		s.logger.LogErrorSimulation(s.startTLSErrorResult.Code, s.mailFrom, "STARTTLS")
-		return s.writeResponse(s.formatErrorResult(s.startTLSErrorResult))
+		return s.writeSimulatedError(s.startTLSErrorResult, s.mailFrom, "STARTTLS")
 	}
 
 	if s.tlsState != nil {
@@ -1078,15 +1375,18 @@ func (s *Session) handleStartTLS() error {
 		hostname = s.config.GetTLSHostname()
 	}
 
-	// Generate or load certificate for hostname
-	cert, err := s.obtainTLSCertificate(hostname)
-	if err != nil {
-		s.logger.LogTLSHandshake(false, "", "", err)
-		return err
+	// Misbehave as selected by a tls<behaviour> EHLO label
+	if s.tlsBehaviour != "" {
+		if err := s.startTLSWithBehaviour(hostname); err != nil {
+			return err
+		}
+		s.logger.LogStateTransition(s.state.String(), smtp.StateHelo.String(), "STARTTLS")
+		s.state = smtp.StateHelo
+		return nil
 	}
 
-	// Perform TLS upgrade
-	if err := s.upgradeToTLS(&cert); err != nil {
+	// Perform TLS upgrade with the certificate for the SNI or EHLO hostname
+	if err := s.handshakeTLS(s.startTLSConfig(hostname)); err != nil {
 		return err
 	}
 
@@ -1098,8 +1398,7 @@ func (s *Session) handleStartTLS() error {
 func (s *Session) handleQuit() error {
 	// Check for QUIT error configured from MAIL FROM
 	if s.quitErrorResult != nil {
-		s.logger.LogErrorSimulation(s.quitErrorResult.Code, s.mailFrom, "QUIT")
-		if err := s.writeResponse(s.formatErrorResult(s.quitErrorResult)); err != nil {
+		if err := s.writeSimulatedError(s.quitErrorResult, s.mailFrom, "QUIT"); err != nil {
 			return err
 		}
 		// Still close the connection after error
@@ -1295,7 +1594,11 @@ func (s *Session) getAuthMechanisms(parts []string) string {
 		} else if strings.Contains(part, "authcram") {
 			lastAuth = "CRAM-MD5 CRAM-SHA256"
 		} else if strings.Contains(part, "authoauth") {
-			lastAuth = "XOAUTH2"
+			lastAuth = "XOAUTH2 OAUTHBEARER"
+		} else if strings.Contains(part, "authscram") {
+			lastAuth = s.scramMechanisms()
+		} else if strings.Contains(part, "authntlm") {
+			lastAuth = "NTLM"
 		}
 	}
 
@@ -1304,8 +1607,21 @@ func (s *Session) getAuthMechanisms(parts []string) string {
 		return lastAuth
 	}
 
-	// Default: all mechanisms
-	return "PLAIN LOGIN CRAM-MD5 CRAM-SHA256 XOAUTH2"
+	// Default: all mechanisms, with EXTERNAL once the client has a verified certificate
+	mechanisms := "PLAIN LOGIN CRAM-MD5 CRAM-SHA256 XOAUTH2 OAUTHBEARER " + s.scramMechanisms()
+	if s.peerCertificate() != nil {
+		mechanisms += " EXTERNAL"
+	}
+	return mechanisms
+}
+
+// scramMechanisms returns the SCRAM mechanisms to advertise. The -PLUS channel binding
+// variants are only offered over TLS.
+func (s *Session) scramMechanisms() string {
+	if s.tlsState != nil {
+		return "SCRAM-SHA-1 SCRAM-SHA-256 SCRAM-SHA-1-PLUS SCRAM-SHA-256-PLUS"
+	}
+	return "SCRAM-SHA-1 SCRAM-SHA-256"
 }
 
 // getMaxMessageSize returns the effective maximum message size for the session.
@@ -1366,10 +1682,219 @@ func (s *Session) formatErrorResult(err *smtp.ErrorResult) string {
 	// Always return a 3-digit response code first. If enhanced status codes
 	// are enabled for this session and an enhanced code is available, include it.
 	if s.capabilities.EnhancedStatusCodes && err.Enhanced != "" {
-		return fmt.Sprintf("%d %s %s", err.Code, err.Enhanced, smtp.GetErrorMessage(err.Code))
+		return fmt.Sprintf("%d %s %s", err.Code, err.Enhanced, err.ResponseText())
+	}
+	// Default: numeric code followed by the response text
+	return fmt.Sprintf("%d %s", err.Code, err.ResponseText())
+}
+
+// writeSimulatedError logs a pattern-triggered error, notifies observers and sends the
+// formatted response to the client.
+func (s *Session) writeSimulatedError(result *smtp.ErrorResult, trigger, command string) error {
+	s.reportSimulatedError(result, trigger, command)
+	return s.writeResponse(s.formatErrorResult(result))
+}
+
+// reportSimulatedError logs a pattern-triggered error and notifies observers.
+func (s *Session) reportSimulatedError(result *smtp.ErrorResult, trigger, command string) {
+	s.logger.LogErrorSimulation(result.Code, trigger, command)
+	s.observer.OnError(s.sessionContext(), &SimulatedError{
+		Code:     result.Code,
+		Enhanced: result.Enhanced,
+		Trigger:  trigger,
+	}, command)
+}
+
+// allowMessage asks the configured RateLimiter whether another message may be accepted.
+func (s *Session) allowMessage() (allowed bool, reason string) {
+	if s.config.RateLimiter == nil {
+		return true, ""
+	}
+	return s.config.RateLimiter.AllowMessage(s.user, s.logger.GetClientIP())
+}
+
+// writeRateLimited sends a 450 4.7.1 response for a message rejected by the rate limiter.
+func (s *Session) writeRateLimited(reason, command string) error {
+	s.logger.Warn("Message rejected by rate limiter",
+		logging.F("client_ip", s.logger.GetClientIP()),
+		logging.F("reason", reason))
+	s.observer.OnError(s.sessionContext(), fmt.Errorf("%s", reason), command)
+	return s.writeResponse(s.formatStatus(smtp.Code450, rateLimitMessageEnhanced, reason))
+}
+
+// writeAuthorizationFailure sends a 550 5.7.1 response for an address the Authorizer rejected.
+func (s *Session) writeAuthorizationFailure(command, text string) error {
+	s.logger.Warn("Address rejected by authorizer",
+		logging.F("client_ip", s.logger.GetClientIP()),
+		logging.F("command", command),
+		logging.F("reason", text))
+	s.observer.OnError(s.sessionContext(), fmt.Errorf("%s", text), command)
+	return s.writeResponse(s.formatStatus(smtp.Code550, "5.7.1", text))
+}
+
+// withinQuota reports whether a message of size bytes fits the authenticated user's
+// remaining quota. Unauthenticated sessions and unlimited quotas (-1) always fit.
+func (s *Session) withinQuota(size int) bool {
+	if !s.authenticated || s.config.Authorizer == nil {
+		return true
+	}
+	quota := s.config.Authorizer.GetQuota(s.user)
+	return quota < 0 || int64(size) <= quota
+}
+
+// writeQuotaExceeded sends a 552 5.2.2 response for a message over the user's quota.
+func (s *Session) writeQuotaExceeded(command string) error {
+	s.logger.Warn("Message rejected: quota exceeded",
+		logging.F("client_ip", s.logger.GetClientIP()),
+		logging.F("command", command))
+	s.observer.OnError(s.sessionContext(), fmt.Errorf("quota exceeded"), command)
+	return s.writeResponse(s.formatStatus(smtp.Code552, "5.2.2", "Quota exceeded"))
+}
+
+// formatStatus builds a response line, including the enhanced status code only when
+// ENHANCEDSTATUSCODES is enabled for this session.
+func (s *Session) formatStatus(code int, enhanced, text string) string {
+	if s.capabilities.EnhancedStatusCodes && enhanced != "" {
+		return fmt.Sprintf("%d %s %s", code, enhanced, text)
+	}
+	return fmt.Sprintf("%d %s", code, text)
+}
+
+// sessionContext returns a snapshot of the session for observers. A fresh value is built
+// for every event so that asynchronous observers never see later mutations.
+func (s *Session) sessionContext() *SessionContext {
+	certSubject, certSANs := s.clientCertInfo()
+	return &SessionContext{
+		ID:            s.logger.GetSessionID(),
+		ClientIP:      s.logger.GetClientIP(),
+		Hostname:      s.hostname,
+		User:          s.user,
+		Authenticated: s.authenticated,
+		TLSActive:     s.tlsState != nil,
+		MessagesSent:  s.messagesSent,
+		Metadata:      s.metadataSnapshot(),
+
+		ClientCertSubject: certSubject,
+		ClientCertSANs:    certSANs,
+	}
+}
+
+// metadataSnapshot returns a copy of the session metadata.
+func (s *Session) metadataSnapshot() map[string]interface{} {
+	metadata := make(map[string]interface{}, len(s.metadata))
+	for k, v := range s.metadata {
+		metadata[k] = v
 	}
-	// Default: numeric code followed by standard message
-	return fmt.Sprintf("%d %s", err.Code, smtp.GetErrorMessage(err.Code))
+	return metadata
+}
+
+// checkParameters parses the ESMTP parameters of a MAIL or RCPT command and checks each
+// one against the extensions advertised to this session: unknown parameters, or ones
+// whose extension is disabled (e.g. BODY= with no8bit), are refused with 555 5.5.4 and
+// a declared SIZE above the session limit with 552 5.3.4.
+func (s *Session) checkParameters(command string, args []string) (smtp.Parameters, *smtp.ParamError) {
+	var paramErr *smtp.ParamError
+	params, err := smtp.ParseParameters(args)
+	if errors.As(err, &paramErr) {
+		return nil, paramErr
+	}
+	for keyword, value := range params {
+		if err := smtp.ValidateParameter(command, keyword, value); errors.As(err, &paramErr) {
+			return nil, paramErr
+		}
+		if !s.parameterEnabled(keyword, value) {
+			return nil, smtp.UnsupportedParamError(keyword)
+		}
+	}
+	if size := params.Get(smtp.ParamSize); size != "" {
+		if declared, err := strconv.ParseInt(size, 10, 64); err != nil || declared > int64(s.getMaxMessageSize()) {
+			return nil, &smtp.ParamError{Code: smtp.Code552, Enhanced: "5.3.4", Message: "Message size exceeds fixed maximum message size"}
+		}
+	}
+	return params, nil
+}
+
+// parameterEnabled reports whether the extension providing an ESMTP parameter was
+// advertised in this session's EHLO response.
+func (s *Session) parameterEnabled(keyword, value string) bool {
+	switch keyword {
+	case smtp.ParamSize:
+		return s.capabilities.Size
+	case smtp.ParamBody:
+		if strings.EqualFold(value, smtp.BodyBinaryMIME) {
+			return s.capabilities.BinaryMIME
+		}
+		return s.capabilities.EightBitMIME
+	case smtp.ParamSMTPUTF8:
+		return s.capabilities.SMTPUTF8
+	case smtp.ParamAuth:
+		return s.capabilities.Auth
+	case smtp.ParamRet, smtp.ParamEnvID, smtp.ParamNotify, smtp.ParamOrcpt:
+		return s.capabilities.DSN
+	}
+	return false
+}
+
+// bodyType returns the body type declared with MAIL FROM BODY=, upper-cased, or 7BIT
+// when none was declared (RFC 6152 section 2).
+func (s *Session) bodyType() string {
+	if body := s.mailParams.Get(smtp.ParamBody); body != "" {
+		return strings.ToUpper(body)
+	}
+	return smtp.Body7Bit
+}
+
+// recipientParams returns the accepted RCPT TO parameters as plain maps for Message.
+func (s *Session) recipientParams() map[string]map[string]string {
+	if len(s.rcptParams) == 0 {
+		return nil
+	}
+	out := make(map[string]map[string]string, len(s.rcptParams))
+	for rcpt, params := range s.rcptParams {
+		out[rcpt] = params
+	}
+	return out
+}
+
+// routingHostname returns the hostname a message was received for, used for mailbox
+// routing. In order of preference: the TLS SNI name (implicit TLS or STARTTLS), the
+// reverse-DNS name of the local address, then the EHLO/HELO name. The local address or a
+// generic name such as "localhost" is only used when none of these is known.
+func (s *Session) routingHostname() string {
+	if s.tlsState != nil && s.tlsState.ServerName != "" {
+		return s.tlsState.ServerName
+	}
+	if !isGenericHostname(s.hostname) {
+		return s.hostname
+	}
+	if s.heloName != "" {
+		return s.heloName
+	}
+	return s.hostname
+}
+
+// isGenericHostname reports whether a local hostname names no particular mail domain: it
+// is empty, an IP address, or a loopback name as found in /etc/hosts, which the reverse
+// DNS of a loopback address usually resolves to.
+func isGenericHostname(hostname string) bool {
+	name := strings.ToLower(strings.TrimSuffix(hostname, "."))
+	switch {
+	case name == "", net.ParseIP(name) != nil:
+		return true
+	case name == "localhost", strings.HasSuffix(name, ".localhost"), strings.HasPrefix(name, "localhost."):
+		return true
+	case name == "ip6-localhost", name == "ip6-loopback":
+		return true
+	}
+	return false
+}
+
+// commandName returns the upper-cased command verb of a raw command line.
+func commandName(line string) string {
+	if name, _, _ := strings.Cut(strings.TrimSpace(line), " "); name != "" {
+		return strings.ToUpper(name)
+	}
+	return ""
 }
 
 // handleBdat implements BDAT chunk handling for CHUNKING extension support.
@@ -1390,10 +1915,12 @@ func (s *Session) handleBdat(cmd *smtp.Command) error {
 		last = true
 	}
 
-	// Check for DATA error configured from MAIL FROM (only relevant on final chunk)
-	if s.dataErrorResult != nil && last {
-		s.logger.LogErrorSimulation(s.dataErrorResult.Code, s.mailFrom, "BDAT")
-		return s.writeResponse(s.formatErrorResult(s.dataErrorResult))
+	// Check for BDAT (or DATA) error configured from MAIL FROM (only relevant on final chunk)
+	if result := s.bdatErrorResult; last && (result != nil || s.dataErrorResult != nil) {
+		if result == nil {
+			result = s.dataErrorResult
+		}
+		return s.writeSimulatedError(result, s.mailFrom, "BDAT")
 	}
 
 	// Enforce maximum message size
@@ -1415,18 +1942,25 @@ func (s *Session) handleBdat(cmd *smtp.Command) error {
 		return err
 	}
 
+	// The rate limiter is consulted on the first chunk of each message; the chunk has
+	// already been consumed so the connection stays in sync with the client.
+	if len(s.bdatBuffer) == 0 && s.state == smtp.StateRcpt {
+		if allowed, reason := s.allowMessage(); !allowed {
+			return s.writeRateLimited(reason, smtp.CmdBDAT)
+		}
+	}
+
 	// Append to buffer
 	s.bdatBuffer = append(s.bdatBuffer, chunk...)
 
 	// If LAST, finalise message: store the message and reset state
 	if last {
-		content := string(s.bdatBuffer)
-		if err := s.storeMessage(content); err != nil {
-			return s.handleStorageError(err)
+		if !s.withinQuota(len(s.bdatBuffer)) {
+			s.bdatBuffer = nil
+			s.resetSessionState()
+			return s.writeQuotaExceeded(smtp.CmdBDAT)
 		}
-		s.bdatBuffer = nil
-		s.resetSessionState()
-		return s.writeResponse("250 OK Message accepted for delivery")
+		return s.completeTransaction(string(s.bdatBuffer))
 	}
 
 	// If not LAST, remain in Bdat state and acknowledge
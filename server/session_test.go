@@ -254,6 +254,53 @@ func TestSessionMailTransaction(t *testing.T) {
 	}
 }
 
+// captureStore records stored messages for inspection.
+type captureStore struct{ messages []*Message }
+
+func (c *captureStore) Store(msg *Message) error {
+	c.messages = append(c.messages, msg)
+	return nil
+}
+
+func TestSessionNullReversePathAndPostmaster(t *testing.T) {
+	conn := newMockConn()
+	store := &captureStore{}
+	config := &Config{Port: 2525, MessageStore: store}
+	config.EnsureDefaults()
+	session := NewSession(conn, config, nil)
+
+	conn.writeInput("EHLO client.example.com\r\n")
+	conn.writeInput("MAIL FROM:<>\r\n")
+	conn.writeInput("RCPT TO:<Postmaster>\r\n")
+	conn.writeInput("RCPT TO:<postmaster@example.com>\r\n")
+	conn.writeInput("DATA\r\n")
+	conn.writeInput("Subject: Delivery Status Notification\r\n\r\nbounced\r\n.\r\n")
+	conn.writeInput("QUIT\r\n")
+
+	if err := session.Handle(); err != nil {
+		t.Fatalf("Session handle failed: %v", err)
+	}
+
+	output := conn.getOutput()
+	if strings.Contains(output, "501") {
+		t.Fatalf("null reverse-path or postmaster rejected: %s", output)
+	}
+	if !strings.Contains(output, "250 OK Message accepted for delivery") {
+		t.Fatalf("expected message to be accepted, got: %s", output)
+	}
+
+	if len(store.messages) != 1 {
+		t.Fatalf("expected 1 stored message, got %d", len(store.messages))
+	}
+	msg := store.messages[0]
+	if msg.From != "" {
+		t.Errorf("expected empty From for null reverse-path, got %q", msg.From)
+	}
+	if len(msg.To) != 2 || msg.To[0] != "postmaster" || msg.To[1] != "postmaster@example.com" {
+		t.Errorf("unexpected recipients %v", msg.To)
+	}
+}
+
 func TestSessionErrorCodes(t *testing.T) {
 	conn := newMockConn()
 	config := newTestConfig()
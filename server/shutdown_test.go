@@ -128,3 +128,46 @@ func TestShutdownMultipleClients(t *testing.T) {
 		_ = conns[i].Close()
 	}
 }
+
+// TestShutdownAbortsTLSHandshake verifies that an implicit TLS connection whose client
+// never sends a ClientHello is closed by Shutdown rather than held open.
+func TestShutdownAbortsTLSHandshake(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	listener, err := srv.createTLSListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if conn, err := listener.Accept(); err == nil {
+			srv.serveTLS(conn, cfg, 0)
+		}
+	}()
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned error: %v", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Shutdown to abort the pending TLS handshake")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"badsmtp/logging"
+)
+
+// submissionPolicy holds the message submission (RFC 6409) rules in force for a session.
+// The submission port enables all of them; EHLO labels enable them individually.
+type submissionPolicy struct {
+	requireTLS  bool // hide AUTH until TLS is active and refuse it over cleartext (requiretls)
+	requireAuth bool // refuse MAIL until the client has authenticated (requireauth)
+	fixMessages bool // add a missing Date and Message-ID header to accepted messages
+}
+
+// applySubmissionPolicy sets the session's submission rules from the port configuration
+// and the requiretls, requireauth and submission labels of the EHLO hostname.
+func (s *Session) applySubmissionPolicy(parts []string) {
+	submission := s.config.Submission || hasCapability(parts, "submission")
+	s.submission = submissionPolicy{
+		requireTLS:  submission || hasCapability(parts, "requiretls"),
+		requireAuth: submission || hasCapability(parts, "requireauth"),
+		fixMessages: submission,
+	}
+}
+
+// authRequiresTLS reports whether AUTH must wait until TLS is active.
+func (s *Session) authRequiresTLS() bool {
+	return s.submission.requireTLS && s.tlsState == nil
+}
+
+// fixSubmittedMessage adds the Date and Message-ID header fields a submission server
+// may supply when the client omitted them (RFC 6409 section 8). Other content is unchanged.
+func (s *Session) fixSubmittedMessage(content string) string {
+	if !s.submission.fixMessages {
+		return content
+	}
+
+	newline := "\n"
+	if strings.Contains(content, "\r\n") {
+		newline = "\r\n"
+	}
+	header, _, _ := strings.Cut(content, newline+newline)
+
+	var added []string
+	if !hasHeaderField(header, "Date") {
+		added = append(added, "Date: "+time.Now().Format(time.RFC1123Z))
+	}
+	if !hasHeaderField(header, "Message-ID") {
+		added = append(added, fmt.Sprintf("Message-ID: <%s@%s>", newMessageIDLocalPart(), s.messageIDDomain()))
+	}
+	if len(added) == 0 {
+		return content
+	}
+
+	s.logger.Debug("Submission added missing header fields", logging.F("count", len(added)))
+	return strings.Join(added, newline) + newline + content
+}
+
+// messageIDDomain returns the domain used in generated Message-ID header fields.
+func (s *Session) messageIDDomain() string {
+	if hostname := s.routingHostname(); hostname != "" {
+		return hostname
+	}
+	return dsnReportingMTA
+}
+
+// hasHeaderField reports whether the header block contains the named field.
+func hasHeaderField(header, name string) bool {
+	prefix := strings.ToLower(name) + ":"
+	for _, line := range strings.Split(header, "\n") {
+		if strings.HasPrefix(strings.ToLower(line), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// newMessageIDLocalPart returns a unique left-hand side for a Message-ID.
+func newMessageIDLocalPart() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%d.%s", time.Now().Unix(), hex.EncodeToString(b))
+}
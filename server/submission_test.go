@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestSubmissionPortEnablesSubmission(t *testing.T) {
+	cfg := &Config{Port: 2587, SubmissionPort: 2587}
+	cfg.EnsureDefaults()
+	cfg.AnalysePortBehaviour()
+	if !cfg.Submission {
+		t.Fatal("expected submission mode on the submission port")
+	}
+
+	other := &Config{Port: 2525, SubmissionPort: 2587}
+	other.EnsureDefaults()
+	other.AnalysePortBehaviour()
+	if other.Submission {
+		t.Fatal("expected no submission mode on other ports")
+	}
+}
+
+func TestSubmissionHidesAuthBeforeTLS(t *testing.T) {
+	cfg := &Config{Port: 2587, Submission: true}
+	cfg.EnsureDefaults()
+	sess := NewSession(nil, cfg, nil)
+
+	advertisesAuth := func() bool {
+		for _, line := range sess.buildEhloResponse("client.example.com") {
+			if strings.HasPrefix(line, "250-AUTH ") {
+				return true
+			}
+		}
+		return false
+	}
+	if advertisesAuth() {
+		t.Fatal("expected AUTH to be hidden before STARTTLS")
+	}
+	sess.tlsState = &tls.ConnectionState{}
+	if !advertisesAuth() {
+		t.Fatal("expected AUTH to be advertised over TLS")
+	}
+}
+
+func TestSessionSubmissionPolicy(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	plain := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00goodauth@example.com\x00password"))
+
+	cmd := paramSession(t, cfg, "nopipelining-requiretls.example.com")
+	if got := cmd(plain); !strings.HasPrefix(got, "538 5.7.11") {
+		t.Fatalf("expected AUTH over cleartext to be refused, got %q", got)
+	}
+	if got := cmd("MAIL FROM:<a@example.com>"); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected requiretls alone to accept MAIL, got %q", got)
+	}
+
+	cmd = paramSession(t, cfg, "nopipelining-requireauth.example.com")
+	if got := cmd("MAIL FROM:<a@example.com>"); !strings.HasPrefix(got, "530 5.7.0") {
+		t.Fatalf("expected MAIL without AUTH to be refused, got %q", got)
+	}
+	if got := cmd(plain); !strings.HasPrefix(got, "235") {
+		t.Fatalf("expected AUTH to succeed, got %q", got)
+	}
+	if got := cmd("MAIL FROM:<a@example.com>"); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected MAIL after AUTH to be accepted, got %q", got)
+	}
+
+	cmd = paramSession(t, cfg, "nopipelining-submission.example.com")
+	if got := cmd(plain); !strings.HasPrefix(got, "538 5.7.11") {
+		t.Fatalf("expected submission label to require TLS, got %q", got)
+	}
+	if got := cmd("MAIL FROM:<a@example.com>"); !strings.HasPrefix(got, "530 5.7.0") {
+		t.Fatalf("expected submission label to require AUTH, got %q", got)
+	}
+}
+
+func TestFixSubmittedMessage(t *testing.T) {
+	cfg := &Config{Port: 2587, Submission: true}
+	cfg.EnsureDefaults()
+	sess := NewSession(nil, cfg, nil)
+	sess.heloName = "client.example.com"
+
+	fixed := sess.fixSubmittedMessage("Subject: hi\r\n\r\nDate: in the body\r\n")
+	header, body, _ := strings.Cut(fixed, "\r\n\r\n")
+	if !hasHeaderField(header, "Date") || !strings.Contains(header, "Message-ID: <") || !strings.Contains(header, "@client.example.com>") {
+		t.Fatalf("expected Date and Message-ID to be added, got %q", fixed)
+	}
+	if body != "Date: in the body\r\n" {
+		t.Errorf("body changed: %q", body)
+	}
+
+	complete := "Date: Mon, 02 Jan 2006 15:04:05 -0700\nMessage-Id: <1@example.com>\n\nbody\n"
+	if got := sess.fixSubmittedMessage(complete); got != complete {
+		t.Errorf("expected existing headers to be kept, got %q", got)
+	}
+
+	sess.submission = submissionPolicy{}
+	if got := sess.fixSubmittedMessage("Subject: hi\n\nbody\n"); got != "Subject: hi\n\nbody\n" {
+		t.Errorf("expected no fixes outside submission mode, got %q", got)
+	}
+}
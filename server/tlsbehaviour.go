@@ -0,0 +1,268 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"badsmtp/logging"
+)
+
+// TLS behaviours, in the order of their ports from TLSBehaviourPortStart. Each name is
+// also the EHLO label that selects the behaviour for STARTTLS, e.g. "tlsexpired.example.com".
+const (
+	TLSBehaviourExpired     = "tlsexpired"     // Certificate that expired a day ago
+	TLSBehaviourNotYetValid = "tlsnotyetvalid" // Certificate that only becomes valid tomorrow
+	TLSBehaviourWrongHost   = "tlswronghost"   // Certificate for WrongTLSHostname
+	TLSBehaviourUntrusted   = "tlsuntrusted"   // Certificate issued by a CA nobody trusts
+	TLSBehaviourWeak        = "tlsweak"        // Certificate with an RSA-1024 key and a SHA-1 signature
+	TLSBehaviourTLS10       = "tls10"          // Only TLS 1.0 is offered
+	TLSBehaviourTLS11       = "tls11"          // Only TLS 1.1 is offered
+	TLSBehaviourStall       = "tlsstall"       // The ClientHello is never answered
+	TLSBehaviourAlert       = "tlsalert"       // The ClientHello is answered with a handshake_failure alert
+	TLSBehaviourSelfSigned  = "tlsselfsigned"  // Self-signed certificate
+)
+
+// TLSBehaviours lists the TLS behaviours by port offset.
+var TLSBehaviours = []string{
+	TLSBehaviourExpired,
+	TLSBehaviourNotYetValid,
+	TLSBehaviourWrongHost,
+	TLSBehaviourUntrusted,
+	TLSBehaviourWeak,
+	TLSBehaviourTLS10,
+	TLSBehaviourTLS11,
+	TLSBehaviourStall,
+	TLSBehaviourAlert,
+	TLSBehaviourSelfSigned,
+}
+
+const (
+	// WrongTLSHostname is the only name in the certificate served by the tlswronghost behaviour.
+	WrongTLSHostname = "wrong.host.badsmtp.test"
+
+	// weakRSAKeySize is the key size used by the tlsweak behaviour.
+	weakRSAKeySize = 1024
+
+	// tlsStallTimeout bounds how long a stalled handshake holds the connection open when
+	// the client never gives up.
+	tlsStallTimeout = 10 * time.Minute
+)
+
+// handshakeFailureAlert is a TLS record holding a fatal handshake_failure alert
+// (RFC 5246 section 7.2).
+var handshakeFailureAlert = []byte{21, 3, 3, 0, 2, 2, 40}
+
+// applyTLSBehaviour selects the STARTTLS behaviour named by a tls<behaviour> label of the
+// EHLO hostname, and returns the other parts.
+func (s *Session) applyTLSBehaviour(parts []string) []string {
+	s.tlsBehaviour = ""
+	remaining := parts[:0]
+	for _, part := range parts {
+		if isTLSBehaviour(part) {
+			s.tlsBehaviour = part
+			continue
+		}
+		remaining = append(remaining, part)
+	}
+	return remaining
+}
+
+func isTLSBehaviour(name string) bool {
+	for _, b := range TLSBehaviours {
+		if name == b {
+			return true
+		}
+	}
+	return false
+}
+
+// startTLSWithBehaviour misbehaves as selected by a tls<behaviour> EHLO label once the
+// client has been told to start TLS. Stalled and aborted handshakes end the session.
+func (s *Session) startTLSWithBehaviour(hostname string) error {
+	s.logger.LogBehaviourTriggered(s.tlsBehaviour, s.config.Port, 0)
+	switch s.tlsBehaviour {
+	case TLSBehaviourStall:
+		stallTLSHandshake(s.conn)
+		return io.EOF
+	case TLSBehaviourAlert:
+		if err := abortTLSHandshake(s.conn); err != nil {
+			s.logger.Debug("failed to send TLS alert", logging.F("err", err))
+		}
+		return io.EOF
+	}
+	return s.handshakeTLS(s.config.tlsBehaviourConfig(s.tlsBehaviour, hostname, s.obtainTLSCertificate))
+}
+
+// serveTLSBehaviour handles a connection to a TLS behaviour port: the handshake
+// misbehaves as selected by portConfig.TLSBehaviour, and a session is run if it completes.
+func (s *Server) serveTLSBehaviour(conn net.Conn, portConfig *Config, port int) {
+	s.logger.Info("TLS behaviour triggered", logging.F("behaviour", portConfig.TLSBehaviour),
+		logging.F("port", port), logging.F("client_ip", remoteIP(conn)))
+	switch portConfig.TLSBehaviour {
+	case TLSBehaviourStall:
+		stallTLSHandshake(conn)
+		_ = conn.Close()
+		return
+	case TLSBehaviourAlert:
+		if err := abortTLSHandshake(conn); err != nil {
+			s.logger.Debug("failed to send TLS alert", logging.F("port", port), logging.F("err", err))
+		}
+		_ = conn.Close()
+		return
+	}
+	tlsConfig := portConfig.tlsBehaviourConfig(portConfig.TLSBehaviour, portConfig.GetTLSHostname(), s.certificate)
+	if portConfig.KeyLog != nil {
+		tlsConfig.KeyLogWriter = portConfig.KeyLog.forConn(conn)
+	}
+	s.serveTLS(tls.Server(conn, tlsConfig), portConfig, port)
+}
+
+// tlsBehaviourConfig returns the server TLS configuration for a certificate or protocol
+// version behaviour. Certificates are issued for the client's SNI name, or for hostname
+// without one; certificate supplies the normal certificate for the TLS 1.0 and 1.1 modes.
+func (c *Config) tlsBehaviourConfig(behaviour, hostname string, certificate func(hostname string) (tls.Certificate, error)) *tls.Config {
+	tlsConfig := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = hostname
+			}
+			var cert tls.Certificate
+			var err error
+			switch behaviour {
+			case TLSBehaviourTLS10, TLSBehaviourTLS11:
+				cert, err = certificate(name)
+			default:
+				cert, err = generateBehaviourCert(behaviour, name, c.CA)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		},
+		MinVersion: MinTLSVersion,
+	}
+	switch behaviour {
+	case TLSBehaviourTLS10:
+		tlsConfig.MinVersion, tlsConfig.MaxVersion = tls.VersionTLS10, tls.VersionTLS10
+	case TLSBehaviourTLS11:
+		tlsConfig.MinVersion, tlsConfig.MaxVersion = tls.VersionTLS11, tls.VersionTLS11
+	}
+	c.applyClientAuth(tlsConfig)
+	return tlsConfig
+}
+
+// generateBehaviourCert generates the faulty certificate served for a TLS behaviour.
+// Apart from the fault, each certificate is a valid one for hostname, signed by ca (or
+// self-signed without one), so a client that trusts the CA only trips over the fault.
+func generateBehaviourCert(behaviour, hostname string, ca *CertificateAuthority) (tls.Certificate, error) {
+	now := time.Now()
+	validity := CertValidityHours * time.Hour
+	template := certificateTemplate(hostname, now, now.Add(validity))
+
+	var key crypto.Signer
+	var err error
+	if behaviour == TLSBehaviourWeak {
+		key, err = rsa.GenerateKey(rand.Reader, weakRSAKeySize)
+		template.SignatureAlgorithm = x509.SHA1WithRSA
+		if _, ok := ca.publicKey().(*ecdsa.PublicKey); ok {
+			template.SignatureAlgorithm = x509.ECDSAWithSHA1
+		}
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate private key: %v", err)
+	}
+
+	switch behaviour {
+	case TLSBehaviourExpired:
+		template.NotBefore, template.NotAfter = now.Add(-2*validity), now.Add(-validity)
+	case TLSBehaviourNotYetValid:
+		template.NotBefore, template.NotAfter = now.Add(validity), now.Add(2*validity)
+	case TLSBehaviourWrongHost:
+		template.Subject.CommonName = WrongTLSHostname
+		template.DNSNames, template.IPAddresses = []string{WrongTLSHostname}, nil
+	case TLSBehaviourUntrusted:
+		return issueUntrustedCert(template, key)
+	}
+	if ca != nil && behaviour != TLSBehaviourSelfSigned {
+		return ca.sign(template, key)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// issueUntrustedCert signs template with a CA generated for this certificate alone, so
+// no client can have it in its trust store. The CA certificate is sent in the chain.
+func issueUntrustedCert(template *x509.Certificate, key crypto.Signer) (tls.Certificate, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate CA key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "BadSMTP Untrusted CA"},
+		NotBefore:             template.NotBefore,
+		NotAfter:              template.NotAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create CA certificate: %v", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse CA certificate: %v", err)
+	}
+
+	template.SerialNumber = big.NewInt(2)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der, caDER}, PrivateKey: key}, nil
+}
+
+// stallTLSHandshake reads and discards whatever the client sends without answering, until
+// the client gives up or tlsStallTimeout passes.
+func stallTLSHandshake(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(tlsStallTimeout))
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+// abortTLSHandshake reads the client's first TLS record, normally the ClientHello, and
+// answers it with a fatal handshake_failure alert.
+func abortTLSHandshake(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(maxWriteDeadline)); err != nil {
+		return err
+	}
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	length := int64(header[3])<<8 | int64(header[4])
+	if _, err := io.CopyN(io.Discard, conn, length); err != nil {
+		return err
+	}
+	_, err := conn.Write(handshakeFailureAlert)
+	return err
+}
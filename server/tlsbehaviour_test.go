@@ -0,0 +1,182 @@
+package server
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSBehaviourPorts(t *testing.T) {
+	cfg := &Config{Port: 2525}
+	cfg.EnsureDefaults()
+
+	for i, behaviour := range TLSBehaviours {
+		portConfig := *cfg
+		portConfig.Port = cfg.TLSBehaviourPortStart + i
+		portConfig.AnalysePortBehaviour()
+		if portConfig.TLSBehaviour != behaviour {
+			t.Errorf("port %d: expected behaviour %q, got %q", portConfig.Port, behaviour, portConfig.TLSBehaviour)
+		}
+		if got := portConfig.GetBehaviourDescription(); got != "TLS behaviour: "+behaviour {
+			t.Errorf("port %d: unexpected description %q", portConfig.Port, got)
+		}
+	}
+
+	cfg.Port = cfg.TLSBehaviourPortStart + 3
+	if err := cfg.ValidatePortConfiguration(); err == nil {
+		t.Error("expected the normal port inside the TLS behaviour range to be rejected")
+	}
+}
+
+func TestGenerateBehaviourCert(t *testing.T) {
+	ca, err := NewCertificateAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	leaf := func(behaviour string) (*x509.Certificate, tls.Certificate) {
+		t.Helper()
+		cert, err := generateBehaviourCert(behaviour, "mail.example.com", ca)
+		if err != nil {
+			t.Fatalf("%s: %v", behaviour, err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("%s: %v", behaviour, err)
+		}
+		return parsed, cert
+	}
+
+	c, _ := leaf(TLSBehaviourExpired)
+	if !c.NotAfter.Before(now) {
+		t.Errorf("expected an expired certificate, NotAfter %v", c.NotAfter)
+	}
+	if err := c.CheckSignatureFrom(ca.cert); err != nil || c.VerifyHostname("mail.example.com") != nil {
+		t.Errorf("expected the expired certificate to be otherwise valid: %v", err)
+	}
+	if c, _ := leaf(TLSBehaviourNotYetValid); !c.NotBefore.After(now) {
+		t.Errorf("expected a certificate that is not yet valid, NotBefore %v", c.NotBefore)
+	}
+	if c, _ := leaf(TLSBehaviourWrongHost); c.VerifyHostname("mail.example.com") == nil || c.VerifyHostname(WrongTLSHostname) != nil {
+		t.Errorf("expected a certificate for %s only, got %v", WrongTLSHostname, c.DNSNames)
+	}
+	if c, cert := leaf(TLSBehaviourUntrusted); len(cert.Certificate) != 2 || c.Issuer.CommonName != "BadSMTP Untrusted CA" {
+		t.Errorf("expected a certificate issued by the untrusted CA, got issuer %q", c.Issuer.CommonName)
+	}
+	c, _ = leaf(TLSBehaviourWeak)
+	if key, ok := c.PublicKey.(*rsa.PublicKey); !ok || key.N.BitLen() != weakRSAKeySize || c.SignatureAlgorithm != x509.ECDSAWithSHA1 {
+		t.Errorf("expected an RSA-1024 certificate signed with SHA-1, got %v", c.SignatureAlgorithm)
+	}
+	if c, _ := leaf(TLSBehaviourSelfSigned); c.VerifyHostname("mail.example.com") != nil || c.NotAfter.Before(now) ||
+		c.CheckSignature(c.SignatureAlgorithm, c.RawTBSCertificate, c.Signature) != nil {
+		t.Error("expected a valid self-signed certificate")
+	}
+
+	cert, err := generateBehaviourCert(TLSBehaviourWeak, "mail.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := x509.ParseCertificate(cert.Certificate[0]); err != nil || c.SignatureAlgorithm != x509.SHA1WithRSA {
+		t.Errorf("expected a self-signed SHA-1 certificate without a CA (%v)", err)
+	}
+}
+
+func TestSessionSTARTTLSBehaviours(t *testing.T) {
+	handshake := func(ehlo string, clientConfig *tls.Config) (*tls.Conn, error) {
+		t.Helper()
+		cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+		cfg.EnsureDefaults()
+		client, serverConn := connPair()
+		t.Cleanup(func() { _ = client.Close() })
+		go func() { _ = NewSession(serverConn, cfg, nil).Handle() }()
+
+		tp := textproto.NewConn(client)
+		if _, _, err := tp.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		if err := tp.PrintfLine("EHLO %s", ehlo); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := tp.ReadResponse(250); err != nil {
+			t.Fatal(err)
+		}
+		if err := tp.PrintfLine("STARTTLS"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := tp.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		clientConfig.InsecureSkipVerify = true //nolint:gosec // inspecting deliberately bad certificates
+		tlsConn := tls.Client(client, clientConfig)
+		_ = tlsConn.SetDeadline(time.Now().Add(time.Second))
+		return tlsConn, tlsConn.Handshake()
+	}
+
+	conn, err := handshake("tlsexpired-nopipelining.example.com", &tls.Config{})
+	if err != nil {
+		t.Fatalf("tlsexpired: handshake failed: %v", err)
+	}
+	if cert := conn.ConnectionState().PeerCertificates[0]; !cert.NotAfter.Before(time.Now()) {
+		t.Errorf("tlsexpired: expected an expired certificate, NotAfter %v", cert.NotAfter)
+	}
+
+	conn, err = handshake("tls10-nopipelining.example.com", &tls.Config{MinVersion: tls.VersionTLS10})
+	if err != nil {
+		t.Fatalf("tls10: handshake failed: %v", err)
+	}
+	if v := conn.ConnectionState().Version; v != tls.VersionTLS10 {
+		t.Errorf("tls10: expected TLS 1.0, got %x", v)
+	}
+	if _, err := handshake("tls11-nopipelining.example.com", &tls.Config{}); err == nil {
+		t.Error("tls11: expected a TLS 1.2+ client to fail")
+	}
+
+	if _, err := handshake("tlsalert-nopipelining.example.com", &tls.Config{}); err == nil || !strings.Contains(err.Error(), "handshake failure") {
+		t.Errorf("tlsalert: expected a handshake failure alert, got %v", err)
+	}
+	if _, err := handshake("tlsstall-nopipelining.example.com", &tls.Config{}); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("tlsstall: expected the handshake to time out, got %v", err)
+	}
+}
+
+func TestServerTLSBehaviourPort(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}}
+	cfg.EnsureDefaults()
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	handshake := func(behaviour string) (*tls.Conn, error) {
+		t.Helper()
+		client, serverConn := connPair()
+		t.Cleanup(func() { _ = client.Close() })
+		for i, b := range TLSBehaviours {
+			if b == behaviour {
+				go srv.handleConnectionForPort(serverConn, cfg.TLSBehaviourPortStart+i)
+			}
+		}
+		tlsConn := tls.Client(client, &tls.Config{InsecureSkipVerify: true, ServerName: "mail.example.com"}) //nolint:gosec // inspecting deliberately bad certificates
+		_ = tlsConn.SetDeadline(time.Now().Add(time.Second))
+		return tlsConn, tlsConn.Handshake()
+	}
+
+	conn, err := handshake(TLSBehaviourWrongHost)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if names := conn.ConnectionState().PeerCertificates[0].DNSNames; len(names) != 1 || names[0] != WrongTLSHostname {
+		t.Errorf("expected a certificate for %s, got %v", WrongTLSHostname, names)
+	}
+	if greeting, err := textproto.NewConn(conn).ReadLine(); err != nil || !strings.HasPrefix(greeting, "220") {
+		t.Errorf("expected a greeting over TLS, got %q (%v)", greeting, err)
+	}
+
+	if _, err := handshake(TLSBehaviourStall); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected a stalled handshake to time out, got %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// TLSSettings tunes the TLS handshakes of the implicit TLS and STARTTLS listeners. Empty
+// fields keep Go's defaults, except MinVersion, which defaults to TLS 1.2 (or MaxVersion
+// when that is lower). The tls<behaviour> modes ignore these settings.
+type TLSSettings struct {
+	MinVersion     string   `mapstructure:"min_version"`     // 1.0, 1.1, 1.2 or 1.3
+	MaxVersion     string   `mapstructure:"max_version"`     // 1.0, 1.1, 1.2 or 1.3
+	CipherSuites   []string `mapstructure:"cipher_suites"`   // TLS 1.0-1.2 suites by name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	Curves         []string `mapstructure:"curves"`          // Key exchanges in order of preference: X25519MLKEM768, X25519, P256, P384, P521
+	ALPN           []string `mapstructure:"alpn"`            // Application protocols; clients offering none of them are rejected
+	SessionTickets *bool    `mapstructure:"session_tickets"` // Issue session tickets (default true)
+	Resumption     *bool    `mapstructure:"resumption"`      // Resume sessions from tickets (default true)
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+// override returns s with the fields set in o replaced.
+func (s TLSSettings) override(o TLSSettings) TLSSettings {
+	if o.MinVersion != "" {
+		s.MinVersion = o.MinVersion
+	}
+	if o.MaxVersion != "" {
+		s.MaxVersion = o.MaxVersion
+	}
+	if len(o.CipherSuites) > 0 {
+		s.CipherSuites = o.CipherSuites
+	}
+	if len(o.Curves) > 0 {
+		s.Curves = o.Curves
+	}
+	if len(o.ALPN) > 0 {
+		s.ALPN = o.ALPN
+	}
+	if o.SessionTickets != nil {
+		s.SessionTickets = o.SessionTickets
+	}
+	if o.Resumption != nil {
+		s.Resumption = o.Resumption
+	}
+	return s
+}
+
+// tlsConfig returns a server TLS configuration with the settings applied, but without
+// certificates.
+func (s TLSSettings) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: MinTLSVersion}
+	if s.MaxVersion != "" {
+		v, err := parseTLSVersion(s.MaxVersion)
+		if err != nil {
+			return nil, fmt.Errorf("max_version: %w", err)
+		}
+		tlsConfig.MaxVersion = v
+		tlsConfig.MinVersion = min(tlsConfig.MinVersion, v)
+	}
+	if s.MinVersion != "" {
+		v, err := parseTLSVersion(s.MinVersion)
+		if err != nil {
+			return nil, fmt.Errorf("min_version: %w", err)
+		}
+		if tlsConfig.MaxVersion != 0 && v > tlsConfig.MaxVersion {
+			return nil, fmt.Errorf("min_version %s is above max_version %s", s.MinVersion, s.MaxVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+
+	for _, name := range s.CipherSuites {
+		id, err := parseCipherSuite(name)
+		if err != nil {
+			return nil, fmt.Errorf("cipher_suites: %w", err)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	for _, name := range s.Curves {
+		id, err := parseCurve(name)
+		if err != nil {
+			return nil, fmt.Errorf("curves: %w", err)
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, id)
+	}
+	tlsConfig.NextProtos = s.ALPN
+
+	if s.SessionTickets != nil && !*s.SessionTickets {
+		tlsConfig.SessionTicketsDisabled = true
+	}
+	if s.Resumption != nil && !*s.Resumption {
+		// Tickets are still issued, but never accepted, so every handshake is a full one
+		tlsConfig.UnwrapSession = func([]byte, tls.ConnectionState) (*tls.SessionState, error) {
+			return nil, nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// parseTLSVersion parses a version such as "1.2" or "TLS 1.2".
+func parseTLSVersion(name string) (uint16, error) {
+	key := strings.TrimPrefix(strings.ToUpper(strings.ReplaceAll(name, " ", "")), "TLS")
+	if v, ok := tlsVersions[strings.TrimPrefix(key, "V")]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", name)
+}
+
+// parseCipherSuite looks up a TLS 1.0-1.2 cipher suite by its standard name, including
+// the insecure suites Go does not offer by default.
+func parseCipherSuite(name string) (uint16, error) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if !strings.EqualFold(suite.Name, name) {
+			continue
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return 0, fmt.Errorf("TLS 1.3 cipher suite %s cannot be configured", suite.Name)
+		}
+		return suite.ID, nil
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+// parseCurve looks up a key exchange by name, e.g. "X25519", "P256", "P-256" or "CurveP256".
+func parseCurve(name string) (tls.CurveID, error) {
+	key := strings.TrimPrefix(strings.ToUpper(strings.ReplaceAll(name, "-", "")), "CURVE")
+	for _, id := range tlsCurves {
+		if strings.TrimPrefix(strings.ToUpper(id.String()), "CURVE") == key {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown curve %q", name)
+}
+
+// loadTLSSettings builds ImplicitTLSConfig and STARTTLSConfig from TLS and the per-listener
+// overrides. Both share a session ticket key, so sessions resume across connections and
+// STARTTLS sessions. Configurations set by the caller are kept.
+func (c *Config) loadTLSSettings() error {
+	if _, err := c.TLS.tlsConfig(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	var ticketKey [32]byte
+	if _, err := rand.Read(ticketKey[:]); err != nil {
+		return fmt.Errorf("failed to generate session ticket key: %v", err)
+	}
+	listeners := []struct {
+		key      string
+		settings TLSSettings
+		dest     **tls.Config
+	}{
+		{"implicit_tls", c.ImplicitTLS, &c.ImplicitTLSConfig},
+		{"starttls", c.STARTTLS, &c.STARTTLSConfig},
+	}
+	for _, l := range listeners {
+		if *l.dest != nil {
+			continue
+		}
+		tlsConfig, err := c.TLS.override(l.settings).tlsConfig()
+		if err != nil {
+			return fmt.Errorf("%s: %w", l.key, err)
+		}
+		tlsConfig.SetSessionTicketKeys([][32]byte{ticketKey})
+		*l.dest = tlsConfig
+	}
+	return nil
+}
+
+// newImplicitTLSConfig returns a copy of ImplicitTLSConfig, with the client certificate
+// policy applied, for adding the certificates to.
+func (c *Config) newImplicitTLSConfig() *tls.Config {
+	return c.newListenerTLSConfig(c.ImplicitTLSConfig)
+}
+
+// newSTARTTLSConfig returns a copy of STARTTLSConfig, with the client certificate policy
+// applied, for adding the certificates to.
+func (c *Config) newSTARTTLSConfig() *tls.Config {
+	return c.newListenerTLSConfig(c.STARTTLSConfig)
+}
+
+func (c *Config) newListenerTLSConfig(base *tls.Config) *tls.Config {
+	var tlsConfig *tls.Config
+	if base != nil {
+		tlsConfig = base.Clone()
+	} else {
+		tlsConfig = &tls.Config{MinVersion: MinTLSVersion}
+	}
+	c.applyClientAuth(tlsConfig)
+	return tlsConfig
+}
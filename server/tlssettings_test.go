@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestTLSSettings(t *testing.T) {
+	tlsConfig, err := TLSSettings{
+		MaxVersion:   "TLS 1.1",
+		CipherSuites: []string{"tls_ecdhe_rsa_with_aes_128_cbc_sha", "TLS_RSA_WITH_RC4_128_SHA"},
+		Curves:       []string{"P-384", "CurveP256", "x25519"},
+	}.tlsConfig()
+	if err != nil {
+		t.Fatalf("tlsConfig failed: %v", err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS11 || tlsConfig.MaxVersion != tls.VersionTLS11 {
+		t.Errorf("expected a max_version below 1.2 to lower the minimum, got %x-%x", tlsConfig.MinVersion, tlsConfig.MaxVersion)
+	}
+	if len(tlsConfig.CipherSuites) != 2 || tlsConfig.CipherSuites[1] != tls.TLS_RSA_WITH_RC4_128_SHA {
+		t.Errorf("unexpected cipher suites %v", tlsConfig.CipherSuites)
+	}
+	if want := []tls.CurveID{tls.CurveP384, tls.CurveP256, tls.X25519}; len(tlsConfig.CurvePreferences) != 3 || tlsConfig.CurvePreferences[0] != want[0] {
+		t.Errorf("expected curves %v, got %v", want, tlsConfig.CurvePreferences)
+	}
+
+	off := false
+	merged := TLSSettings{MinVersion: "1.3", Curves: []string{"X25519"}}.override(TLSSettings{MinVersion: "1.2", Resumption: &off})
+	if merged.MinVersion != "1.2" || len(merged.Curves) != 1 || merged.Resumption == nil {
+		t.Errorf("unexpected merged settings %+v", merged)
+	}
+
+	for _, bad := range []TLSSettings{
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{MinVersion: "3.0"},
+		{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{CipherSuites: []string{"TLS_NOT_A_SUITE"}},
+		{Curves: []string{"P-192"}},
+	} {
+		if _, err := bad.tlsConfig(); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+
+	cfg := &Config{STARTTLS: TLSSettings{MaxVersion: "1.0"}, TLS: TLSSettings{MinVersion: "1.1"}}
+	if err := cfg.loadTLSSettings(); err == nil || !strings.HasPrefix(err.Error(), "starttls:") {
+		t.Errorf("expected the STARTTLS override to be rejected, got %v", err)
+	}
+}
+
+// startTLSClient runs a session on cfg, issues STARTTLS and returns the client's TLS connection
+// after the handshake and a second EHLO, which also delivers any TLS 1.3 session ticket.
+func startTLSClient(t *testing.T, cfg *Config, clientConfig *tls.Config) (*tls.Conn, error) {
+	t.Helper()
+	client, serverConn := connPair()
+	t.Cleanup(func() { _ = client.Close() })
+	go func() { _ = NewSession(serverConn, cfg, nil).Handle() }()
+
+	tp := textproto.NewConn(client)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"EHLO nopipelining.example.com", "STARTTLS"} {
+		if err := tp.PrintfLine("%s", line); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := tp.ReadResponse(0); err != nil {
+			t.Fatalf("%s failed: %v", line, err)
+		}
+	}
+	tlsConn := tls.Client(client, clientConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	tp = textproto.NewConn(tlsConn)
+	if err := tp.PrintfLine("EHLO nopipelining.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tp.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	return tlsConn, nil
+}
+
+func TestSessionSTARTTLSSettings(t *testing.T) {
+	newConfig := func(settings TLSSettings) *Config {
+		t.Helper()
+		cfg := &Config{Port: 2525, MessageStore: nopStore{}, STARTTLS: settings}
+		cfg.EnsureDefaults()
+		if err := cfg.loadTLSSettings(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.loadCA(); err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	clientConfig := func(cfg *Config) *tls.Config {
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(cfg.CA.CertPEM())
+		return &tls.Config{RootCAs: roots, ServerName: "nopipelining.example.com", ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	}
+
+	cfg := newConfig(TLSSettings{
+		MaxVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+		Curves:       []string{"P384"},
+	})
+	conn, err := startTLSClient(t, cfg, clientConfig(cfg))
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	state := conn.ConnectionState()
+	if state.Version != tls.VersionTLS12 || state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 || state.CurveID != tls.CurveP384 {
+		t.Errorf("expected the configured version, cipher suite and curve, got %x %s %s",
+			state.Version, tls.CipherSuiteName(state.CipherSuite), state.CurveID)
+	}
+	tls13Only := clientConfig(cfg)
+	tls13Only.MinVersion = tls.VersionTLS13
+	if _, err := startTLSClient(t, cfg, tls13Only); err == nil {
+		t.Error("expected a TLS 1.3 client to be refused")
+	}
+
+	// Sessions resume across STARTTLS sessions unless resumption is off
+	for _, resume := range []bool{true, false} {
+		cfg := newConfig(TLSSettings{Resumption: &resume})
+		clientConfig := clientConfig(cfg)
+		if _, err := startTLSClient(t, cfg, clientConfig); err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		conn, err := startTLSClient(t, cfg, clientConfig)
+		if err != nil {
+			t.Fatalf("second handshake failed: %v", err)
+		}
+		if got := conn.ConnectionState().DidResume; got != resume {
+			t.Errorf("resumption %v: expected DidResume %v, got %v", resume, resume, got)
+		}
+	}
+}
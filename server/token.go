@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"badsmtp/storage"
+)
+
+// MetadataToken is the session metadata key holding the token from a tok<id> EHLO label.
+// It is copied into SessionContext.Metadata and Message.Metadata.
+const MetadataToken = "token"
+
+// tokenLabelRegex matches a tok<id> capability label. The id is limited to letters and
+// digits so that it is safe to use as a directory name.
+var tokenLabelRegex = regexp.MustCompile(`^tok([a-z0-9]{1,59})$`)
+
+// TokenCapabilityParser recognises tok<id> labels in the EHLO hostname, e.g.
+// "tokci4711-nopipelining.example.com", and stores the id under MetadataToken. The label
+// is removed from the parts before they are passed on to the next parser.
+type TokenCapabilityParser struct {
+	next CapabilityParser
+}
+
+// NewTokenCapabilityParser creates a token parser that hands the remaining parts to next,
+// which may be nil.
+func NewTokenCapabilityParser(next CapabilityParser) *TokenCapabilityParser {
+	return &TokenCapabilityParser{next: next}
+}
+
+// ParseCapabilities extracts the token and returns the other parts (implements CapabilityParser).
+func (p *TokenCapabilityParser) ParseCapabilities(hostname string, parts []string) (modifiedParts []string, metadata map[string]interface{}) {
+	var token string
+	modifiedParts = make([]string, 0, len(parts))
+	for _, part := range parts {
+		if m := tokenLabelRegex.FindStringSubmatch(part); m != nil {
+			token = m[1]
+			continue
+		}
+		modifiedParts = append(modifiedParts, part)
+	}
+
+	metadata = make(map[string]interface{})
+	if p.next != nil {
+		modifiedParts, metadata = p.next.ParseCapabilities(hostname, modifiedParts)
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+	}
+	if token != "" {
+		metadata[MetadataToken] = token
+	}
+	return modifiedParts, metadata
+}
+
+// MessageToken returns the token of the session that sent msg, or "" without one.
+func MessageToken(msg *Message) string {
+	token, _ := msg.Metadata[MetadataToken].(string)
+	return token
+}
+
+// ValidToken reports whether token can be used in a tok<id> label.
+func ValidToken(token string) bool {
+	return tokenLabelRegex.MatchString("tok" + strings.ToLower(token))
+}
+
+// TokenMailboxDir returns the sub-mailbox of the Maildir at dir that holds the messages
+// sent with token. It is a Maildir++ folder, so IMAP servers such as Dovecot show it as
+// a folder of the main mailbox.
+func TokenMailboxDir(dir, token string) string {
+	return storage.TokenMailboxDir(dir, token)
+}
+
+// TokenMessageStore is a MessageStore wrapper that isolates concurrent test runs: each
+// message sent in a session with a tok<id> EHLO label is stored in the sub-mailbox for
+// that token (see TokenMailboxDir), and all other messages are passed to the wrapped
+// store.
+type TokenMessageStore struct {
+	next  MessageStore
+	local *DefaultMessageStore
+}
+
+// NewTokenMessageStore wraps next. Token sub-mailboxes are created inside mailboxDir, or
+// inside the directory resolveDir returns for the message's hostname (as with
+// NewRoutingMessageStore).
+func NewTokenMessageStore(next MessageStore, mailboxDir string, resolveDir func(hostname string) string) *TokenMessageStore {
+	return &TokenMessageStore{next: next, local: NewRoutingMessageStore(mailboxDir, resolveDir)}
+}
+
+// Store saves msg to its token's sub-mailbox, or to the wrapped store (implements MessageStore).
+func (s *TokenMessageStore) Store(msg *Message) error {
+	token := MessageToken(msg)
+	if token == "" {
+		return s.next.Store(msg)
+	}
+	if !ValidToken(token) {
+		return fmt.Errorf("invalid message token %q", token)
+	}
+	return s.local.storeIn(TokenMailboxDir(s.local.dirFor(msg.Hostname), token), msg)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenCapabilityParser(t *testing.T) {
+	p := NewTokenCapabilityParser(NewDefaultCapabilityParser())
+	parts, metadata := p.ParseCapabilities("tokci4711-nopipelining.example.com", []string{"tokci4711", "nopipelining"})
+	if !reflect.DeepEqual(parts, []string{"nopipelining"}) || metadata[MetadataToken] != "ci4711" {
+		t.Fatalf("got parts %v, metadata %v", parts, metadata)
+	}
+
+	parts, metadata = p.ParseCapabilities("tok-size1000.example.com", []string{"tok", "size1000"})
+	if len(parts) != 2 || metadata[MetadataToken] != nil {
+		t.Fatalf("expected a bare tok label to be left alone, got parts %v, metadata %v", parts, metadata)
+	}
+}
+
+func TestSessionTokenMailboxes(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{Port: 2525, MailboxDir: dir, TokenMailboxes: true}
+	cfg.EnsureDefaults()
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	send := func(ehlo string) {
+		t.Helper()
+		cmd := paramSession(t, cfg, ehlo)
+		cmd("MAIL FROM:<a@example.com>")
+		cmd("RCPT TO:<b@example.com>")
+		cmd("DATA")
+		if got := cmd("Subject: hi\r\n\r\nbody\r\n."); !strings.HasPrefix(got, "250") {
+			t.Fatalf("expected message to be accepted, got %q", got)
+		}
+	}
+	send("tokjoba-nopipelining.example.com")
+	send("tokjoba-nopipelining.example.com")
+	send("tokjobb-nopipelining.example.com")
+	send("nopipelining.example.com")
+
+	count := func(token string) int {
+		t.Helper()
+		mailbox := srv.GetMailbox()
+		if token != "" {
+			if mailbox, err = srv.TokenMailbox(token); err != nil {
+				t.Fatalf("TokenMailbox(%q) failed: %v", token, err)
+			}
+		}
+		files, err := mailbox.ListMessages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+	if a, b, none := count("jobA"), count("jobb"), count(""); a != 2 || b != 1 || none != 1 {
+		t.Fatalf("expected 2, 1 and 1 messages, got %d, %d and %d", a, b, none)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(TokenMailboxDir(dir, "jobb"), "new", "*"))
+	content, err := os.ReadFile(files[0])
+	if err != nil || !strings.Contains(string(content), "X-BadSMTP-Token: jobb\r\n") {
+		t.Errorf("expected the token header, got %q (%v)", content, err)
+	}
+
+	if _, err := srv.TokenMailbox("../escape"); err == nil {
+		t.Error("expected an invalid token to be refused")
+	}
+}
+
+func TestSessionTokenMailboxesWithRouting(t *testing.T) {
+	dir, routed := t.TempDir(), t.TempDir()
+	const hostname = "tokjobr-nopipelining.example.com"
+	cfg := &Config{
+		Port:                  2525,
+		MailboxDir:            dir,
+		TokenMailboxes:        true,
+		EnableHostnameRouting: true,
+		HostnameMailboxMap:    map[string]string{hostname: routed},
+	}
+	cfg.EnsureDefaults()
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	cmd := paramSession(t, cfg, hostname)
+	cmd("MAIL FROM:<a@example.com>")
+	cmd("RCPT TO:<b@example.com>")
+	cmd("DATA")
+	if got := cmd("Subject: hi\r\n\r\nbody\r\n."); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected message to be accepted, got %q", got)
+	}
+
+	mailbox, err := srv.HostnameTokenMailbox(hostname, "jobr")
+	if err != nil {
+		t.Fatalf("HostnameTokenMailbox failed: %v", err)
+	}
+	if mailbox.Directory != TokenMailboxDir(routed, "jobr") {
+		t.Errorf("expected the token mailbox inside the routed mailbox, got %s", mailbox.Directory)
+	}
+	if files, err := mailbox.ListMessages(); err != nil || len(files) != 1 {
+		t.Fatalf("expected the routed token mailbox to hold the message, got %d (%v)", len(files), err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(TokenMailboxDir(dir, "jobr"), "new", "*")); len(files) != 0 {
+		t.Errorf("expected nothing in the unrouted token mailbox, got %v", files)
+	}
+}
+
+func TestSessionTokenMailboxDSN(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{Port: 2525, MailboxDir: dir, TokenMailboxes: true}
+	cfg.EnsureDefaults()
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	cmd := paramSession(t, cfg, "tokjobd-nopipelining.example.com")
+	cmd("MAIL FROM:<a@example.com>")
+	cmd("RCPT TO:<dsnfail@example.com>")
+	cmd("DATA")
+	if got := cmd("Subject: hi\r\n\r\nbody\r\n."); !strings.HasPrefix(got, "250") {
+		t.Fatalf("expected message to be accepted, got %q", got)
+	}
+
+	mailbox, err := srv.TokenMailbox("jobd")
+	if err != nil {
+		t.Fatalf("TokenMailbox failed: %v", err)
+	}
+	if files, err := mailbox.ListMessages(); err != nil || len(files) != 2 {
+		t.Fatalf("expected the message and its DSN in the token mailbox, got %d (%v)", len(files), err)
+	}
+	if files, err := srv.GetMailbox().ListMessages(); err != nil || len(files) != 0 {
+		t.Errorf("expected nothing in the shared mailbox, got %d (%v)", len(files), err)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"badsmtp/logging"
+
+	"github.com/knadh/koanf"
+	kjson "github.com/knadh/koanf/parsers/json"
+	kyaml "github.com/knadh/koanf/parsers/yaml"
+	kfile "github.com/knadh/koanf/providers/file"
+)
+
+// LoadUsersFile reads the users for UserAuthenticator from path. Files ending in .yaml,
+// .yml or .json hold a "users" list with the same fields as the auth_users key; any
+// other file is read as an htpasswd file, with one "username:hash" line per user and
+// bcrypt or SHA-crypt hashes.
+func LoadUsersFile(path string) ([]AuthUser, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return loadUsersDocument(path, kyaml.Parser())
+	case ".json":
+		return loadUsersDocument(path, kjson.Parser())
+	default:
+		return loadHtpasswd(path)
+	}
+}
+
+func loadUsersDocument(path string, parser koanf.Parser) ([]AuthUser, error) {
+	k := koanf.New(".")
+	if err := k.Load(kfile.Provider(path), parser); err != nil {
+		return nil, err
+	}
+	var users []AuthUser
+	if err := k.UnmarshalWithConf("users", &users, koanf.UnmarshalConf{Tag: "mapstructure"}); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return users, nil
+}
+
+func loadHtpasswd(path string) ([]AuthUser, error) {
+	f, err := os.Open(path) //nolint:gosec // path comes from the operator's configuration
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var users []AuthUser
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		// Ignore any further fields, as in /etc/shadow
+		hash, _, _ = strings.Cut(hash, ":")
+		if !ok || username == "" || hash == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:hash", path, lineNo)
+		}
+		users = append(users, AuthUser{Username: username, PasswordHash: hash})
+	}
+	return users, scanner.Err()
+}
+
+// watchUsersFile reloads the auth_users_file into the UserAuthenticator whenever it
+// changes. A file that fails to load is logged and the previous users are kept.
+func (s *Server) watchUsersFile() {
+	path := s.config.AuthUsersFile
+	ua, ok := s.config.Authenticator.(*UserAuthenticator)
+	if path == "" || !ok {
+		return
+	}
+	stop, err := watchFile(path, func() {
+		users, err := LoadUsersFile(path)
+		if err == nil {
+			err = ua.SetUsers(append(append([]AuthUser(nil), s.config.AuthUsers...), users...))
+		}
+		if err != nil {
+			s.logger.Warn("Failed to reload users file; keeping the previous users",
+				logging.F("path", path), logging.F("err", err))
+			return
+		}
+		s.logger.Info("Reloaded users file", logging.F("path", path), logging.F("users", len(users)))
+	})
+	if err != nil {
+		s.logger.Warn("Cannot watch users file for changes", logging.F("path", path), logging.F("err", err))
+		return
+	}
+	s.stopWatchers = append(s.stopWatchers, stop)
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"badsmtp/auth"
+)
+
+// Hashes of "secret", from glibc crypt(3)
+const (
+	testBcryptHash      = "$2y$04$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW"
+	testSHA512CryptHash = "$6$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1"
+)
+
+const testUsersYAML = `users:
+  - username: alice@example.com
+    password: s3cret
+    quota: 1000
+    allowed_senders: ["alice@example.com"]
+    metadata:
+      plan: pro
+  - username: bob@example.com
+    password_hash: "` + testBcryptHash + `"
+    allowed_mechanisms: [PLAIN]
+  - username: carol@example.com
+    password: s3cret
+    active: false
+`
+
+func writeUsersFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadUsersFile(t *testing.T) {
+	users, err := LoadUsersFile(writeUsersFile(t, "users.yaml", testUsersYAML))
+	if err != nil {
+		t.Fatalf("LoadUsersFile(yaml) failed: %v", err)
+	}
+	if len(users) != 3 || users[0].Quota != 1000 || users[0].Metadata["plan"] != "pro" ||
+		users[1].PasswordHash != testBcryptHash || users[2].Active == nil || *users[2].Active {
+		t.Fatalf("unexpected users %+v", users)
+	}
+
+	users, err = LoadUsersFile(writeUsersFile(t, "users.json", `{"users": [{"username": "dave@example.com", "password": "pw"}]}`))
+	if err != nil || len(users) != 1 || users[0].Password != "pw" {
+		t.Fatalf("LoadUsersFile(json) = %+v, %v", users, err)
+	}
+
+	htpasswd := "# comment\nalice@example.com:" + testBcryptHash + "\n\nbob@example.com:" + testSHA512CryptHash + ":19000:0:99999:7:::\n"
+	users, err = LoadUsersFile(writeUsersFile(t, ".htpasswd", htpasswd))
+	if err != nil || len(users) != 2 || users[1].Username != "bob@example.com" || users[1].PasswordHash != testSHA512CryptHash {
+		t.Fatalf("LoadUsersFile(htpasswd) = %+v, %v", users, err)
+	}
+
+	if _, err := LoadUsersFile(writeUsersFile(t, "broken.htpasswd", "no-hash-here\n")); err == nil {
+		t.Error("expected a line without a hash to fail")
+	}
+}
+
+func TestUserAuthenticatorUserDatabase(t *testing.T) {
+	users, err := LoadUsersFile(writeUsersFile(t, "users.yaml", testUsersYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewUserAuthenticator(nil)
+	if err := a.SetUsers(users); err != nil {
+		t.Fatalf("SetUsers failed: %v", err)
+	}
+
+	alice, err := a.Authenticate("alice@example.com", "s3cret")
+	if err != nil {
+		t.Fatalf("expected alice to authenticate: %v", err)
+	}
+	if alice.Metadata[MetadataQuota] != int64(1000) || alice.Metadata["plan"] != "pro" {
+		t.Errorf("unexpected metadata %v", alice.Metadata)
+	}
+
+	if _, err := a.Authenticate("bob@example.com", "secret"); err != nil {
+		t.Errorf("expected bob's bcrypt password to verify: %v", err)
+	}
+	if _, err := a.Authenticate("bob@example.com", "s3cret"); err == nil {
+		t.Error("expected a wrong password to fail against the hash")
+	}
+	if _, ok := a.LookupSecret("bob@example.com"); ok {
+		t.Error("expected no cleartext secret for a hashed password")
+	}
+	if _, err := a.AuthenticateCredentials(&auth.Credentials{Mechanism: auth.AuthMechanismLogin, Username: "bob@example.com", Password: "secret"}); err == nil {
+		t.Error("expected LOGIN to be refused outside bob's allowed mechanisms")
+	}
+
+	carol, err := a.Authenticate("carol@example.com", "s3cret")
+	if err != nil || carol.Active {
+		t.Errorf("expected carol to authenticate as inactive, got %+v (%v)", carol, err)
+	}
+
+	if err := a.SetUsers([]AuthUser{{Username: "eve@example.com", PasswordHash: "$1$md5$notsupported"}}); err == nil {
+		t.Error("expected an unsupported hash to be reported")
+	}
+	if _, err := a.Authenticate("alice@example.com", "s3cret"); err != nil {
+		t.Error("expected the previous users to be kept after a failed update")
+	}
+}
+
+func TestSessionUserDatabase(t *testing.T) {
+	cfg := &Config{Port: 2525, MessageStore: nopStore{}, AuthUsersFile: writeUsersFile(t, "users.yaml", testUsersYAML)}
+	cfg.EnsureDefaults()
+	if err := cfg.loadUsers(); err != nil {
+		t.Fatalf("loadUsers failed: %v", err)
+	}
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	cmd := paramSession(t, cfg, "nopipelining.example.com")
+	if got := cmd("AUTH PLAIN " + b64("\x00carol@example.com\x00s3cret")); !strings.Contains(got, "account inactive") {
+		t.Fatalf("expected inactive account to be refused, got %q", got)
+	}
+	if got := cmd("AUTH PLAIN " + b64("\x00alice@example.com\x00s3cret")); !strings.HasPrefix(got, "235") {
+		t.Fatalf("expected alice to authenticate, got %q", got)
+	}
+	if got := cmd("MAIL FROM:<other@example.com>"); !strings.HasPrefix(got, "550 5.7.1") {
+		t.Fatalf("expected sender outside alice's allowed senders to be refused, got %q", got)
+	}
+	cmd("MAIL FROM:<alice@example.com>")
+	cmd("RCPT TO:<user@example.com>")
+	cmd("DATA")
+	if got := cmd("Subject: big\r\n\r\n" + strings.Repeat("x", 2000) + "\r\n."); !strings.HasPrefix(got, "552 5.2.2") {
+		t.Fatalf("expected message over alice's quota to be refused, got %q", got)
+	}
+}
+
+func TestServerReloadsUsersFile(t *testing.T) {
+	path := writeUsersFile(t, "users.htpasswd", "alice@example.com:"+testBcryptHash+"\n")
+	cfg := &Config{Port: 2525, AuthUsersFile: path}
+	cfg.EnsureDefaults()
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	srv.watchUsersFile()
+	t.Cleanup(func() {
+		for _, stop := range srv.stopWatchers {
+			stop()
+		}
+	})
+
+	if _, err := cfg.Authenticator.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("expected alice to authenticate: %v", err)
+	}
+
+	// A broken file keeps the current users
+	if err := os.WriteFile(path, []byte("broken\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * fileWatchDebounce)
+	if _, err := cfg.Authenticator.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("expected alice to survive a broken reload: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("bob@example.com:"+testSHA512CryptHash+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := cfg.Authenticator.Authenticate("bob@example.com", "secret")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("users file was not reloaded: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := cfg.Authenticator.Authenticate("alice@example.com", "secret"); err == nil {
+		t.Error("expected alice to be removed by the reload")
+	}
+}
+
+func TestServerRejectsInvalidUsers(t *testing.T) {
+	for _, users := range [][]AuthUser{
+		{{Username: "alice@example.com", PasswordHash: "$2a$10$typo"}},
+		{{Username: "alice@example.com", PasswordHash: testSHA512CryptHash + "x"}},
+		{{Password: "s3cret"}},
+	} {
+		cfg := &Config{Port: 2525, MessageStore: nopStore{}, AuthUsers: users}
+		cfg.EnsureDefaults()
+		if _, err := NewServer(cfg); err == nil {
+			t.Errorf("expected NewServer to reject users %+v", users)
+		}
+	}
+}
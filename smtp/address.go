@@ -9,6 +9,10 @@ import (
 
 const maxASCII = 127
 
+// PostmasterMailbox is the domain-less recipient that every SMTP server must accept
+// (RFC 5321 section 4.5.1). It is matched case-insensitively.
+const PostmasterMailbox = "postmaster"
+
 var asciiLocalRe = regexp.MustCompile(`^[a-zA-Z0-9.!#$%&'*+/=?^_` + "`" + `{|}~-]+$`)
 var angleAddrRe = regexp.MustCompile(`<([^>]+)>`)
 
@@ -34,6 +38,20 @@ func ExtractMailboxFromArg(arg string) string {
 	return strings.Trim(arg, "<>")
 }
 
+// IsNullReversePath reports whether a MAIL argument carries the null reverse-path "<>"
+// used as the sender of bounces and DSNs (RFC 5321 section 4.5.5), e.g. "FROM:<>".
+func IsNullReversePath(arg string) bool {
+	if len(arg) >= 5 && strings.EqualFold(arg[:5], "FROM:") {
+		arg = arg[5:]
+	}
+	return strings.TrimSpace(arg) == "<>"
+}
+
+// IsPostmaster reports whether mailbox is the bare "postmaster" recipient, without a domain.
+func IsPostmaster(mailbox string) bool {
+	return strings.EqualFold(strings.TrimSpace(mailbox), PostmasterMailbox)
+}
+
 // NormaliseMailbox returns the mailbox in a canonical form where the local part
 // preserves case and the domain is lowercased (common mailserver behaviour).
 // If the input is empty, returns empty string.
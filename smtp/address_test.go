@@ -80,3 +80,25 @@ func TestQuotedLocalPart(t *testing.T) {
 		}
 	}
 }
+
+func TestNullReversePathAndPostmaster(t *testing.T) {
+	nullCases := map[string]bool{
+		"FROM:<>":                 true,
+		"from:<>":                 true,
+		"<>":                      true,
+		"FROM:<user@example.com>": false,
+		"FROM:":                   false,
+	}
+	for arg, want := range nullCases {
+		if got := IsNullReversePath(arg); got != want {
+			t.Fatalf("IsNullReversePath(%q) = %v; want %v", arg, got, want)
+		}
+	}
+
+	if addr := ExtractMailboxFromArg("TO:<Postmaster>"); !IsPostmaster(addr) {
+		t.Fatalf("expected TO:<Postmaster> to be recognised as postmaster, got %q", addr)
+	}
+	if IsPostmaster("postmaster@example.com") {
+		t.Fatal("postmaster with a domain is an ordinary mailbox")
+	}
+}
@@ -11,6 +11,7 @@ import (
 const (
 	CmdHELO     = "HELO"
 	CmdEHLO     = "EHLO"
+	CmdLHLO     = "LHLO" // LMTP greeting (RFC 2033)
 	CmdAUTH     = "AUTH"
 	CmdMAIL     = "MAIL"
 	CmdRCPT     = "RCPT"
@@ -47,6 +48,7 @@ func (c *Command) IsValid() bool {
 	validCommands := map[string]bool{
 		CmdHELO:     true,
 		CmdEHLO:     true,
+		CmdLHLO:     true,
 		CmdAUTH:     true,
 		CmdMAIL:     true,
 		CmdRCPT:     true,
@@ -77,6 +79,12 @@ func (c *Command) ValidateArgs() error {
 			}
 			return nil
 		},
+		CmdLHLO: func() error {
+			if len(c.Args) < 1 {
+				return fmt.Errorf("501 Syntax error in parameters")
+			}
+			return nil
+		},
 		CmdAUTH: func() error {
 			if len(c.Args) < 1 {
 				return fmt.Errorf("501 Syntax error in parameters")
@@ -217,6 +225,7 @@ func (c *Command) IsAllowedInState(state State) bool {
 	allowed := map[string]map[State]bool{
 		CmdHELO:     {StateHelo: true, StateMail: true},
 		CmdEHLO:     {StateHelo: true, StateMail: true},
+		CmdLHLO:     {StateHelo: true, StateMail: true},
 		CmdAUTH:     {StateMail: true, StateAuth: true},
 		CmdMAIL:     {StateMail: true},
 		CmdRCPT:     {StateRcpt: true},
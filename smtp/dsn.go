@@ -0,0 +1,117 @@
+package smtp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DSN actions reported in the Action field of a delivery-status report (RFC 3464 section 2.3.3).
+const (
+	DSNActionFailed    = "failed"
+	DSNActionDelayed   = "delayed"
+	DSNActionDelivered = "delivered"
+)
+
+// DSN NOTIFY conditions (RFC 3461 section 4.1).
+const (
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+)
+
+var dsnRegex = regexp.MustCompile(`^dsn(fail|delay|success)(?:_(\d)\.(\d{1,3})\.(\d{1,3}))?@`)
+
+// DSNTrigger describes the delivery status notification requested by a recipient
+// address such as dsnfail_5.1.1@example.com or dsndelay@example.com.
+type DSNTrigger struct {
+	Action string // One of DSNActionFailed, DSNActionDelayed or DSNActionDelivered
+	Status string // RFC 3463 status code, e.g. "5.1.1"
+}
+
+// Code returns the SMTP reply code matching the trigger's status class.
+func (t *DSNTrigger) Code() int {
+	switch {
+	case strings.HasPrefix(t.Status, "5."):
+		return Code550
+	case strings.HasPrefix(t.Status, "4."):
+		return Code450
+	default:
+		return Code250
+	}
+}
+
+// Condition returns the NOTIFY condition that must be requested for the trigger's DSN.
+func (t *DSNTrigger) Condition() string {
+	switch t.Action {
+	case DSNActionDelayed:
+		return NotifyDelay
+	case DSNActionDelivered:
+		return NotifySuccess
+	default:
+		return NotifyFailure
+	}
+}
+
+// ExtractDSNTrigger extracts a DSN request from a recipient address. The forms are
+// dsnfail@, dsndelay@ and dsnsuccess@, optionally with an RFC 3463 status such as
+// dsnfail_5.1.1@. Without a status, failures report 5.0.0, delays 4.0.0 and
+// successes 2.0.0.
+func ExtractDSNTrigger(email string) *DSNTrigger {
+	matches := dsnRegex.FindStringSubmatch(strings.ToLower(email))
+	if matches == nil {
+		return nil
+	}
+
+	trigger := &DSNTrigger{}
+	switch matches[1] {
+	case "fail":
+		trigger.Action, trigger.Status = DSNActionFailed, "5.0.0"
+	case "delay":
+		trigger.Action, trigger.Status = DSNActionDelayed, "4.0.0"
+	default:
+		trigger.Action, trigger.Status = DSNActionDelivered, "2.0.0"
+	}
+	if matches[2] != "" {
+		trigger.Status = fmt.Sprintf("%s.%s.%s", matches[2], matches[3], matches[4])
+	}
+	return trigger
+}
+
+// NotifyConditions returns the set of conditions requested by a NOTIFY parameter
+// value. An empty value means the RFC 3461 default of FAILURE and DELAY; NEVER
+// yields an empty set.
+func NotifyConditions(value string) map[string]bool {
+	if value == "" {
+		return map[string]bool{NotifyFailure: true, NotifyDelay: true}
+	}
+	conditions := make(map[string]bool)
+	for _, v := range strings.Split(strings.ToUpper(value), ",") {
+		if v != NotifyNever {
+			conditions[v] = true
+		}
+	}
+	return conditions
+}
+
+// DecodeXText decodes RFC 3461 xtext, replacing "+XX" escapes with the byte they encode.
+// Invalid escapes are left as-is.
+func DecodeXText(s string) string {
+	if !strings.Contains(s, "+") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -12,6 +12,7 @@ var (
 	extendedRegex = regexp.MustCompile(`^([a-z]+)(\d{3})_(\d+)\.(\d+)\.(\d+)@`)
 	basicRegex    = regexp.MustCompile(`^([a-z]+)(\d{3})@`)
 	heloRegex     = regexp.MustCompile(`^(?:helo|ehlo)(\d{3})\.`)
+	certRegex     = regexp.MustCompile(`^cert(\d{3})(?:_(\d+)\.(\d+)\.(\d+))?(?:[.@]|$)`)
 )
 
 //nolint:revive // exported constants are intentionally grouped here
@@ -27,21 +28,27 @@ const (
 	Code250 = 250
 	Code354 = 354
 	Code421 = 421
+	Code432 = 432
 	Code450 = 450
 	Code451 = 451
 	Code452 = 452
+	Code454 = 454
 	Code500 = 500
 	Code501 = 501
 	Code502 = 502
 	Code503 = 503
 	Code504 = 504
 	Code521 = 521
+	Code530 = 530
+	Code534 = 534
 	Code535 = 535
+	Code538 = 538
 	Code550 = 550
 	Code551 = 551
 	Code552 = 552
 	Code553 = 553
 	Code554 = 554
+	Code555 = 555
 	Code571 = 571
 )
 
@@ -63,6 +70,7 @@ var errorMessages = map[int]string{
 	Code552: "Requested mail action aborted: exceeded storage allocation",
 	Code553: "Requested action not taken: mailbox name not allowed",
 	Code554: "Transaction failed",
+	Code555: "MAIL FROM/RCPT TO parameters not recognized or not implemented", //nolint:misspell // RFC 5321 uses US spelling
 	Code571: "Blocked - see https://example.com/blocked",
 }
 
@@ -71,6 +79,16 @@ type ErrorResult struct {
 	Code     int    // Main 3-digit error code (e.g., 550)
 	Enhanced string // Optional enhanced code (e.g., "5.7.1")
 	Message  string // Full error message
+	Text     string // Optional response text; the standard message for Code is used when empty
+}
+
+// ResponseText returns the text sent after the reply code(s): Text if set, otherwise
+// the standard message for Code.
+func (e *ErrorResult) ResponseText() string {
+	if e.Text != "" {
+		return e.Text
+	}
+	return GetErrorMessage(e.Code)
 }
 
 // CodeForMessage attempts to find an SMTP code whose standard message is contained in the provided msg.
@@ -120,6 +138,10 @@ func ExtractMailFromError(email string) *ErrorResult { return parsePrefixedError
 // ExtractRcptToError extracts error code from RCPT TO addresses.
 func ExtractRcptToError(email string) *ErrorResult { return parsePrefixedError("rcpt", email) }
 
+// ExtractRcptDataError extracts the post-DATA reply for one recipient in LMTP mode
+// from RCPT TO addresses (e.g. rcptdata452_4.2.2@example.com).
+func ExtractRcptDataError(email string) *ErrorResult { return parsePrefixedError("rcptdata", email) }
+
 // ExtractDataError extracts error code for DATA phase from MAIL FROM addresses.
 func ExtractDataError(email string) *ErrorResult { return parsePrefixedError("data", email) }
 
@@ -141,6 +163,34 @@ func ExtractNoopError(email string) *ErrorResult { return parsePrefixedError("no
 // ExtractAuthError extracts error code for AUTH command from MAIL FROM addresses.
 func ExtractAuthError(email string) *ErrorResult { return parsePrefixedError("auth", email) }
 
+// authReplies are the RFC 4954 enhanced status codes and reply texts for AUTH failures,
+// used when an auth<NNN>@ username does not give an enhanced code.
+var authReplies = map[int]struct{ enhanced, text string }{
+	Code432: {"4.7.12", "A password transition is needed"},
+	Code454: {"4.7.0", "Temporary authentication failure"},
+	Code534: {"5.7.9", "Authentication mechanism is too weak"},
+	Code535: {"5.7.8", "Authentication credentials invalid"},
+	Code538: {"5.7.11", "Encryption required for requested authentication mechanism"},
+}
+
+// ExtractAuthUserError extracts the AUTH reply from the username a client authenticated
+// with (e.g. auth454@example.com, auth535_5.7.0@example.com). The RFC 4954 reply codes
+// get their standard text, and their enhanced code when the pattern does not give one.
+func ExtractAuthUserError(username string) *ErrorResult {
+	result := parsePrefixedError("auth", username)
+	if result == nil {
+		return nil
+	}
+	if reply, ok := authReplies[result.Code]; ok {
+		if result.Enhanced == "" {
+			result.Enhanced = reply.enhanced
+		}
+		result.Text = reply.text
+		result.Message = fmt.Sprintf("%d %s %s", result.Code, result.Enhanced, reply.text)
+	}
+	return result
+}
+
 // ExtractHeloError extracts error code from HELO/EHLO hostname (different pattern).
 func ExtractHeloError(hostname string) *ErrorResult {
 	hostname = strings.ToLower(hostname)
@@ -152,6 +202,25 @@ func ExtractHeloError(hostname string) *ErrorResult {
 	return nil
 }
 
+// ExtractCertError extracts the error code from a TLS client certificate common name,
+// which may be a hostname or an address (e.g. cert550.relay.example.com,
+// cert454_4.7.0@example.com or just cert535).
+func ExtractCertError(commonName string) *ErrorResult {
+	matches := certRegex.FindStringSubmatch(strings.ToLower(commonName))
+	if matches == nil {
+		return nil
+	}
+	code, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return nil
+	}
+	if matches[2] == "" {
+		return &ErrorResult{Code: code, Message: fmt.Sprintf("%d %s", code, GetErrorMessage(code))}
+	}
+	enhanced := fmt.Sprintf("%s.%s.%s", matches[2], matches[3], matches[4])
+	return &ErrorResult{Code: code, Enhanced: enhanced, Message: fmt.Sprintf("%d %s %s", code, enhanced, GetErrorMessage(code))}
+}
+
 // GetErrorMessage returns a standard SMTP error message for the given error code.
 func GetErrorMessage(code int) string {
 	if msg, exists := errorMessages[code]; exists {
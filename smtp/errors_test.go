@@ -109,6 +109,7 @@ func TestExtractRcptToError(t *testing.T) {
 		{"Too many extended digits", "rcpt550_5712@example.com", 0, "", true},
 		{"Too few error digits", "rcpt45@example.com", 0, "", true},
 		{"Too many error digits", "rcpt4521@example.com", 0, "", true},
+		{"Post-DATA pattern is not a RCPT error", "rcptdata452@example.com", 0, "", true},
 	}
 
 	for _, test := range tests {
@@ -134,6 +135,68 @@ func TestExtractRcptToError(t *testing.T) {
 	}
 }
 
+func TestExtractRcptDataError(t *testing.T) {
+	if result := ExtractRcptDataError("rcptdata452_4.2.2@example.com"); result == nil || result.Code != 452 || result.Enhanced != "4.2.2" {
+		t.Errorf("ExtractRcptDataError(rcptdata452_4.2.2@...) = %+v, expected 452 4.2.2", result)
+	}
+	if result := ExtractRcptDataError("rcptdata550@example.com"); result == nil || result.Code != 550 {
+		t.Errorf("ExtractRcptDataError(rcptdata550@...) = %+v, expected 550", result)
+	}
+	if result := ExtractRcptDataError("rcpt452@example.com"); result != nil {
+		t.Errorf("ExtractRcptDataError(rcpt452@...) should return nil but got %+v", result)
+	}
+}
+
+func TestExtractAuthUserError(t *testing.T) {
+	tests := []struct {
+		username string
+		code     int
+		enhanced string
+	}{
+		{"auth454@example.com", 454, "4.7.0"},
+		{"auth534@example.com", 534, "5.7.9"},
+		{"auth538@example.com", 538, "5.7.11"},
+		{"auth432@example.com", 432, "4.7.12"},
+		{"auth535_5.7.0@example.com", 535, "5.7.0"},
+		{"auth421@example.com", 421, ""},
+	}
+	for _, test := range tests {
+		result := ExtractAuthUserError(test.username)
+		if result == nil || result.Code != test.code || result.Enhanced != test.enhanced {
+			t.Errorf("ExtractAuthUserError(%s) = %+v, expected %d %s", test.username, result, test.code, test.enhanced)
+		}
+	}
+	if result := ExtractAuthUserError("goodauth@example.com"); result != nil {
+		t.Errorf("ExtractAuthUserError(goodauth@...) should return nil but got %+v", result)
+	}
+	if result := ExtractAuthUserError("auth454@example.com"); result.Message != "454 4.7.0 Temporary authentication failure" {
+		t.Errorf("unexpected message %q", result.Message)
+	}
+}
+
+func TestExtractCertError(t *testing.T) {
+	tests := []struct {
+		commonName string
+		code       int
+		enhanced   string
+	}{
+		{"cert550.relay.example.com", 550, ""},
+		{"cert454_4.7.0@example.com", 454, "4.7.0"},
+		{"CERT535", 535, ""},
+	}
+	for _, test := range tests {
+		result := ExtractCertError(test.commonName)
+		if result == nil || result.Code != test.code || result.Enhanced != test.enhanced {
+			t.Errorf("ExtractCertError(%s) = %+v, expected %d %s", test.commonName, result, test.code, test.enhanced)
+		}
+	}
+	for _, commonName := range []string{"relay.example.com", "cert550x.example.com", "mycert550.example.com"} {
+		if result := ExtractCertError(commonName); result != nil {
+			t.Errorf("ExtractCertError(%s) should return nil but got %+v", commonName, result)
+		}
+	}
+}
+
 func TestExtractDataError(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -0,0 +1,212 @@
+package smtp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ESMTP parameter keywords accepted on MAIL FROM and RCPT TO.
+const (
+	ParamSize     = "SIZE"     // RFC 1870 declared message size
+	ParamBody     = "BODY"     // RFC 6152 / RFC 3030 body type
+	ParamSMTPUTF8 = "SMTPUTF8" // RFC 6531 internationalised message
+	ParamAuth     = "AUTH"     // RFC 4954 original submitter identity
+	ParamRet      = "RET"      // RFC 3461 DSN return content
+	ParamEnvID    = "ENVID"    // RFC 3461 DSN envelope identifier
+	ParamNotify   = "NOTIFY"   // RFC 3461 DSN notification conditions
+	ParamOrcpt    = "ORCPT"    // RFC 3461 DSN original recipient
+)
+
+// BODY parameter values.
+const (
+	Body7Bit       = "7BIT"
+	Body8BitMIME   = "8BITMIME"
+	BodyBinaryMIME = "BINARYMIME"
+)
+
+// maxEnvIDLength is the RFC 3461 maximum length of an ENVID value.
+const maxEnvIDLength = 100
+
+// mailParams and rcptParams list the parameters recognised on each command.
+var (
+	mailParams = map[string]bool{
+		ParamSize: true, ParamBody: true, ParamSMTPUTF8: true, ParamAuth: true, ParamRet: true, ParamEnvID: true,
+	}
+	rcptParams = map[string]bool{
+		ParamNotify: true, ParamOrcpt: true,
+	}
+)
+
+// Parameters holds ESMTP parameters keyed by upper-cased keyword. Keyword-only
+// parameters such as SMTPUTF8 have an empty value.
+type Parameters map[string]string
+
+// Has reports whether the parameter keyword was supplied.
+func (p Parameters) Has(keyword string) bool {
+	_, ok := p[strings.ToUpper(keyword)]
+	return ok
+}
+
+// Get returns the value of the parameter keyword, or "" if it was not supplied.
+func (p Parameters) Get(keyword string) string {
+	return p[strings.ToUpper(keyword)]
+}
+
+// ParamError describes an ESMTP parameter that was rejected.
+type ParamError struct {
+	Code     int    // 3-digit SMTP response code
+	Enhanced string // RFC 3463 enhanced status code
+	Message  string // Human-readable response text
+}
+
+// Error implements the error interface.
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("%d %s %s", e.Code, e.Enhanced, e.Message)
+}
+
+func paramSyntaxError(format string, args ...interface{}) *ParamError {
+	return &ParamError{Code: Code501, Enhanced: "5.5.4", Message: fmt.Sprintf(format, args...)}
+}
+
+// UnsupportedParamError returns the 555 5.5.4 error for a parameter that is not
+// recognised or whose extension is not enabled (RFC 5321 section 4.1.1.11).
+func UnsupportedParamError(keyword string) *ParamError {
+	return &ParamError{Code: Code555, Enhanced: "5.5.4", Message: fmt.Sprintf("%s parameter not recognised or not implemented", keyword)}
+}
+
+// ParseParameters parses the "KEYWORD[=VALUE]" arguments that follow the address in
+// MAIL FROM or RCPT TO. Keywords are case-insensitive; a malformed or repeated
+// parameter returns a 501 *ParamError.
+func ParseParameters(args []string) (Parameters, error) {
+	params := make(Parameters, len(args))
+	for _, arg := range args {
+		keyword, value, hasValue := strings.Cut(arg, "=")
+		keyword = strings.ToUpper(keyword)
+		if !isParamKeyword(keyword) {
+			return nil, paramSyntaxError("Malformed parameter %q", arg)
+		}
+		if hasValue && value == "" {
+			return nil, paramSyntaxError("Missing value for %s parameter", keyword)
+		}
+		if _, dup := params[keyword]; dup {
+			return nil, paramSyntaxError("Duplicate %s parameter", keyword)
+		}
+		params[keyword] = value
+	}
+	return params, nil
+}
+
+// isParamKeyword reports whether s is a valid esmtp-keyword: ALPHA / DIGIT followed by
+// ALPHA / DIGIT / "-" (RFC 5321 section 4.1.2).
+func isParamKeyword(s string) bool {
+	if s == "" || s[0] == '-' {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateParameter checks that keyword is recognised on command (CmdMAIL or CmdRCPT)
+// and that its value is well formed. Unknown parameters return a 555 *ParamError and
+// malformed values a 501 *ParamError. Whether the extension is enabled for the session,
+// and any size limit, is for the caller to enforce.
+func ValidateParameter(command, keyword, value string) error {
+	keyword = strings.ToUpper(keyword)
+	known := mailParams
+	if command == CmdRCPT {
+		known = rcptParams
+	}
+	if !known[keyword] {
+		return UnsupportedParamError(keyword)
+	}
+
+	switch keyword {
+	case ParamSize:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil || strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+") {
+			return paramSyntaxError("Invalid SIZE value %q", value)
+		}
+	case ParamBody:
+		switch strings.ToUpper(value) {
+		case Body7Bit, Body8BitMIME, BodyBinaryMIME:
+		default:
+			return paramSyntaxError("Invalid BODY value %q", value)
+		}
+	case ParamSMTPUTF8:
+		if value != "" {
+			return paramSyntaxError("SMTPUTF8 parameter takes no value")
+		}
+	case ParamAuth:
+		if value != "<>" && !IsXText(value) {
+			return paramSyntaxError("Invalid AUTH value %q", value)
+		}
+	case ParamRet:
+		if !strings.EqualFold(value, "FULL") && !strings.EqualFold(value, "HDRS") {
+			return paramSyntaxError("Invalid RET value %q", value)
+		}
+	case ParamEnvID:
+		if len(value) > maxEnvIDLength || !IsXText(value) {
+			return paramSyntaxError("Invalid ENVID value %q", value)
+		}
+	case ParamNotify:
+		if !validNotify(value) {
+			return paramSyntaxError("Invalid NOTIFY value %q", value)
+		}
+	case ParamOrcpt:
+		addrType, addr, ok := strings.Cut(value, ";")
+		if !ok || !isParamKeyword(strings.ToUpper(addrType)) || !IsXText(addr) {
+			return paramSyntaxError("Invalid ORCPT value %q", value)
+		}
+	}
+	return nil
+}
+
+// validNotify reports whether value is "NEVER" or a comma-separated list of
+// SUCCESS, FAILURE and DELAY (RFC 3461 section 4.1).
+func validNotify(value string) bool {
+	if strings.EqualFold(value, "NEVER") {
+		return true
+	}
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(strings.ToUpper(value), ",") {
+		switch v {
+		case "SUCCESS", "FAILURE", "DELAY":
+			if seen[v] {
+				return false
+			}
+			seen[v] = true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// IsXText reports whether s is valid RFC 3461 xtext: printable ASCII other than "+" and
+// "=", with "+XX" hex escapes.
+func IsXText(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(s) || !isUpperHex(s[i+1]) || !isUpperHex(s[i+2]) {
+				return false
+			}
+			i += 2
+		case c == '=' || c < '!' || c > '~':
+			return false
+		}
+	}
+	return true
+}
+
+func isUpperHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'F')
+}
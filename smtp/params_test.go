@@ -0,0 +1,107 @@
+package smtp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseParameters(t *testing.T) {
+	params, err := ParseParameters([]string{"size=1000", "BODY=8BITMIME", "SMTPUTF8"})
+	if err != nil {
+		t.Fatalf("ParseParameters failed: %v", err)
+	}
+	if params.Get("SIZE") != "1000" || params.Get("body") != "8BITMIME" || !params.Has("SMTPUTF8") {
+		t.Fatalf("unexpected parameters %v", params)
+	}
+
+	for _, args := range [][]string{
+		{"SIZE="},
+		{"=100"},
+		{"SI ZE=1"},
+		{"SIZE=1", "size=2"},
+	} {
+		_, err := ParseParameters(args)
+		var perr *ParamError
+		if !errors.As(err, &perr) || perr.Code != Code501 {
+			t.Errorf("ParseParameters(%q) = %v; want 501 ParamError", args, err)
+		}
+	}
+}
+
+func TestValidateParameter(t *testing.T) {
+	cases := []struct {
+		command, keyword, value string
+		code                    int // 0 means valid
+	}{
+		{CmdMAIL, ParamSize, "12345", 0},
+		{CmdMAIL, ParamSize, "12k", Code501},
+		{CmdMAIL, ParamSize, "-1", Code501},
+		{CmdMAIL, ParamBody, "7bit", 0},
+		{CmdMAIL, ParamBody, "BINARYMIME", 0},
+		{CmdMAIL, ParamBody, "9BIT", Code501},
+		{CmdMAIL, ParamSMTPUTF8, "", 0},
+		{CmdMAIL, ParamSMTPUTF8, "yes", Code501},
+		{CmdMAIL, ParamAuth, "<>", 0},
+		{CmdMAIL, ParamAuth, "alice+2Bsales@example.com", 0},
+		{CmdMAIL, ParamAuth, "alice+zz@example.com", Code501},
+		{CmdMAIL, ParamRet, "HDRS", 0},
+		{CmdMAIL, ParamRet, "BODY", Code501},
+		{CmdMAIL, ParamEnvID, "QQ314159", 0},
+		{CmdRCPT, ParamNotify, "SUCCESS,FAILURE", 0},
+		{CmdRCPT, ParamNotify, "NEVER", 0},
+		{CmdRCPT, ParamNotify, "NEVER,DELAY", Code501},
+		{CmdRCPT, ParamOrcpt, "rfc822;bob@example.com", 0},
+		{CmdRCPT, ParamOrcpt, "bob@example.com", Code501},
+		{CmdRCPT, ParamSize, "100", Code555},
+		{CmdMAIL, ParamNotify, "NEVER", Code555},
+		{CmdMAIL, "XFOO", "bar", Code555},
+	}
+	for _, c := range cases {
+		err := ValidateParameter(c.command, c.keyword, c.value)
+		var perr *ParamError
+		switch {
+		case c.code == 0 && err != nil:
+			t.Errorf("%s %s=%s: unexpected error %v", c.command, c.keyword, c.value, err)
+		case c.code != 0 && (!errors.As(err, &perr) || perr.Code != c.code):
+			t.Errorf("%s %s=%s: got %v, want code %d", c.command, c.keyword, c.value, err, c.code)
+		}
+	}
+}
+
+func TestExtractDSNTrigger(t *testing.T) {
+	cases := []struct {
+		email  string
+		action string
+		status string
+	}{
+		{"dsnfail_5.1.1@example.com", DSNActionFailed, "5.1.1"},
+		{"DSNFail@example.com", DSNActionFailed, "5.0.0"},
+		{"dsndelay@example.com", DSNActionDelayed, "4.0.0"},
+		{"dsndelay_4.4.7@example.com", DSNActionDelayed, "4.4.7"},
+		{"dsnsuccess@example.com", DSNActionDelivered, "2.0.0"},
+	}
+	for _, c := range cases {
+		trigger := ExtractDSNTrigger(c.email)
+		if trigger == nil || trigger.Action != c.action || trigger.Status != c.status {
+			t.Errorf("ExtractDSNTrigger(%q) = %+v; want %s %s", c.email, trigger, c.action, c.status)
+		}
+	}
+	if trigger := ExtractDSNTrigger("rcpt550@example.com"); trigger != nil {
+		t.Errorf("expected no trigger for ordinary error pattern, got %+v", trigger)
+	}
+}
+
+func TestNotifyConditionsAndXText(t *testing.T) {
+	if c := NotifyConditions(""); !c[NotifyFailure] || !c[NotifyDelay] || c[NotifySuccess] {
+		t.Errorf("unexpected default NOTIFY conditions %v", c)
+	}
+	if c := NotifyConditions("NEVER"); len(c) != 0 {
+		t.Errorf("expected no conditions for NEVER, got %v", c)
+	}
+	if c := NotifyConditions("success,delay"); !c[NotifySuccess] || !c[NotifyDelay] || c[NotifyFailure] {
+		t.Errorf("unexpected NOTIFY conditions %v", c)
+	}
+	if got := DecodeXText("rfc822;bob+2Bdsn@example.com"); got != "rfc822;bob+dsn@example.com" {
+		t.Errorf("DecodeXText = %q", got)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync/atomic"
@@ -22,6 +23,9 @@ const (
 )
 
 var messageCounter atomic.Int64
+
+// tokenRegex matches a token from a tok<id> EHLO label, which is safe as a folder name.
+var tokenRegex = regexp.MustCompile(`^[A-Za-z0-9]{1,59}$`)
 var (
 	loggerCfg = logging.DefaultConfig()
 	stdLogger = logging.NewStdoutLogger(&loggerCfg)
@@ -35,9 +39,17 @@ type Mailbox struct {
 
 // Message represents an email message.
 type Message struct {
-	From    string
-	To      []string
-	Content string
+	From     string
+	To       []string
+	Content  string
+	BodyType string // Declared BODY= type (7BIT, 8BITMIME, BINARYMIME); recorded when set
+
+	// Verified TLS client certificate of the sending client; recorded when set
+	ClientCertSubject string
+	ClientCertSANs    []string
+
+	// Token from the sender's tok<id> EHLO label; recorded when set
+	Token string
 }
 
 // remapUnixTmpOnWindows maps incoming unix-style /tmp or /var/tmp paths to the real OS temp dir on Windows.
@@ -213,7 +225,12 @@ func validatePathWithinDir(baseDir, targetPath string) error {
 // writeMessageToFile writes headers and body to the open file
 func writeMessageToFile(file *os.File, msg *Message) error {
 	// Write headers
-	if _, err := fmt.Fprintf(file, "From: %s\r\n", msg.From); err != nil {
+	// An empty sender is the null reverse-path used by bounces and DSNs
+	from := msg.From
+	if from == "" {
+		from = "<>"
+	}
+	if _, err := fmt.Fprintf(file, "From: %s\r\n", from); err != nil {
 		return err
 	}
 
@@ -228,6 +245,30 @@ func writeMessageToFile(file *os.File, msg *Message) error {
 		return err
 	}
 
+	if msg.BodyType != "" {
+		if _, err := fmt.Fprintf(file, "X-BadSMTP-Body-Type: %s\r\n", msg.BodyType); err != nil {
+			return err
+		}
+	}
+
+	if msg.ClientCertSubject != "" {
+		if _, err := fmt.Fprintf(file, "X-BadSMTP-Client-Cert-Subject: %s\r\n", msg.ClientCertSubject); err != nil {
+			return err
+		}
+	}
+
+	if len(msg.ClientCertSANs) > 0 {
+		if _, err := fmt.Fprintf(file, "X-BadSMTP-Client-Cert-SANs: %s\r\n", strings.Join(msg.ClientCertSANs, ", ")); err != nil {
+			return err
+		}
+	}
+
+	if msg.Token != "" {
+		if _, err := fmt.Fprintf(file, "X-BadSMTP-Token: %s\r\n", msg.Token); err != nil {
+			return err
+		}
+	}
+
 	if _, err := file.WriteString("\r\n"); err != nil {
 		return err
 	}
@@ -240,6 +281,28 @@ func writeMessageToFile(file *os.File, msg *Message) error {
 	return nil
 }
 
+// ValidToken reports whether token can name a token sub-mailbox.
+func ValidToken(token string) bool {
+	return tokenRegex.MatchString(token)
+}
+
+// TokenMailboxDir returns the sub-mailbox of the Maildir at dir that holds the messages
+// sent with token. It is a Maildir++ folder, so IMAP servers such as Dovecot show it as
+// a folder of the main mailbox.
+func TokenMailboxDir(dir, token string) string {
+	return filepath.Join(dir, "."+strings.ToLower(token))
+}
+
+// TokenMailbox returns the sub-mailbox holding the messages sent with token, creating it
+// if needed. Its ListMessages, DeleteMessage and Clear only see that token's messages, so
+// concurrent test runs can inspect and clean up their own mail.
+func (m *Mailbox) TokenMailbox(token string) (*Mailbox, error) {
+	if !ValidToken(token) {
+		return nil, fmt.Errorf("invalid token %q", token)
+	}
+	return NewMailbox(TokenMailboxDir(m.Directory, token))
+}
+
 // ListMessages lists all messages in the mailbox (from both new/ and cur/ directories).
 func (m *Mailbox) ListMessages() ([]string, error) {
 	var allFiles []string
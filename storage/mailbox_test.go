@@ -347,7 +347,138 @@ func TestSaveMessageEmpty(t *testing.T) {
 	}
 
 	if len(files) != 1 {
-		t.Errorf("Expected 1 message, got %d", len(files))
+		t.Fatalf("Expected 1 message, got %d", len(files))
+	}
+
+	// An empty sender is the null reverse-path
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if !strings.HasPrefix(string(content), "From: <>\r\n") {
+		t.Errorf("Expected null reverse-path From header, got %q", string(content))
+	}
+}
+
+func TestSaveMessageBodyType(t *testing.T) {
+	mailbox, err := NewMailbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create mailbox: %v", err)
+	}
+
+	message := &Message{
+		From:     "sender@example.com",
+		To:       []string{"recipient@example.com"},
+		Content:  "Subject: Binary\r\n\r\nbody",
+		BodyType: "BINARYMIME",
+	}
+	if err := mailbox.SaveMessage(message); err != nil {
+		t.Fatalf("Failed to save message: %v", err)
+	}
+
+	files, err := mailbox.ListMessages()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 message, got %d (%v)", len(files), err)
+	}
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if !strings.Contains(string(content), "X-BadSMTP-Body-Type: BINARYMIME\r\n") {
+		t.Errorf("Expected body type header, got %q", string(content))
+	}
+}
+
+func TestSaveMessageClientCertificate(t *testing.T) {
+	mailbox, err := NewMailbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create mailbox: %v", err)
+	}
+
+	message := &Message{
+		From:              "relay@example.com",
+		To:                []string{"recipient@example.com"},
+		Content:           "Subject: Relayed\r\n\r\nbody",
+		ClientCertSubject: "CN=relay.example.com",
+		ClientCertSANs:    []string{"DNS:relay.example.com", "email:relay@example.com"},
+	}
+	if err := mailbox.SaveMessage(message); err != nil {
+		t.Fatalf("Failed to save message: %v", err)
+	}
+
+	files, err := mailbox.ListMessages()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 message, got %d (%v)", len(files), err)
+	}
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	for _, header := range []string{
+		"X-BadSMTP-Client-Cert-Subject: CN=relay.example.com\r\n",
+		"X-BadSMTP-Client-Cert-SANs: DNS:relay.example.com, email:relay@example.com\r\n",
+	} {
+		if !strings.Contains(string(content), header) {
+			t.Errorf("Expected %q, got %q", header, string(content))
+		}
+	}
+}
+
+func TestSaveMessageToken(t *testing.T) {
+	mailbox, err := NewMailbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create mailbox: %v", err)
+	}
+
+	if err := mailbox.SaveMessage(&Message{From: "ci@example.com", Content: "body", Token: "job42"}); err != nil {
+		t.Fatalf("Failed to save message: %v", err)
+	}
+
+	files, err := mailbox.ListMessages()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 message, got %d (%v)", len(files), err)
+	}
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if !strings.Contains(string(content), "X-BadSMTP-Token: job42\r\n") {
+		t.Errorf("Expected token header, got %q", string(content))
+	}
+}
+
+func TestTokenMailbox(t *testing.T) {
+	mailbox, err := NewMailbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create mailbox: %v", err)
+	}
+	tokenMailbox, err := mailbox.TokenMailbox("JobA")
+	if err != nil {
+		t.Fatalf("Failed to open token mailbox: %v", err)
+	}
+	if want := filepath.Join(mailbox.Directory, ".joba"); tokenMailbox.Directory != want {
+		t.Errorf("Expected token mailbox %s, got %s", want, tokenMailbox.Directory)
+	}
+
+	for _, m := range []*Mailbox{mailbox, tokenMailbox} {
+		if err := m.SaveMessage(&Message{From: "ci@example.com", Content: "body"}); err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+	}
+	if files, err := tokenMailbox.ListMessages(); err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 token message, got %d (%v)", len(files), err)
+	}
+	if err := tokenMailbox.Clear(); err != nil {
+		t.Fatalf("Failed to clear token mailbox: %v", err)
+	}
+	if files, err := mailbox.ListMessages(); err != nil || len(files) != 1 {
+		t.Errorf("Expected clearing the token mailbox to keep the other message, got %d (%v)", len(files), err)
+	}
+
+	for _, token := range []string{"", "../escape", "job-a"} {
+		if _, err := mailbox.TokenMailbox(token); err == nil {
+			t.Errorf("Expected token %q to be refused", token)
+		}
 	}
 }
 